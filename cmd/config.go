@@ -0,0 +1,124 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"encoding/csv"
+	"fmt"
+	"os"
+	"strconv"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/pflag"
+	"github.com/spf13/viper"
+)
+
+// Prefix of the environment variables overriding the flags, e.g.
+// GO_DEPLOY_CONCURRENCY for --concurrency
+const envPrefix = "GO_DEPLOY"
+
+// applyConfig sets the flags of cmd that were not given on the command line.
+// The environment variables have precedence over the settings of the target,
+// which have precedence over the top-level settings of the config file.
+func applyConfig(cmd *cobra.Command, target *viper.Viper) error {
+	var err error
+	cmd.Flags().VisitAll(func(f *pflag.Flag) {
+		if err != nil || f.Changed || f.Name == "config" || f.Name == "help" {
+			return
+		}
+
+		value, source, found := configValue(f.Name, target)
+		if !found {
+			return
+		}
+
+		s, convErr := flagValue(value)
+		if convErr == nil {
+			convErr = cmd.Flags().Set(f.Name, s)
+		}
+		if convErr != nil {
+			err = fmt.Errorf("Invalid value for %s in %s: %s", f.Name, source, convErr)
+		}
+	})
+	return err
+}
+
+func configValue(name string, target *viper.Viper) (interface{}, string, bool) {
+	envName := envPrefix + "_" + strings.ToUpper(strings.Replace(name, "-", "_", -1))
+	if value, exists := os.LookupEnv(envName); exists {
+		return value, envName, true
+	}
+	if target != nil && target.IsSet(name) {
+		return target.Get(name), viper.ConfigFileUsed(), true
+	}
+	if viper.IsSet(name) {
+		return viper.Get(name), viper.ConfigFileUsed(), true
+	}
+	return nil, "", false
+}
+
+// Convert a setting of the config file to the string representation of a
+// flag value, lists being comma separated
+func flagValue(value interface{}) (string, error) {
+	switch v := value.(type) {
+	case string:
+		return v, nil
+	case float64:
+		return strconv.FormatFloat(v, 'f', -1, 64), nil
+	case []string:
+		return csvLine(v)
+	case []interface{}:
+		items := make([]string, len(v))
+		for i, item := range v {
+			s, err := flagValue(item)
+			if err != nil {
+				return "", err
+			}
+			items[i] = s
+		}
+		return csvLine(items)
+	case map[string]interface{}, map[interface{}]interface{}:
+		return "", fmt.Errorf("expected a value or a list, got a map")
+	default:
+		return fmt.Sprint(v), nil
+	}
+}
+
+// Join values the way the slice flags split them, quoting the ones that
+// contain a comma
+func csvLine(values []string) (string, error) {
+	var b bytes.Buffer
+	w := csv.NewWriter(&b)
+	if err := w.Write(values); err != nil {
+		return "", err
+	}
+	w.Flush()
+	return strings.TrimSuffix(b.String(), "\n"), w.Error()
+}
+
+// targetConfig returns the settings of a target of the config file.
+func targetConfig(name string) (*viper.Viper, error) {
+	target := viper.Sub("targets." + name)
+	if target == nil {
+		if viper.ConfigFileUsed() == "" {
+			return nil, fmt.Errorf("Unknown target %s: no config file found", name)
+		}
+		return nil, fmt.Errorf("Unknown target %s in %s", name, viper.ConfigFileUsed())
+	}
+	return target, nil
+}
@@ -0,0 +1,226 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var testSettings = `
+concurrency: 2
+storage-class: STANDARD
+immutable: ["*.js", "a,b.css"]
+check-md5: true
+targets:
+  production:
+    concurrency: 4
+    storage-class: GLACIER
+  broken:
+    concurrency: many
+  nested:
+    immutable:
+      js: "*.js"
+`
+
+func readTestSettings(t *testing.T) {
+	viper.Reset()
+	viper.SetConfigType("yaml")
+	if err := viper.ReadConfig(strings.NewReader(testSettings)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func newConfigTestCommand() *cobra.Command {
+	cmd := &cobra.Command{Use: "test"}
+	cmd.Flags().IntP("concurrency", "", 10, "")
+	cmd.Flags().StringP("storage-class", "", "", "")
+	cmd.Flags().StringSliceP("immutable", "", []string{}, "")
+	cmd.Flags().BoolP("check-md5", "", false, "")
+	return cmd
+}
+
+// The command line, then the environment, then the target, then the
+// top-level settings
+func TestApplyConfigPrecedence(t *testing.T) {
+	readTestSettings(t)
+	defer viper.Reset()
+
+	type values struct {
+		concurrency  int
+		storageClass string
+		immutable    []string
+		checkMD5     bool
+	}
+	tests := []struct {
+		name   string
+		target string
+		env    map[string]string
+		flags  map[string]string
+		want   values
+	}{
+		{
+			name: "top-level",
+			want: values{2, "STANDARD", []string{"*.js", "a,b.css"}, true},
+		},
+		{
+			name:   "target",
+			target: "production",
+			want:   values{4, "GLACIER", []string{"*.js", "a,b.css"}, true},
+		},
+		{
+			name:   "environment",
+			target: "production",
+			env:    map[string]string{"GO_DEPLOY_CONCURRENCY": "8", "GO_DEPLOY_CHECK_MD5": "false"},
+			want:   values{8, "GLACIER", []string{"*.js", "a,b.css"}, false},
+		},
+		{
+			name:   "command line",
+			target: "production",
+			env:    map[string]string{"GO_DEPLOY_CONCURRENCY": "8"},
+			flags:  map[string]string{"concurrency": "16", "immutable": "*.css"},
+			want:   values{16, "GLACIER", []string{"*.css"}, true},
+		},
+	}
+
+	for _, test := range tests {
+		for name, value := range test.env {
+			os.Setenv(name, value)
+		}
+		cmd := newConfigTestCommand()
+		for name, value := range test.flags {
+			if err := cmd.Flags().Set(name, value); err != nil {
+				t.Fatal(err)
+			}
+		}
+
+		var target *viper.Viper
+		if test.target != "" {
+			var err error
+			if target, err = targetConfig(test.target); err != nil {
+				t.Fatal(err)
+			}
+		}
+		err := applyConfig(cmd, target)
+		for name := range test.env {
+			os.Unsetenv(name)
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+
+		var got values
+		got.concurrency, _ = cmd.Flags().GetInt("concurrency")
+		got.storageClass, _ = cmd.Flags().GetString("storage-class")
+		got.immutable, _ = cmd.Flags().GetStringSlice("immutable")
+		got.checkMD5, _ = cmd.Flags().GetBool("check-md5")
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s: got %+v, want %+v", test.name, got, test.want)
+		}
+	}
+}
+
+func TestApplyConfigErrors(t *testing.T) {
+	readTestSettings(t)
+	defer viper.Reset()
+
+	tests := []struct {
+		target string
+		err    string
+	}{
+		{"broken", `Invalid value for concurrency in : invalid argument "many" for "--concurrency" flag: strconv.ParseInt: parsing "many": invalid syntax`},
+		{"nested", "Invalid value for immutable in : expected a value or a list, got a map"},
+	}
+	for _, test := range tests {
+		target, err := targetConfig(test.target)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = applyConfig(newConfigTestCommand(), target)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%s: got %v, want %s", test.target, err, test.err)
+		}
+	}
+
+	if _, err := targetConfig("staging"); err == nil || err.Error() != "Unknown target staging: no config file found" {
+		t.Errorf("got %v for an unknown target", err)
+	}
+}
+
+func TestFlagValue(t *testing.T) {
+	tests := []struct {
+		value interface{}
+		want  string
+	}{
+		{"STANDARD", "STANDARD"},
+		{2.5, "2.5"},
+		{float64(300), "300"},
+		{1e21, "1000000000000000000000"},
+		{42, "42"},
+		{true, "true"},
+		{[]string{"*.js", "*.css"}, "*.js,*.css"},
+		{[]string{"a,b.css", `say "hi"`}, `"a,b.css","say ""hi"""`},
+		{[]interface{}{"*.js", 2.0, false}, "*.js,2,false"},
+		{[]interface{}{}, ""},
+	}
+	for _, test := range tests {
+		got, err := flagValue(test.value)
+		if err != nil || got != test.want {
+			t.Errorf("%#v: got %q %v, want %q", test.value, got, err, test.want)
+		}
+	}
+
+	for _, value := range []interface{}{
+		map[string]interface{}{"a": 1},
+		map[interface{}]interface{}{"a": 1},
+		[]interface{}{"a", map[string]interface{}{"b": 2}},
+	} {
+		if _, err := flagValue(value); err == nil {
+			t.Errorf("%#v: expected an error", value)
+		}
+	}
+}
+
+// The slice flags read back the values joined by csvLine
+func TestCSVLineRoundTrip(t *testing.T) {
+	tests := [][]string{
+		{"*.js"},
+		{"*.js", "*.css"},
+		{"a,b.css", "c"},
+		{`say "hi"`, "x"},
+		{" padded ", ""},
+	}
+	for _, values := range tests {
+		line, err := csvLine(values)
+		if err != nil {
+			t.Fatal(err)
+		}
+		cmd := newConfigTestCommand()
+		if err := cmd.Flags().Set("immutable", line); err != nil {
+			t.Fatalf("%q: %v", line, err)
+		}
+		got, _ := cmd.Flags().GetStringSlice("immutable")
+		if !reflect.DeepEqual(got, values) {
+			t.Errorf("%q: got %q, want %q", line, got, values)
+		}
+	}
+}
@@ -0,0 +1,111 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"fmt"
+	"strings"
+
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+// Scheme of the destinations of each target type, the other types being
+// schemes themselves
+var targetSchemes = map[string]string{
+	"volume": "file",
+}
+
+// deployCmd represents the deploy command
+var deployCmd = &cobra.Command{
+	Use:   "deploy <target|destination>",
+	Short: "Deploys to a target of the config file or to a destination URI",
+	Long: `Deploys the application to a target declared in the config file, or to a
+destination URI like file:///html_dir or s3://bucket/prefix. The settings can be
+overridden with flags or GO_DEPLOY_* environment variables, for instance
+GO_DEPLOY_CONCURRENCY=20.`,
+	Args: cobra.ExactArgs(1),
+	// The settings are applied by Run, once the target is known
+	PersistentPreRun: func(cmd *cobra.Command, args []string) {},
+	Run: func(cmd *cobra.Command, args []string) {
+		destination := args[0]
+		var target *viper.Viper
+		if !strings.Contains(destination, "://") {
+			var err error
+			target, err = targetConfig(args[0])
+			if err == nil {
+				destination, err = targetDestination(args[0], target)
+			}
+			if err == nil {
+				err = checkTargetSettings(cmd, args[0], target)
+			}
+			if err != nil {
+				log.Fatal(err)
+			}
+		}
+
+		if err := applyConfig(cmd, target); err != nil {
+			log.Fatal(err)
+		}
+		deployTo(cmd, destination)
+	},
+}
+
+// Returns the destination URI of a target, built from its destination and
+// its optional type
+func targetDestination(name string, target *viper.Viper) (string, error) {
+	destination := target.GetString("destination")
+	if destination == "" {
+		return "", fmt.Errorf("No destination for target %s", name)
+	}
+
+	targetType := target.GetString("type")
+	if targetType == "" {
+		return destination, nil
+	}
+	scheme, found := targetSchemes[targetType]
+	if !found {
+		scheme = targetType
+	}
+
+	if i := strings.Index(destination, "://"); i >= 0 {
+		if destination[:i] != scheme {
+			return "", fmt.Errorf("The destination %s of target %s does not match its type %s", destination, name, targetType)
+		}
+		return destination, nil
+	}
+	if scheme == "file" {
+		return destination, nil
+	}
+	return scheme + "://" + destination, nil
+}
+
+// Reports the settings of a target that are not flags of the deploy command,
+// usually typos
+func checkTargetSettings(cmd *cobra.Command, name string, target *viper.Viper) error {
+	for _, key := range target.AllKeys() {
+		if key != "type" && key != "destination" && cmd.Flags().Lookup(key) == nil {
+			return fmt.Errorf("Unknown setting %s for target %s", key, name)
+		}
+	}
+	return nil
+}
+
+func init() {
+	rootCmd.AddCommand(deployCmd)
+	addDotEnvFlags(deployCmd)
+	addSyncFlags(deployCmd)
+}
@@ -0,0 +1,84 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"testing"
+
+	"github.com/spf13/viper"
+)
+
+func newTarget(settings map[string]interface{}) *viper.Viper {
+	target := viper.New()
+	for key, value := range settings {
+		target.Set(key, value)
+	}
+	return target
+}
+
+func TestTargetDestination(t *testing.T) {
+	tests := []struct {
+		targetType  string
+		destination string
+		want        string
+	}{
+		{"", "s3://bucket/prefix", "s3://bucket/prefix"},
+		{"", "/var/www/html", "/var/www/html"},
+		{"volume", "/var/www/html", "/var/www/html"},
+		{"volume", "relative/html", "relative/html"},
+		{"volume", "file:///var/www/html", "file:///var/www/html"},
+		{"file", "/var/www/html", "/var/www/html"},
+		{"s3", "bucket/prefix", "s3://bucket/prefix"},
+		{"s3", "s3://bucket/prefix", "s3://bucket/prefix"},
+		{"gs", "bucket", "gs://bucket"},
+		{"sftp", "deploy@host/var/www", "sftp://deploy@host/var/www"},
+		{"git+ssh", "git@github.com/org/site.git", "git+ssh://git@github.com/org/site.git"},
+	}
+	for _, test := range tests {
+		target := newTarget(map[string]interface{}{"type": test.targetType, "destination": test.destination})
+		destination, err := targetDestination("site", target)
+		if err != nil || destination != test.want {
+			t.Errorf("%s %s: got %s %v, want %s", test.targetType, test.destination, destination, err, test.want)
+		}
+	}
+
+	errors := []struct {
+		settings map[string]interface{}
+		err      string
+	}{
+		{map[string]interface{}{"type": "s3"}, "No destination for target site"},
+		{map[string]interface{}{"type": "s3", "destination": "gs://bucket"}, "The destination gs://bucket of target site does not match its type s3"},
+		{map[string]interface{}{"type": "volume", "destination": "s3://bucket"}, "The destination s3://bucket of target site does not match its type volume"},
+	}
+	for _, test := range errors {
+		if _, err := targetDestination("site", newTarget(test.settings)); err == nil || err.Error() != test.err {
+			t.Errorf("%v: got %v, want %s", test.settings, err, test.err)
+		}
+	}
+}
+
+func TestCheckTargetSettings(t *testing.T) {
+	cmd := newConfigTestCommand()
+	target := newTarget(map[string]interface{}{"type": "s3", "destination": "bucket", "concurrency": 4})
+	if err := checkTargetSettings(cmd, "site", target); err != nil {
+		t.Error(err)
+	}
+
+	target.Set("concurency", 4)
+	if err := checkTargetSettings(cmd, "site", target); err == nil || err.Error() != "Unknown setting concurency for target site" {
+		t.Errorf("got %v", err)
+	}
+}
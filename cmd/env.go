@@ -0,0 +1,159 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"encoding/json"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+	"text/tabwriter"
+
+	"github.com/dmetzler/go-deploy/lib"
+	"github.com/spf13/cobra"
+)
+
+// envCmd represents the env command
+var envCmd = &cobra.Command{
+	Use:   "env",
+	Short: "Inspect the resolved runtime configuration",
+	Long: `Print, diff and validate the variables that would be written in the
+generated config, resolved exactly like the deploy commands do.`,
+}
+
+// envPrintCmd represents the env print command
+var envPrintCmd = &cobra.Command{
+	Use:   "print",
+	Short: "Print the resolved variables and where their values come from",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := dotEnvConfig(cmd)
+		err, vars := lib.GetVars(lookupSrcDir(), config)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		output, _ := cmd.Flags().GetString("output")
+		switch output {
+		case "table":
+			writeVarsTable(os.Stdout, vars)
+		case "json":
+			b, err := json.MarshalIndent(vars, "", "  ")
+			if err != nil {
+				log.Fatal(err)
+			}
+			fmt.Println(string(b))
+		case "dotenv":
+			for _, v := range vars {
+				fmt.Printf("# from %s\n%s=%s\n", v.Source, v.Name, dotEnvQuote(v.Value))
+			}
+		default:
+			log.Fatalf("Invalid output format %s (valid formats: table, json, dotenv)", output)
+		}
+	},
+}
+
+// envDiffCmd represents the env diff command
+var envDiffCmd = &cobra.Command{
+	Use:   "diff <target>",
+	Short: "Compare the resolved config with the one deployed on a target",
+	Long: `Compare the resolved config with the one deployed in a directory or in a
+bucket (s3://bucket/prefix, gs://bucket/prefix). Exits with status 1 when they differ.
+
+The json config is compared when it is generated. Otherwise a js config written
+by --template is compared with the object literal the template renders, which
+must be like the one of the js format.`,
+	Args: cobra.ExactArgs(1),
+	Run: func(cmd *cobra.Command, args []string) {
+		config := dotEnvConfig(cmd)
+		srcDir := lookupSrcDir()
+		err, vars := lib.GetVars(srcDir, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		changes, err := lib.DiffConfig(syncConfig(cmd), args[0], srcDir, vars, config)
+		if err != nil {
+			log.Fatal(err)
+		}
+
+		for _, change := range changes {
+			switch {
+			case change.Deployed == nil:
+				fmt.Printf("+ %s=%s\n", change.Name, *change.Resolved)
+			case change.Resolved == nil:
+				fmt.Printf("- %s=%s\n", change.Name, *change.Deployed)
+			default:
+				fmt.Printf("~ %s: %s -> %s\n", change.Name, *change.Deployed, *change.Resolved)
+			}
+		}
+		if len(changes) > 0 {
+			os.Exit(1)
+		}
+	},
+}
+
+// envCheckCmd represents the env check command
+var envCheckCmd = &cobra.Command{
+	Use:   "check",
+	Short: "Validate the resolved config without deploying it",
+	Run: func(cmd *cobra.Command, args []string) {
+		config := dotEnvConfig(cmd)
+		err, vars := lib.GetVars(lookupSrcDir(), config)
+		if err == nil {
+			err = lib.CheckSecrets(vars, config.AllowSecrets)
+		}
+		if err != nil {
+			fmt.Println(err)
+			os.Exit(1)
+		}
+		fmt.Printf("%d variables OK\n", len(vars))
+	},
+}
+
+// Write the variables in aligned columns, the values holding line breaks or
+// tabs being quoted so that each variable stays on its line
+func writeVarsTable(out io.Writer, vars []lib.EnvVar) {
+	w := tabwriter.NewWriter(out, 0, 4, 2, ' ', 0)
+	fmt.Fprintln(w, "NAME\tVALUE\tSOURCE")
+	for _, v := range vars {
+		value := v.Value
+		if strings.ContainsAny(value, "\n\r\t") {
+			value = dotEnvQuote(value)
+		}
+		fmt.Fprintf(w, "%s\t%s\t%s\n", v.Name, value, v.Source)
+	}
+	w.Flush()
+}
+
+// Quote a value so that the dotenv parser reads it back unchanged
+func dotEnvQuote(value string) string {
+	r := strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`, "\r", `\r`, "\t", `\t`, "$", "$$")
+	return `"` + r.Replace(value) + `"`
+}
+
+func init() {
+	rootCmd.AddCommand(envCmd)
+	envCmd.AddCommand(envPrintCmd)
+	envCmd.AddCommand(envDiffCmd)
+	envCmd.AddCommand(envCheckCmd)
+
+	addDotEnvFlags(envPrintCmd)
+	addDotEnvFlags(envDiffCmd)
+	addSyncFlags(envDiffCmd)
+	addDotEnvFlags(envCheckCmd)
+	envPrintCmd.Flags().StringP("output", "o", "table", "Output format: table, json or dotenv")
+}
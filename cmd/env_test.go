@@ -0,0 +1,44 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/dmetzler/go-deploy/lib"
+)
+
+func TestWriteVarsTable(t *testing.T) {
+	vars := []lib.EnvVar{
+		{Name: "API_URL", Value: "https://api.example.com", Source: ".env"},
+		{Name: "CERT", Value: "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n", Source: "/run/secrets/cert"},
+		{Name: "SEP", Value: "a\tb", Source: "environment"},
+		{Name: "QUOTED", Value: `say "hi"`, Source: ".env.local"},
+	}
+	var out bytes.Buffer
+	writeVarsTable(&out, vars)
+
+	want := `NAME     VALUE                                                             SOURCE
+API_URL  https://api.example.com                                           .env
+CERT     "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----\n"  /run/secrets/cert
+SEP      "a\tb"                                                            environment
+QUOTED   say "hi"                                                          .env.local
+`
+	if out.String() != want {
+		t.Errorf("got\n%s\nwant\n%s", out.String(), want)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package cmd
+
+import (
+	"os"
+
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/dmetzler/go-deploy/lib"
+	"github.com/spf13/cobra"
+	"github.com/spf13/viper"
+)
+
+var (
+	validStorageClasses = map[string]bool{
+		"":                                      true,
+		s3.ObjectStorageClassStandard:           true,
+		s3.ObjectStorageClassReducedRedundancy:  true,
+		s3.ObjectStorageClassGlacier:            true,
+		s3.ObjectStorageClassStandardIa:         true,
+		s3.ObjectStorageClassOnezoneIa:          true,
+		s3.ObjectStorageClassIntelligentTiering: true,
+		s3.ObjectStorageClassDeepArchive:        true,
+	}
+)
+
+// lookupSrcDir returns the source directory of the application, set in the
+// SRC_DIR environment variable.
+func lookupSrcDir() string {
+	srcDir, exists := os.LookupEnv("SRC_DIR")
+	if !exists {
+		log.Fatal("SRC_DIR env variable does not exist")
+	}
+
+	if _, err := os.Stat(srcDir); os.IsNotExist(err) {
+		log.Fatal("Source directory does not exist (SRC_DIR: " + srcDir + ")")
+	}
+	return srcDir
+}
+
+// addDotEnvFlags adds the flags shared by the commands that generate the
+// runtime configuration of the application.
+func addDotEnvFlags(cmd *cobra.Command) {
+	cmd.Flags().StringSliceP("env", "e", []string{".env"}, "Source dotenv files, the later ones override the former ones")
+	cmd.Flags().StringP("mode", "m", "", "Deployment mode, layers .env.<mode> over the dotenv files, below .env.local")
+	cmd.Flags().StringP("env-dir", "", "", "Directory where each file holds the value of the variable it is named after, like a mounted ConfigMap")
+	cmd.Flags().StringP("configname", "c", "env-config.js", "Name of the generated config file")
+	cmd.Flags().StringSliceP("format", "f", []string{"js"}, "Generated config formats (js, json, esm, dts), each one optionally as format=filename")
+	cmd.Flags().StringP("global", "", "_env_", "Name of the global variable set by the js format")
+	cmd.Flags().StringP("template", "t", "", "Go template replacing the built-in js config, relative to SRC_DIR")
+	cmd.Flags().BoolP("render-templates", "", false, "Render the *.tmpl files of SRC_DIR into their non-.tmpl counterparts")
+	cmd.Flags().StringP("inject", "", "", "Inline the config in HTML files as a script or a meta tag")
+	cmd.Flags().StringSliceP("inject-files", "", []string{"index.html"}, "HTML files to inject the config into")
+	cmd.Flags().BoolP("placeholders", "", false, "Replace the variable placeholders found in the text assets")
+	cmd.Flags().StringSliceP("placeholder-globs", "", []string{"*.js", "*.css", "*.html", "*.json"}, "Files scanned for placeholders")
+	cmd.Flags().StringSliceP("placeholder-delims", "", []string{"__", "%%"}, "Placeholder delimiters, either open:close or a single delimiter used on both sides")
+	cmd.Flags().BoolP("placeholder-raw", "", false, "Insert the placeholder values as is instead of escaping them for JavaScript, JSON, HTML or CSS")
+	cmd.Flags().StringSliceP("placeholder-ignore", "", lib.DefaultPlaceholderIgnore, "Globs of the placeholder names not reported when they have no value, * to report none")
+	cmd.Flags().BoolP("hash-config", "", false, "Add a hash of the content to the generated config file names and rewrite their references in HTML files")
+	cmd.Flags().StringP("schema", "", "", "Schema validating the variables, defaults to the dotenv file with a .schema suffix when present")
+	cmd.Flags().BoolP("production", "", false, "Refuse the .env defaults of the variables declared no-default in the schema")
+	cmd.Flags().BoolP("typed", "", false, "Emit booleans, numbers, null and JSON values natively instead of strings")
+	cmd.Flags().StringSliceP("prefix", "", []string{}, "Export every environment variable starting with one of these prefixes, e.g. APP_,VITE_")
+	cmd.Flags().BoolP("strip-prefix", "", false, "Remove the prefix from the name of the variables exported by prefix")
+	cmd.Flags().StringSliceP("deny", "", []string{}, "Globs of the environment variables never exported by prefix, in addition to the default ones (AWS_*, *SECRET*, *TOKEN*...)")
+	cmd.Flags().StringP("ssm-endpoint", "", "", "Endpoint of the SSM service resolving the ref+ssm:// values")
+	cmd.Flags().StringSliceP("allow-secret", "", []string{}, "Variables published even though they look like secrets")
+	cmd.Flags().StringSliceP("exclude", "", []string{}, "Globs of the source files left out of the deployment")
+	cmd.Flags().BoolP("verbose", "", false, "Verbose")
+}
+
+// dotEnvConfig builds the runtime configuration options from the flags
+// registered by addDotEnvFlags.
+func dotEnvConfig(cmd *cobra.Command) *lib.DotEnvConfig {
+	config := &lib.DotEnvConfig{}
+	config.EnvFiles, _ = cmd.Flags().GetStringSlice("env")
+	config.Mode, _ = cmd.Flags().GetString("mode")
+	config.EnvDir, _ = cmd.Flags().GetString("env-dir")
+	config.ConfigName, _ = cmd.Flags().GetString("configname")
+	config.Formats, _ = cmd.Flags().GetStringSlice("format")
+	config.GlobalName, _ = cmd.Flags().GetString("global")
+	config.Template, _ = cmd.Flags().GetString("template")
+	config.RenderTemplates, _ = cmd.Flags().GetBool("render-templates")
+	config.Inject, _ = cmd.Flags().GetString("inject")
+	config.InjectFiles, _ = cmd.Flags().GetStringSlice("inject-files")
+	config.Placeholders, _ = cmd.Flags().GetBool("placeholders")
+	config.PlaceholderGlobs, _ = cmd.Flags().GetStringSlice("placeholder-globs")
+	config.PlaceholderDelims, _ = cmd.Flags().GetStringSlice("placeholder-delims")
+	config.PlaceholderRaw, _ = cmd.Flags().GetBool("placeholder-raw")
+	config.PlaceholderIgnore, _ = cmd.Flags().GetStringSlice("placeholder-ignore")
+	config.HashConfig, _ = cmd.Flags().GetBool("hash-config")
+	config.SchemaFile, _ = cmd.Flags().GetString("schema")
+	config.Production, _ = cmd.Flags().GetBool("production")
+	config.TypedValues, _ = cmd.Flags().GetBool("typed")
+	config.Prefixes, _ = cmd.Flags().GetStringSlice("prefix")
+	config.StripPrefix, _ = cmd.Flags().GetBool("strip-prefix")
+	config.Deny, _ = cmd.Flags().GetStringSlice("deny")
+	config.SSMEndpoint, _ = cmd.Flags().GetString("ssm-endpoint")
+	config.AllowSecrets, _ = cmd.Flags().GetStringSlice("allow-secret")
+	config.Exclude, _ = cmd.Flags().GetStringSlice("exclude")
+	config.Verbose, _ = cmd.Flags().GetBool("verbose")
+	config.SettingsFile = viper.ConfigFileUsed()
+	return config
+}
+
+// addSyncFlags adds the flags of the commands that synchronize the
+// application with a remote storage.
+func addSyncFlags(cmd *cobra.Command) {
+	cmd.Flags().StringP("access-key", "", "", "AWS Access Key")
+	cmd.Flags().StringP("secret-key", "", "", "AWS Secret Key")
+	cmd.Flags().StringP("storage-class", "", "", "S3 Storage Class")
+	cmd.Flags().IntP("concurrency", "", 10, "Concurrency")
+	cmd.Flags().Int64P("part-size", "", 0, "Part Size in MB")
+	cmd.Flags().BoolP("check-md5", "", false, "Check MD5")
+	cmd.Flags().BoolP("dry-run", "", false, "Dry Run")
+	cmd.Flags().BoolP("recursive", "", true, "Recursive")
+	cmd.Flags().BoolP("force", "", false, "Force")
+	cmd.Flags().BoolP("skip-existing", "", false, "Skip existing")
+	cmd.Flags().StringP("cache-control", "", "", "Cache-Control header of the uploaded files")
+	cmd.Flags().StringSliceP("immutable", "", []string{}, "Globs of the file names cached for a year, like hashed assets")
+	cmd.Flags().StringP("endpoint", "", "", "S3 compatible endpoint, like http://localhost:9000 for MinIO")
+	cmd.Flags().StringP("region", "", "", "S3 region, looked up with GetBucketLocation on AWS when empty")
+	cmd.Flags().BoolP("path-style", "", false, "Address the buckets as endpoint/bucket instead of bucket.endpoint")
+	cmd.Flags().BoolP("tls-skip-verify", "", false, "Do not verify the TLS certificate of the S3 endpoint")
+	cmd.Flags().StringP("ca-bundle", "", "", "PEM file of the certificate authorities trusted for the S3 endpoint")
+	cmd.Flags().StringP("gcs-endpoint", "", "", "Google Cloud Storage endpoint, defaults to STORAGE_EMULATOR_HOST or the public API")
+	cmd.Flags().StringP("gcs-credentials", "", "", "Google Cloud service account key file, defaults to the application default credentials")
+	cmd.Flags().StringP("azure-account", "", "", "Azure storage account, defaults to AZURE_STORAGE_ACCOUNT")
+	cmd.Flags().StringP("azure-key", "", "", "Azure storage account key, defaults to AZURE_STORAGE_KEY")
+	cmd.Flags().StringP("azure-sas", "", "", "Azure shared access signature, defaults to AZURE_STORAGE_SAS_TOKEN")
+	cmd.Flags().StringP("azure-endpoint", "", "", "Azure blob service endpoint, e.g. http://127.0.0.1:10000/devstoreaccount1 for Azurite")
+	cmd.Flags().StringP("ssh-key", "", "", "Private key of the SFTP login, defaults to the ssh agent and the ~/.ssh/id_* keys")
+	cmd.Flags().StringP("ssh-known-hosts", "", "", "known_hosts file verifying the SFTP host keys, defaults to ~/.ssh/known_hosts")
+	cmd.Flags().StringP("git-branch", "", "gh-pages", "Branch committed for the git+file:// and git+ssh:// destinations")
+	cmd.Flags().BoolP("git-orphan", "", false, "Replace the history of the branch by a single commit")
+	cmd.Flags().StringP("git-author", "", "", "Author of the commits like 'Name <email>', defaults to GIT_AUTHOR_NAME and GIT_AUTHOR_EMAIL")
+	cmd.Flags().StringP("git-message", "", "Deploy {{.Date}}", "Template of the commit message, with .Branch, .Date, .Files, .Parent and env")
+	cmd.Flags().StringP("cname", "", "", "Custom domain written to the CNAME file of the branch")
+	cmd.Flags().BoolP("nojekyll", "", false, "Add a .nojekyll file to the branch to skip the Jekyll build")
+	cmd.Flags().StringP("manifest", "", "SHA256SUMS", "SHA-256 manifest added to the tar:// and zip:// archives, none when empty")
+}
+
+// syncConfig builds the storage options from the flags registered by
+// addSyncFlags, the flags missing from cmd keeping their zero value.
+func syncConfig(cmd *cobra.Command) *lib.Config {
+	config := &lib.Config{}
+	config.AccessKey, _ = cmd.Flags().GetString("access-key")
+	config.SecretKey, _ = cmd.Flags().GetString("secret-key")
+	config.StorageClass, _ = cmd.Flags().GetString("storage-class")
+	config.Concurrency, _ = cmd.Flags().GetInt("concurrency")
+	config.PartSize, _ = cmd.Flags().GetInt64("part-size")
+	config.CheckMD5, _ = cmd.Flags().GetBool("check-md5")
+	config.DryRun, _ = cmd.Flags().GetBool("dry-run")
+	config.Verbose, _ = cmd.Flags().GetBool("verbose")
+	config.Recursive, _ = cmd.Flags().GetBool("recursive")
+	config.Force, _ = cmd.Flags().GetBool("force")
+	config.SkipExisting, _ = cmd.Flags().GetBool("skip-existing")
+	config.CacheControl, _ = cmd.Flags().GetString("cache-control")
+	config.ImmutableFiles, _ = cmd.Flags().GetStringSlice("immutable")
+	config.HostBase, _ = cmd.Flags().GetString("endpoint")
+	config.Region, _ = cmd.Flags().GetString("region")
+	config.PathStyle, _ = cmd.Flags().GetBool("path-style")
+	config.SkipVerify, _ = cmd.Flags().GetBool("tls-skip-verify")
+	config.CABundle, _ = cmd.Flags().GetString("ca-bundle")
+	config.GCSEndpoint, _ = cmd.Flags().GetString("gcs-endpoint")
+	config.GCSCredentials, _ = cmd.Flags().GetString("gcs-credentials")
+	config.AzureAccount, _ = cmd.Flags().GetString("azure-account")
+	config.AzureKey, _ = cmd.Flags().GetString("azure-key")
+	config.AzureSAS, _ = cmd.Flags().GetString("azure-sas")
+	config.AzureEndpoint, _ = cmd.Flags().GetString("azure-endpoint")
+	config.SSHKey, _ = cmd.Flags().GetString("ssh-key")
+	config.SSHKnownHosts, _ = cmd.Flags().GetString("ssh-known-hosts")
+	config.GitBranch, _ = cmd.Flags().GetString("git-branch")
+	config.GitOrphan, _ = cmd.Flags().GetBool("git-orphan")
+	config.GitAuthor, _ = cmd.Flags().GetString("git-author")
+	config.GitMessage, _ = cmd.Flags().GetString("git-message")
+	config.GitCNAME, _ = cmd.Flags().GetString("cname")
+	config.GitNoJekyll, _ = cmd.Flags().GetBool("nojekyll")
+	config.ArchiveManifest, _ = cmd.Flags().GetString("manifest")
+
+	if _, found := validStorageClasses[config.StorageClass]; !found {
+		log.Fatalf("Invalid storage class provided: %s", config.StorageClass)
+	}
+	return config
+}
+
+// deployTo builds the application found in SRC_DIR and deploys it to
+// destination, with the options given by the flags of cmd.
+func deployTo(cmd *cobra.Command, destination string) {
+	err := lib.Deploy(lookupSrcDir(), destination, dotEnvConfig(cmd), syncConfig(cmd))
+	if err != nil {
+		log.Fatal(err)
+	}
+}
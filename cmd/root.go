@@ -19,6 +19,7 @@ import (
   "fmt"
   "os"
   "github.com/spf13/cobra"
+  "github.com/spf13/viper"
   "github.com/sirupsen/logrus"
 )
 
@@ -35,6 +36,12 @@ var rootCmd = &cobra.Command{
   // Uncomment the following line if your bare application
   // has an action associated with it:
   //	Run: func(cmd *cobra.Command, args []string) { },
+  PersistentPreRun: func(cmd *cobra.Command, args []string) {
+    // Flags not given on the command line come from the environment or the config file
+    if err := applyConfig(cmd, nil); err != nil {
+      log.Fatal(err)
+    }
+  },
 }
 
 // Execute adds all child commands to the root command and sets flags appropriately.
@@ -48,13 +55,29 @@ func Execute() {
 
 func init() {
   cobra.OnInitialize(initConfig)
-
+  rootCmd.PersistentFlags().StringVar(&cfgFile, "config", "", "Config file (default is go-deploy.yaml, .toml or .json in the current directory)")
 }
 
 
 // initConfig reads in config file and ENV variables if set.
 func initConfig() {
+  if cfgFile == "" {
+    cfgFile = os.Getenv(envPrefix + "_CONFIG")
+  }
 
+  if cfgFile != "" {
+    viper.SetConfigFile(cfgFile)
+  } else {
+    // Not in $SRC_DIR, whose content is published
+    viper.SetConfigName("go-deploy")
+    viper.AddConfigPath(".")
+  }
 
+  if err := viper.ReadInConfig(); err != nil {
+    // The config file is optional unless it is explicitly given
+    if _, notFound := err.(viper.ConfigFileNotFoundError); !notFound || cfgFile != "" {
+      log.Fatalf("Unable to read config file: %s", err)
+    }
+  }
 }
 
@@ -82,21 +82,10 @@ var serveCmd = &cobra.Command{
 	Short: "Serve the web app (for development use only)",
 	Long: `.`,
 	Run: func(cmd *cobra.Command, args []string) {
-		// Check that SRC_DIR exist
-		srcDir, exists := os.LookupEnv("SRC_DIR")
-    if(!exists) {
-    	log.Fatal("SRC_DIR env variable does not exist")
-    }
-
-    if _, err := os.Stat(srcDir); os.IsNotExist(err) {
-			log.Fatal("Source directory does not exist (SRC_DIR: " + srcDir + ")")
-		}
-
-		configName, _:= cmd.Flags().GetString("configname")
-		dotenv, _:= cmd.Flags().GetString("env")
+		srcDir := lookupSrcDir()
 		port, _:= cmd.Flags().GetString("port")
 
-		err, workdir := lib.BuildWorkDir(srcDir, dotenv, configName )
+		err, workdir := lib.BuildWorkDir(srcDir, dotEnvConfig(cmd))
 		if err != nil {
 			log.Fatal(err)
 		}
@@ -111,6 +100,5 @@ var serveCmd = &cobra.Command{
 func init() {
 	rootCmd.AddCommand(serveCmd)
 	serveCmd.Flags().StringP("port", "p", "8080", "Listening port")
-	serveCmd.Flags().StringP("env", "e", ".env", "Source dotenv file")
-	serveCmd.Flags().StringP("configname", "c", "env-config.js", "Name of the generated config file")
+	addDotEnvFlags(serveCmd)
 }
@@ -0,0 +1,291 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+func init() {
+	RegisterDeployer("tar", newArchiveDeployer)
+	RegisterDeployer("zip", newArchiveDeployer)
+}
+
+// Default time of the archived files, the oldest one of the zip format
+var archiveEpoch = time.Date(1980, time.January, 1, 0, 0, 0, 0, time.UTC)
+
+// Writes the application to a reproducible archive: the same application
+// gives the same archive, byte for byte
+type archiveDeployer struct {
+	config *Config
+	format string // tar or zip
+	file   string
+}
+
+// A file or directory of the archive, by its slash separated path
+type archiveEntry struct {
+	name    string // ends with a slash for the directories
+	path    string
+	info    os.FileInfo // nil for the generated files
+	content string      // target of the symbolic links, content of the generated files
+}
+
+func newArchiveDeployer(destination *url.URL, config *Config) (Deployer, error) {
+	file := destination.Path
+	if destination.Host != "" {
+		// tar://relative/site.tar.gz
+		file = destination.Host + file
+	}
+	if file == "" || strings.HasSuffix(file, "/") {
+		return nil, fmt.Errorf("Invalid destination %s: no archive file", destination)
+	}
+	return archiveDeployer{config: config, format: destination.Scheme, file: file}, nil
+}
+
+// The files are archived in the order of their path, with a fixed time,
+// SOURCE_DATE_EPOCH when set, and the permissions 0644 or 0755 of root.
+// The manifest lists their SHA-256 hashes like sha256sum.
+func (d archiveDeployer) Deploy(workdir string) error {
+	modTime := archiveEpoch
+	if epoch := os.Getenv("SOURCE_DATE_EPOCH"); epoch != "" {
+		seconds, err := strconv.ParseInt(epoch, 10, 64)
+		if err != nil {
+			return fmt.Errorf("Invalid SOURCE_DATE_EPOCH %s: %v", epoch, err)
+		}
+		modTime = time.Unix(seconds, 0).UTC()
+	}
+
+	entries, err := archiveEntries(workdir)
+	if err != nil {
+		return err
+	}
+	if d.config.ArchiveManifest != "" {
+		for _, entry := range entries {
+			if entry.name == d.config.ArchiveManifest {
+				return fmt.Errorf("The manifest %s is a file of the application", entry.name)
+			}
+		}
+		manifest, err := archiveManifest(entries)
+		if err != nil {
+			return err
+		}
+		entries = append(entries, archiveEntry{name: d.config.ArchiveManifest, content: manifest})
+		sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	}
+
+	// The archive is written next to the destination then renamed, a failed
+	// deployment doesn't leave a partial archive
+	dir := filepath.Dir(d.file)
+	if err := os.MkdirAll(dir, 0755); err != nil {
+		return fmt.Errorf("Error making directory dir=%s error=%v", dir, err)
+	}
+	fd, err := ioutil.TempFile(dir, "."+filepath.Base(d.file))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(fd.Name())
+
+	if d.format == "zip" {
+		err = writeZip(fd, entries, modTime)
+	} else {
+		err = writeTar(fd, entries, modTime, strings.HasSuffix(d.file, ".gz") || strings.HasSuffix(d.file, ".tgz"))
+	}
+	if err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Chmod(0644); err != nil {
+		fd.Close()
+		return err
+	}
+	if err := fd.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(fd.Name(), d.file); err != nil {
+		return err
+	}
+
+	files := 0
+	for _, entry := range entries {
+		if !strings.HasSuffix(entry.name, "/") {
+			files++
+		}
+	}
+	fmt.Printf("Wrote %s with %d files\n", d.file, files)
+	return nil
+}
+
+// List the content of dir sorted by path, a directory coming before its files
+func archiveEntries(dir string) ([]archiveEntry, error) {
+	entries := make([]archiveEntry, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir {
+			return nil
+		}
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			return err
+		}
+
+		entry := archiveEntry{name: filepath.ToSlash(rel), path: path, info: info}
+		if info.IsDir() {
+			entry.name += "/"
+		} else if info.Mode()&os.ModeSymlink != 0 {
+			if entry.content, err = os.Readlink(path); err != nil {
+				return err
+			}
+		}
+		entries = append(entries, entry)
+		return nil
+	})
+	sort.Slice(entries, func(i, j int) bool { return entries[i].name < entries[j].name })
+	return entries, err
+}
+
+// SHA-256 hashes of the regular files
+func archiveManifest(entries []archiveEntry) (string, error) {
+	var manifest bytes.Buffer
+	for _, entry := range entries {
+		if entry.info == nil || !entry.info.Mode().IsRegular() {
+			continue
+		}
+		fd, err := os.Open(entry.path)
+		if err != nil {
+			return "", err
+		}
+		hasher := sha256.New()
+		_, err = io.Copy(hasher, fd)
+		fd.Close()
+		if err != nil {
+			return "", err
+		}
+		fmt.Fprintf(&manifest, "%x  %s\n", hasher.Sum(nil), entry.name)
+	}
+	return manifest.String(), nil
+}
+
+// Normalized permissions of an entry, the generated ones being regular files
+func archiveMode(entry archiveEntry) os.FileMode {
+	switch {
+	case entry.info == nil:
+		return 0644
+	case entry.info.IsDir():
+		return os.ModeDir | 0755
+	case entry.info.Mode()&os.ModeSymlink != 0:
+		return os.ModeSymlink | 0777
+	case entry.info.Mode()&0111 != 0:
+		return 0755
+	default:
+		return 0644
+	}
+}
+
+// Write the content of an entry, the one of the symbolic links and of the
+// generated files being kept in memory
+func copyEntry(w io.Writer, entry archiveEntry) error {
+	if entry.info == nil || entry.info.Mode()&os.ModeSymlink != 0 {
+		_, err := io.WriteString(w, entry.content)
+		return err
+	}
+	fd, err := os.Open(entry.path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	_, err = io.Copy(w, fd)
+	return err
+}
+
+func writeTar(w io.Writer, entries []archiveEntry, modTime time.Time, compress bool) error {
+	if compress {
+		// The gzip header has no name nor time
+		zw := gzip.NewWriter(w)
+		if err := writeTar(zw, entries, modTime, false); err != nil {
+			return err
+		}
+		return zw.Close()
+	}
+
+	tw := tar.NewWriter(w)
+	for _, entry := range entries {
+		mode := archiveMode(entry)
+		header := &tar.Header{
+			Name:    entry.name,
+			Mode:    int64(mode.Perm()),
+			ModTime: modTime,
+		}
+		switch {
+		case mode.IsDir():
+			header.Typeflag = tar.TypeDir
+		case mode&os.ModeSymlink != 0:
+			header.Typeflag, header.Linkname = tar.TypeSymlink, entry.content
+		case entry.info == nil:
+			header.Typeflag, header.Size = tar.TypeReg, int64(len(entry.content))
+		default:
+			header.Typeflag, header.Size = tar.TypeReg, entry.info.Size()
+		}
+
+		if err := tw.WriteHeader(header); err != nil {
+			return err
+		}
+		if header.Typeflag == tar.TypeReg {
+			if err := copyEntry(tw, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return tw.Close()
+}
+
+func writeZip(w io.Writer, entries []archiveEntry, modTime time.Time) error {
+	zw := zip.NewWriter(w)
+	for _, entry := range entries {
+		mode := archiveMode(entry)
+		header := &zip.FileHeader{Name: entry.name, Method: zip.Deflate, Modified: modTime}
+		header.SetMode(mode)
+		if mode.IsDir() {
+			header.Method = zip.Store
+		}
+
+		fw, err := zw.CreateHeader(header)
+		if err != nil {
+			return err
+		}
+		if !mode.IsDir() {
+			if err := copyEntry(fw, entry); err != nil {
+				return err
+			}
+		}
+	}
+	return zw.Close()
+}
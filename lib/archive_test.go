@@ -0,0 +1,273 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"archive/tar"
+	"archive/zip"
+	"bytes"
+	"compress/gzip"
+	"crypto/sha256"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+var archiveFiles = []struct {
+	name    string
+	content string
+	mode    os.FileMode
+}{
+	{"index.html", "<html></html>", 0644},
+	{"js/main.js", "main()", 0644},
+	{"css/style.css", "a{}", 0644},
+	{"bin/run.sh", "#!/bin/sh\n", 0755},
+}
+
+// What any application built from archiveFiles has to give
+type archivedEntry struct {
+	name string
+	mode os.FileMode
+	link string
+}
+
+var archivedEntries = []archivedEntry{
+	{"SHA256SUMS", 0644, ""},
+	{"bin/", os.ModeDir | 0755, ""},
+	{"bin/run.sh", 0755, ""},
+	{"css/", os.ModeDir | 0755, ""},
+	{"css/style.css", 0644, ""},
+	{"index.html", 0644, ""},
+	{"js/", os.ModeDir | 0755, ""},
+	{"js/main.js", 0644, ""},
+	{"latest", os.ModeSymlink | 0777, "js/main.js"},
+}
+
+func archivedManifest() string {
+	contents := map[string]string{}
+	for _, file := range archiveFiles {
+		contents[file.name] = file.content
+	}
+	manifest := ""
+	for _, name := range []string{"bin/run.sh", "css/style.css", "index.html", "js/main.js"} {
+		manifest += fmt.Sprintf("%x  %s\n", sha256.Sum256([]byte(contents[name])), name)
+	}
+	return manifest
+}
+
+// Write archiveFiles in the given order with their own time and permissions
+// loosened or tightened by perm
+func writeArchiveApp(t *testing.T, dir string, reverse bool, modTime time.Time, perm os.FileMode) {
+	for i := range archiveFiles {
+		if reverse {
+			i = len(archiveFiles) - 1 - i
+		}
+		file := archiveFiles[i]
+		path := filepath.Join(dir, file.name)
+		if err := os.MkdirAll(filepath.Dir(path), 0700|perm); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(file.content), 0600); err != nil {
+			t.Fatal(err)
+		}
+		mode := file.mode & perm
+		if file.mode&0100 != 0 {
+			mode |= 0700
+		} else {
+			mode |= 0600
+		}
+		if err := os.Chmod(path, mode); err != nil {
+			t.Fatal(err)
+		}
+		if err := os.Chtimes(path, modTime, modTime); err != nil {
+			t.Fatal(err)
+		}
+		modTime = modTime.Add(time.Minute)
+	}
+	if err := os.Symlink("js/main.js", filepath.Join(dir, "latest")); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func deployArchive(t *testing.T, dir string, destination string) []byte {
+	u, err := url.Parse(destination)
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployer, err := newArchiveDeployer(u, &Config{ArchiveManifest: "SHA256SUMS"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deployer.Deploy(dir); err != nil {
+		t.Fatal(err)
+	}
+	content, err := ioutil.ReadFile(u.Path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return content
+}
+
+// The same application written at other times, in another order and with
+// other permissions gives the same archive
+func TestArchiveReproducible(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	first, second := filepath.Join(dir, "first"), filepath.Join(dir, "second")
+	writeArchiveApp(t, first, false, time.Date(2019, time.March, 1, 10, 0, 0, 0, time.UTC), 0755)
+	writeArchiveApp(t, second, true, time.Date(2021, time.June, 5, 18, 30, 0, 0, time.Local), 0700)
+
+	for _, name := range []string{"site.tar", "site.tar.gz", "site.zip"} {
+		scheme := "tar"
+		if name == "site.zip" {
+			scheme = "zip"
+		}
+		archive := filepath.ToSlash(filepath.Join(dir, "out", name))
+		content := deployArchive(t, first, scheme+"://"+archive)
+		if other := deployArchive(t, second, scheme+"://"+archive); !bytes.Equal(content, other) {
+			t.Errorf("%s: the archives differ", name)
+		}
+
+		var entries []archivedEntry
+		var manifest string
+		switch name {
+		case "site.zip":
+			entries, manifest = readZipEntries(t, content)
+		case "site.tar.gz":
+			zr, err := gzip.NewReader(bytes.NewReader(content))
+			if err != nil {
+				t.Fatal(err)
+			}
+			if zr.Name != "" || !zr.ModTime.IsZero() {
+				t.Errorf("%s: the gzip header has the name %q and the time %v", name, zr.Name, zr.ModTime)
+			}
+			entries, manifest = readTarEntries(t, zr)
+		default:
+			entries, manifest = readTarEntries(t, bytes.NewReader(content))
+		}
+		if !reflect.DeepEqual(entries, archivedEntries) {
+			t.Errorf("%s: got the entries %v, want %v", name, entries, archivedEntries)
+		}
+		if want := archivedManifest(); manifest != want {
+			t.Errorf("%s: got the manifest %q, want %q", name, manifest, want)
+		}
+	}
+}
+
+func readTarEntries(t *testing.T, r io.Reader) ([]archivedEntry, string) {
+	entries := make([]archivedEntry, 0)
+	manifest := ""
+	tr := tar.NewReader(r)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !header.ModTime.Equal(archiveEpoch) {
+			t.Errorf("%s: got the time %v", header.Name, header.ModTime)
+		}
+		if header.Uid != 0 || header.Gid != 0 || header.Uname != "" || header.Gname != "" {
+			t.Errorf("%s: owned by %d:%d %s:%s", header.Name, header.Uid, header.Gid, header.Uname, header.Gname)
+		}
+		entries = append(entries, archivedEntry{header.Name, header.FileInfo().Mode(), header.Linkname})
+		if header.Name == "SHA256SUMS" {
+			content, err := ioutil.ReadAll(tr)
+			if err != nil {
+				t.Fatal(err)
+			}
+			manifest = string(content)
+		}
+	}
+	return entries, manifest
+}
+
+func readZipEntries(t *testing.T, content []byte) ([]archivedEntry, string) {
+	zr, err := zip.NewReader(bytes.NewReader(content), int64(len(content)))
+	if err != nil {
+		t.Fatal(err)
+	}
+	entries := make([]archivedEntry, 0)
+	manifest := ""
+	for _, file := range zr.File {
+		if !file.Modified.Equal(archiveEpoch) {
+			t.Errorf("%s: got the time %v", file.Name, file.Modified)
+		}
+		entry := archivedEntry{name: file.Name, mode: file.Mode()}
+		if file.Mode().IsDir() {
+			entries = append(entries, entry)
+			continue
+		}
+		fd, err := file.Open()
+		if err != nil {
+			t.Fatal(err)
+		}
+		data, err := ioutil.ReadAll(fd)
+		fd.Close()
+		if err != nil {
+			t.Fatal(err)
+		}
+		switch {
+		case file.Mode()&os.ModeSymlink != 0:
+			entry.link = string(data)
+		case file.Name == "SHA256SUMS":
+			manifest = string(data)
+		}
+		entries = append(entries, entry)
+	}
+	return entries, manifest
+}
+
+// SOURCE_DATE_EPOCH sets the time of the entries
+func TestArchiveSourceDateEpoch(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, filepath.Join(dir, "app"), map[string]string{"index.html": "<html></html>"})
+
+	old, found := os.LookupEnv("SOURCE_DATE_EPOCH")
+	os.Setenv("SOURCE_DATE_EPOCH", "1571234567")
+	defer func() {
+		if found {
+			os.Setenv("SOURCE_DATE_EPOCH", old)
+		} else {
+			os.Unsetenv("SOURCE_DATE_EPOCH")
+		}
+	}()
+
+	content := deployArchive(t, filepath.Join(dir, "app"), "tar://"+filepath.ToSlash(filepath.Join(dir, "site.tar")))
+	header, err := tar.NewReader(bytes.NewReader(content)).Next()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !header.ModTime.Equal(time.Unix(1571234567, 0)) {
+		t.Errorf("got the time %v", header.ModTime)
+	}
+}
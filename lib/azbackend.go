@@ -0,0 +1,441 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const azureAPIVersion = "2019-12-12"
+
+// Well-known account of the Azurite and storage emulators
+const (
+	azuriteAccount  = "devstoreaccount1"
+	azuriteKey      = "Eby8vdM02xNOcqFlqUwJPLlmEtlCDXJ1OUzFT50uSRZ6IFsuFq2UVErCz4I6tq/K1SZFPTOtr/KBHBeksoGMGw=="
+	azuriteEndpoint = "http://127.0.0.1:10000/devstoreaccount1"
+)
+
+func init() {
+	RegisterBackend("az", newAzureBackend)
+}
+
+// Azure Blob Storage containers of a storage account, through the REST API.
+// The $web container serves the static website of the account.
+type azureBackend struct {
+	config   *Config
+	endpoint *url.URL
+	account  string
+	key      []byte     // shared key, nil when authenticating with a SAS token
+	sas      url.Values // shared access signature
+	client   *http.Client
+}
+
+// The settings default to the AZURE_STORAGE_* environment variables used by
+// the Azure CLI, the connection string included.
+func newAzureBackend(config *Config) (Backend, error) {
+	settings := map[string]string{
+		"AccountName":           firstNonEmpty(config.AzureAccount, os.Getenv("AZURE_STORAGE_ACCOUNT")),
+		"AccountKey":            firstNonEmpty(config.AzureKey, os.Getenv("AZURE_STORAGE_KEY")),
+		"SharedAccessSignature": firstNonEmpty(config.AzureSAS, os.Getenv("AZURE_STORAGE_SAS_TOKEN")),
+		"BlobEndpoint":          config.AzureEndpoint,
+	}
+	if conn := os.Getenv("AZURE_STORAGE_CONNECTION_STRING"); conn != "" {
+		for name, value := range parseConnectionString(conn) {
+			if settings[name] == "" {
+				settings[name] = value
+			}
+		}
+	}
+	if settings["UseDevelopmentStorage"] == "true" {
+		settings["AccountName"] = firstNonEmpty(settings["AccountName"], azuriteAccount)
+		settings["AccountKey"] = firstNonEmpty(settings["AccountKey"], azuriteKey)
+		settings["BlobEndpoint"] = firstNonEmpty(settings["BlobEndpoint"], azuriteEndpoint)
+	}
+
+	account := settings["AccountName"]
+	if account == "" {
+		return nil, fmt.Errorf("No Azure storage account, set --azure-account or AZURE_STORAGE_ACCOUNT")
+	}
+
+	endpoint := settings["BlobEndpoint"]
+	if endpoint == "" {
+		protocol := firstNonEmpty(settings["DefaultEndpointsProtocol"], "https")
+		suffix := firstNonEmpty(settings["EndpointSuffix"], "core.windows.net")
+		endpoint = fmt.Sprintf("%s://%s.blob.%s", protocol, account, suffix)
+	}
+	u, err := url.Parse(strings.TrimSuffix(endpoint, "/"))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid Azure endpoint %s: %v", endpoint, err)
+	}
+
+	b := &azureBackend{config: config, endpoint: u, account: account, client: http.DefaultClient}
+	switch {
+	case settings["AccountKey"] != "":
+		b.key, err = base64.StdEncoding.DecodeString(settings["AccountKey"])
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Azure storage key: %v", err)
+		}
+	case settings["SharedAccessSignature"] != "":
+		b.sas, err = url.ParseQuery(strings.TrimPrefix(settings["SharedAccessSignature"], "?"))
+		if err != nil {
+			return nil, fmt.Errorf("Invalid Azure SAS token: %v", err)
+		}
+	default:
+		return nil, fmt.Errorf("No Azure credentials, set --azure-key or --azure-sas")
+	}
+	return b, nil
+}
+
+// Parse a connection string like AccountName=name;AccountKey=key
+func parseConnectionString(conn string) map[string]string {
+	settings := make(map[string]string)
+	for _, part := range strings.Split(conn, ";") {
+		if i := strings.Index(part, "="); i > 0 {
+			settings[strings.TrimSpace(part[:i])] = strings.TrimSpace(part[i+1:])
+		}
+	}
+	return settings
+}
+
+func firstNonEmpty(values ...string) string {
+	for _, value := range values {
+		if value != "" {
+			return value
+		}
+	}
+	return ""
+}
+
+func (b *azureBackend) blobURL(container, name string) *url.URL {
+	u := *b.endpoint
+	u.Path = u.Path + "/" + container
+	if name != "" {
+		u.Path += "/" + name
+	}
+	return &u
+}
+
+type azureError struct {
+	status  int
+	message string
+}
+
+func (e *azureError) Error() string {
+	return e.message
+}
+
+func isAzureNotFound(err error) bool {
+	e, ok := err.(*azureError)
+	return ok && e.status == http.StatusNotFound
+}
+
+// Send a request to the API, signed with the shared key or the SAS token.
+// The errors are reported with their code and message.
+func (b *azureBackend) do(method string, u *url.URL, query url.Values, header http.Header, body io.Reader, length int64) (*http.Response, error) {
+	if query == nil {
+		query = url.Values{}
+	}
+	for name, values := range b.sas {
+		query[name] = values
+	}
+	call := *u
+	call.RawQuery = query.Encode()
+
+	req, err := http.NewRequest(method, call.String(), body)
+	if err != nil {
+		return nil, err
+	}
+	for name, values := range header {
+		req.Header[name] = values
+	}
+	req.Header.Set("x-ms-date", time.Now().UTC().Format(http.TimeFormat))
+	req.Header.Set("x-ms-version", azureAPIVersion)
+	if body != nil {
+		req.ContentLength = length
+	}
+	if b.key != nil {
+		req.Header.Set("Authorization", "SharedKey "+b.account+":"+b.signature(req))
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiError struct {
+			Code    string `xml:"Code"`
+			Message string `xml:"Message"`
+		}
+		message := resp.Status
+		data, _ := ioutil.ReadAll(resp.Body)
+		if xml.Unmarshal(data, &apiError) == nil && apiError.Code != "" {
+			message = apiError.Code + ": " + strings.SplitN(apiError.Message, "\n", 2)[0]
+		} else if code := resp.Header.Get("x-ms-error-code"); code != "" {
+			message = code
+		}
+		return resp, &azureError{status: resp.StatusCode, message: fmt.Sprintf("%s %s: %s", method, u, message)}
+	}
+	return resp, nil
+}
+
+// Shared key signature of a request, see
+// https://docs.microsoft.com/rest/api/storageservices/authorize-with-shared-key
+func (b *azureBackend) signature(req *http.Request) string {
+	contentLength := ""
+	if req.ContentLength > 0 {
+		contentLength = strconv.FormatInt(req.ContentLength, 10)
+	}
+
+	lines := []string{
+		req.Method,
+		req.Header.Get("Content-Encoding"),
+		req.Header.Get("Content-Language"),
+		contentLength,
+		req.Header.Get("Content-MD5"),
+		req.Header.Get("Content-Type"),
+		"", // Date, replaced by x-ms-date
+		req.Header.Get("If-Modified-Since"),
+		req.Header.Get("If-Match"),
+		req.Header.Get("If-None-Match"),
+		req.Header.Get("If-Unmodified-Since"),
+		req.Header.Get("Range"),
+	}
+
+	msHeaders := make([]string, 0)
+	for name := range req.Header {
+		if lower := strings.ToLower(name); strings.HasPrefix(lower, "x-ms-") {
+			msHeaders = append(msHeaders, lower+":"+strings.TrimSpace(req.Header.Get(name)))
+		}
+	}
+	sort.Strings(msHeaders)
+	lines = append(lines, msHeaders...)
+
+	resource := "/" + b.account + req.URL.EscapedPath()
+	query := req.URL.Query()
+	names := make([]string, 0, len(query))
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		values := query[name]
+		sort.Strings(values)
+		resource += "\n" + strings.ToLower(name) + ":" + strings.Join(values, ",")
+	}
+	lines = append(lines, resource)
+
+	mac := hmac.New(sha256.New, b.key)
+	mac.Write([]byte(strings.Join(lines, "\n")))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// A blob of a container listing
+type azureBlob struct {
+	Name          string `xml:"Name"`
+	ContentLength int64  `xml:"Properties>Content-Length"`
+	ContentMD5    string `xml:"Properties>Content-MD5"`
+}
+
+// The checksum is the hex MD5 like the S3 ETags, empty for the blobs
+// uploaded by blocks without MD5
+func (blob azureBlob) fileObject() FileObject {
+	file := FileObject{Name: blob.Name, Size: blob.ContentLength}
+	if sum, err := base64.StdEncoding.DecodeString(blob.ContentMD5); err == nil && len(sum) > 0 {
+		file.Checksum = hex.EncodeToString(sum)
+	}
+	return file
+}
+
+func (b *azureBackend) List(uri *FileURI) ([]FileObject, error) {
+	prefix := ""
+	if uri.Path != "" && uri.Path != "/" {
+		prefix = *uri.Key()
+	}
+	// Only keep the blobs "in the directory" of the prefix, see s3Backend.List
+	slen := len(prefix) - 1
+	if slen > 0 && prefix[slen] != '/' {
+		slen += 1
+	}
+
+	result := make([]FileObject, 0)
+	marker := ""
+	for {
+		query := url.Values{}
+		query.Set("restype", "container")
+		query.Set("comp", "list")
+		if prefix != "" {
+			query.Set("prefix", prefix)
+		}
+		if marker != "" {
+			query.Set("marker", marker)
+		}
+
+		resp, err := b.do("GET", b.blobURL(uri.Bucket, ""), query, nil, nil, 0)
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Blobs      []azureBlob `xml:"Blobs>Blob"`
+			NextMarker string      `xml:"NextMarker"`
+		}
+		err = xml.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, blob := range page.Blobs {
+			if slen > 0 && len(blob.Name) > slen && blob.Name[slen] != '/' {
+				continue
+			}
+			result = append(result, blob.fileObject())
+		}
+
+		if page.NextMarker == "" {
+			return result, nil
+		}
+		marker = page.NextMarker
+	}
+}
+
+func (b *azureBackend) Stat(uri *FileURI) (*FileObject, error) {
+	resp, err := b.do("HEAD", b.blobURL(uri.Bucket, *uri.Key()), nil, nil, nil, 0)
+	if isAzureNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	resp.Body.Close()
+
+	blob := azureBlob{Name: *uri.Key(), ContentLength: resp.ContentLength, ContentMD5: resp.Header.Get("Content-MD5")}
+	file := blob.fileObject()
+	return &file, nil
+}
+
+// Upload the blob in a single Put Blob request, the content being buffered
+// when its size is unknown
+func (b *azureBackend) Put(uri *FileURI, r io.Reader, size int64) error {
+	if size < 0 {
+		data, err := ioutil.ReadAll(r)
+		if err != nil {
+			return err
+		}
+		r, size = bytes.NewReader(data), int64(len(data))
+	}
+
+	name := strings.TrimPrefix(uri.Path, "/")
+	header := http.Header{}
+	header.Set("x-ms-blob-type", "BlockBlob")
+	contentType := mime.TypeByExtension(filepath.Ext(name))
+	if contentType == "" {
+		contentType = "application/octet-stream"
+	}
+	header.Set("x-ms-blob-content-type", contentType)
+	if cacheControl := cacheControlFor(b.config, name); cacheControl != "" {
+		header.Set("x-ms-blob-cache-control", cacheControl)
+	}
+
+	var body io.Reader = r
+	if size == 0 {
+		body = http.NoBody
+	}
+	resp, err := b.do("PUT", b.blobURL(uri.Bucket, name), nil, header, body, size)
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func (b *azureBackend) Get(uri *FileURI) (io.ReadCloser, error) {
+	resp, err := b.do("GET", b.blobURL(uri.Bucket, *uri.Key()), nil, nil, nil, 0)
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+func (b *azureBackend) Delete(uris []*FileURI) error {
+	for _, uri := range uris {
+		resp, err := b.do("DELETE", b.blobURL(uri.Bucket, *uri.Key()), nil, nil, nil, 0)
+		if isAzureNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Copy a blob of the account, waiting for the copy when it is asynchronous
+func (b *azureBackend) Copy(src, dst *FileURI) error {
+	source := b.blobURL(src.Bucket, *src.Key())
+	source.RawQuery = b.sas.Encode()
+
+	header := http.Header{}
+	header.Set("x-ms-copy-source", source.String())
+	dstURL := b.blobURL(dst.Bucket, *cleanBucketDestPath(src.Path, dst.Path))
+	resp, err := b.do("PUT", dstURL, nil, header, http.NoBody, 0)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	status := resp.Header.Get("x-ms-copy-status")
+	for status == "pending" {
+		time.Sleep(500 * time.Millisecond)
+		resp, err = b.do("HEAD", dstURL, nil, nil, nil, 0)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		status = resp.Header.Get("x-ms-copy-status")
+	}
+	if status != "" && status != "success" {
+		return fmt.Errorf("Copy of %s to %s %s: %s", src.String(), dst.String(), status, resp.Header.Get("x-ms-copy-status-description"))
+	}
+	return nil
+}
+
+// Checksum computes the hex MD5 of a content, the way List reports it
+func (b *azureBackend) Checksum(r io.Reader, size int64, like string) (string, error) {
+	h := md5.New()
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,371 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"crypto/hmac"
+	"crypto/md5"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/xml"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeAzureBlob struct {
+	content      []byte
+	contentType  string
+	cacheControl string
+}
+
+// A stand-in of the Blob service of a storage account, checking the shared
+// key signatures and listing two blobs by page
+type fakeAzure struct {
+	t        *testing.T
+	mutex    sync.Mutex
+	account  string
+	key      []byte
+	blobs    map[string]*fakeAzureBlob // by container/name
+	copies   map[string]bool           // pending copies
+	requests []*http.Request
+}
+
+// Shared key signature of the request, as the service computes it
+func (s *fakeAzure) expectedAuthorization(r *http.Request) string {
+	contentLength := ""
+	if r.ContentLength > 0 {
+		contentLength = fmt.Sprint(r.ContentLength)
+	}
+	headers := make([]string, 0)
+	for name := range r.Header {
+		if strings.HasPrefix(strings.ToLower(name), "x-ms-") {
+			headers = append(headers, strings.ToLower(name)+":"+r.Header.Get(name))
+		}
+	}
+	sort.Strings(headers)
+
+	resource := "/" + s.account + r.URL.EscapedPath()
+	query := r.URL.Query()
+	names := make([]string, 0)
+	for name := range query {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		resource += "\n" + name + ":" + strings.Join(query[name], ",")
+	}
+
+	toSign := strings.Join([]string{
+		r.Method, r.Header.Get("Content-Encoding"), r.Header.Get("Content-Language"), contentLength,
+		r.Header.Get("Content-MD5"), r.Header.Get("Content-Type"), "", r.Header.Get("If-Modified-Since"),
+		r.Header.Get("If-Match"), r.Header.Get("If-None-Match"), r.Header.Get("If-Unmodified-Since"), r.Header.Get("Range"),
+	}, "\n") + "\n" + strings.Join(headers, "\n") + "\n" + resource
+
+	mac := hmac.New(sha256.New, s.key)
+	mac.Write([]byte(toSign))
+	return "SharedKey " + s.account + ":" + base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+func (s *fakeAzure) error(w http.ResponseWriter, r *http.Request, status int, code string) {
+	w.Header().Set("x-ms-error-code", code)
+	w.WriteHeader(status)
+	if r.Method != "HEAD" {
+		fmt.Fprintf(w, "<?xml version=\"1.0\" encoding=\"utf-8\"?><Error><Code>%s</Code><Message>Details of %s\nRequestId:1234</Message></Error>", code, code)
+	}
+}
+
+func (s *fakeAzure) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+	s.requests = append(s.requests, r)
+
+	if r.Header.Get("x-ms-version") == "" || r.Header.Get("x-ms-date") == "" {
+		s.t.Errorf("%s %s: missing x-ms-version or x-ms-date", r.Method, r.URL)
+	}
+	if s.key != nil && r.Header.Get("Authorization") != s.expectedAuthorization(r) {
+		s.error(w, r, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+	if s.key == nil && r.URL.Query().Get("sig") == "" {
+		s.error(w, r, http.StatusForbidden, "AuthenticationFailed")
+		return
+	}
+
+	parts := strings.SplitN(strings.TrimPrefix(r.URL.Path, "/"+s.account+"/"), "/", 2)
+	if len(parts) == 1 {
+		if r.Method != "GET" || r.URL.Query().Get("restype") != "container" || r.URL.Query().Get("comp") != "list" {
+			s.error(w, r, http.StatusBadRequest, "InvalidQueryParameterValue")
+			return
+		}
+		s.list(w, r, parts[0])
+		return
+	}
+
+	key := parts[0] + "/" + parts[1]
+	blob, found := s.blobs[key]
+	switch {
+	case r.Method == "PUT" && r.Header.Get("x-ms-copy-source") != "":
+		source := strings.SplitN(strings.TrimPrefix(r.Header.Get("x-ms-copy-source"), "http://"+r.Host+"/"+s.account+"/"), "?", 2)[0]
+		blob, found := s.blobs[source]
+		if !found {
+			s.error(w, r, http.StatusNotFound, "CannotVerifyCopySource")
+			return
+		}
+		copied := *blob
+		s.blobs[key] = &copied
+		s.copies[key] = true
+		w.Header().Set("x-ms-copy-status", "pending")
+		w.WriteHeader(http.StatusAccepted)
+	case r.Method == "PUT":
+		if r.Header.Get("x-ms-blob-type") != "BlockBlob" {
+			s.error(w, r, http.StatusBadRequest, "MissingRequiredHeader")
+			return
+		}
+		content, _ := ioutil.ReadAll(r.Body)
+		s.blobs[key] = &fakeAzureBlob{
+			content:      content,
+			contentType:  r.Header.Get("x-ms-blob-content-type"),
+			cacheControl: r.Header.Get("x-ms-blob-cache-control"),
+		}
+		w.WriteHeader(http.StatusCreated)
+	case !found:
+		s.error(w, r, http.StatusNotFound, "BlobNotFound")
+	case r.Method == "HEAD":
+		sum := md5.Sum(blob.content)
+		w.Header().Set("Content-Length", fmt.Sprint(len(blob.content)))
+		w.Header().Set("Content-MD5", base64.StdEncoding.EncodeToString(sum[:]))
+		if s.copies[key] {
+			// The copy completes on the first poll
+			w.Header().Set("x-ms-copy-status", "success")
+			delete(s.copies, key)
+		}
+	case r.Method == "GET":
+		w.Write(blob.content)
+	case r.Method == "DELETE":
+		delete(s.blobs, key)
+		w.WriteHeader(http.StatusAccepted)
+	default:
+		s.error(w, r, http.StatusBadRequest, "UnsupportedHttpVerb")
+	}
+}
+
+func (s *fakeAzure) list(w http.ResponseWriter, r *http.Request, container string) {
+	names := make([]string, 0)
+	for key := range s.blobs {
+		if strings.HasPrefix(key, container+"/"+r.URL.Query().Get("prefix")) {
+			names = append(names, strings.TrimPrefix(key, container+"/"))
+		}
+	}
+	sort.Strings(names)
+
+	type properties struct {
+		ContentLength int    `xml:"Content-Length"`
+		ContentMD5    string `xml:"Content-MD5"`
+	}
+	type blob struct {
+		Name       string
+		Properties properties
+	}
+	page := struct {
+		XMLName    xml.Name `xml:"EnumerationResults"`
+		Blobs      []blob   `xml:"Blobs>Blob"`
+		NextMarker string
+	}{}
+
+	start := 0
+	if marker := r.URL.Query().Get("marker"); marker != "" {
+		start = sort.SearchStrings(names, marker)
+	}
+	for i := start; i < len(names) && i < start+2; i++ {
+		content := s.blobs[container+"/"+names[i]].content
+		sum := md5.Sum(content)
+		page.Blobs = append(page.Blobs, blob{names[i], properties{len(content), base64.StdEncoding.EncodeToString(sum[:])}})
+	}
+	if start+2 < len(names) {
+		page.NextMarker = names[start+2]
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	xml.NewEncoder(w).Encode(page)
+}
+
+func (s *fakeAzure) names() []string {
+	names := make([]string, 0, len(s.blobs))
+	for key := range s.blobs {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestAzureBackend(t *testing.T, config *Config) (*fakeAzure, *httptest.Server, Backend) {
+	fake := &fakeAzure{
+		t:       t,
+		account: "testaccount",
+		blobs:   make(map[string]*fakeAzureBlob),
+		copies:  make(map[string]bool),
+	}
+	if config.AzureKey != "" {
+		fake.key, _ = base64.StdEncoding.DecodeString(config.AzureKey)
+	}
+	server := httptest.NewServer(fake)
+
+	config.AzureAccount = fake.account
+	config.AzureEndpoint = server.URL + "/" + fake.account
+	backend, err := newAzureBackend(config)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return fake, server, backend
+}
+
+func TestAzureBackendSync(t *testing.T) {
+	config := &Config{
+		AzureKey:       base64.StdEncoding.EncodeToString([]byte("test key")),
+		CacheControl:   "no-cache",
+		ImmutableFiles: []string{"*.chunk.js"},
+	}
+	fake, server, _ := newTestAzureBackend(t, config)
+	defer server.Close()
+
+	// More blobs than a page
+	fake.blobs["$web/app/stale.html"] = &fakeAzureBlob{content: []byte("stale")}
+	fake.blobs["$web/app/js/stale.js"] = &fakeAzureBlob{content: []byte("stale")}
+	fake.blobs["$web/app/index.html"] = &fakeAzureBlob{content: []byte("<html>previous</html>")}
+	fake.blobs["$web/other/keep.txt"] = &fakeAzureBlob{content: []byte("keep")}
+
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(t, srcDir, map[string]string{
+		"index.html":            "<html>new</html>",
+		"js/main.1a2b.chunk.js": "main()",
+		"css/style.css":         "a{}",
+		"empty.txt":             "",
+	})
+
+	if err := S3Sync(config, srcDir+"/", "az://$web/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"$web/app/css/style.css", "$web/app/empty.txt", "$web/app/index.html", "$web/app/js/main.1a2b.chunk.js", "$web/other/keep.txt"}
+	if names := fake.names(); !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+	if content := string(fake.blobs["$web/app/index.html"].content); content != "<html>new</html>" {
+		t.Errorf("index.html: got %s", content)
+	}
+
+	tests := []struct {
+		name         string
+		cacheControl string
+	}{
+		{"$web/app/index.html", "no-cache"},
+		{"$web/app/css/style.css", "no-cache"},
+		{"$web/app/js/main.1a2b.chunk.js", immutableCacheControl},
+	}
+	for _, test := range tests {
+		blob := fake.blobs[test.name]
+		contentType := mime.TypeByExtension(path.Ext(test.name))
+		if blob.contentType != contentType || blob.cacheControl != test.cacheControl {
+			t.Errorf("%s: got %s and %s, want %s and %s", test.name, blob.contentType, blob.cacheControl, contentType, test.cacheControl)
+		}
+	}
+}
+
+func TestAzureBackendBlobs(t *testing.T) {
+	config := &Config{AzureKey: base64.StdEncoding.EncodeToString([]byte("test key"))}
+	fake, server, backend := newTestAzureBackend(t, config)
+	defer server.Close()
+
+	content := []byte("window._env_ = {}")
+	fake.blobs["site/a/env-config.js"] = &fakeAzureBlob{content: content}
+
+	uri := &FileURI{Scheme: "az", Bucket: "site", Path: "a/env-config.js"}
+	file, err := backend.Stat(uri)
+	if err != nil || file == nil || file.Size != int64(len(content)) {
+		t.Fatalf("got %+v %v", file, err)
+	}
+	checksum, err := backend.(Checksummer).Checksum(bytes.NewReader(content), int64(len(content)), file.Checksum)
+	if err != nil || checksum != file.Checksum {
+		t.Errorf("checksum %s, listed %s (%v)", checksum, file.Checksum, err)
+	}
+
+	r, err := backend.Get(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %s", got)
+	}
+
+	// The copy is pending until the blob is polled
+	copied := &FileURI{Scheme: "az", Bucket: "site", Path: "b/env-config.js"}
+	if err := backend.Copy(uri, copied); err != nil {
+		t.Fatal(err)
+	}
+	if fake.blobs["site/b/env-config.js"] == nil || fake.copies["site/b/env-config.js"] {
+		t.Errorf("the copy was not completed")
+	}
+
+	// Removing a missing blob is not an error
+	missing := &FileURI{Scheme: "az", Bucket: "site", Path: "a/missing.js"}
+	if err := backend.Delete([]*FileURI{uri, missing}); err != nil {
+		t.Fatal(err)
+	}
+	if file, err := backend.Stat(uri); file != nil || err != nil {
+		t.Errorf("got %+v %v after the removal", file, err)
+	}
+
+	// The errors carry the code and the first line of the message
+	fake.key = []byte("another key")
+	_, err = backend.List(&FileURI{Scheme: "az", Bucket: "site", Path: "/"})
+	if err == nil || !strings.HasSuffix(err.Error(), "AuthenticationFailed: Details of AuthenticationFailed") {
+		t.Errorf("got %v, want the code and message of the API", err)
+	}
+}
+
+// Without a shared key the requests carry the SAS token
+func TestAzureBackendSAS(t *testing.T) {
+	config := &Config{AzureSAS: "?sv=2019-12-12&ss=b&sp=rwdl&sig=c2lnbmF0dXJl"}
+	fake, server, backend := newTestAzureBackend(t, config)
+	defer server.Close()
+
+	fake.blobs["site/index.html"] = &fakeAzureBlob{content: []byte("<html></html>")}
+	files, err := backend.List(&FileURI{Scheme: "az", Bucket: "site", Path: "/"})
+	if err != nil || len(files) != 1 || files[0].Name != "index.html" {
+		t.Fatalf("got %v %v", files, err)
+	}
+	request := fake.requests[len(fake.requests)-1]
+	if request.Header.Get("Authorization") != "" || request.URL.Query().Get("sp") != "rwdl" {
+		t.Errorf("unexpected authentication: %s %s", request.Header.Get("Authorization"), request.URL)
+	}
+}
@@ -0,0 +1,154 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Backend stores the files of a deployment, addressed by FileURI. The sync
+// pipeline works between any two backends.
+type Backend interface {
+	// List the files found under uri, the names being complete paths or keys
+	List(uri *FileURI) ([]FileObject, error)
+	// Stat returns nil when the file does not exist
+	Stat(uri *FileURI) (*FileObject, error)
+	Put(uri *FileURI, r io.Reader, size int64) error
+	Get(uri *FileURI) (io.ReadCloser, error)
+	Delete(uris []*FileURI) error
+	// Copy a file within the backend
+	Copy(src, dst *FileURI) error
+}
+
+// Checksummer is implemented by the backends whose checksums are not Amazon
+// ETags. Checksum computes the checksum of a content in the format of like,
+// a checksum reported by the backend.
+type Checksummer interface {
+	Checksum(r io.Reader, size int64, like string) (string, error)
+}
+
+// BackendFactory creates the backend of a scheme for a run
+type BackendFactory func(config *Config) (Backend, error)
+
+var backendFactories = make(map[string]BackendFactory)
+
+// RegisterBackend makes a backend available for the <scheme>:// URIs
+func RegisterBackend(scheme string, factory BackendFactory) {
+	backendFactories[scheme] = factory
+}
+
+func init() {
+	RegisterBackend("file", func(config *Config) (Backend, error) { return fileBackend{}, nil })
+	RegisterBackend("s3", newS3Backend)
+}
+
+// BackendSchemes returns the schemes of the registered backends.
+func BackendSchemes() []string {
+	schemes := make([]string, 0, len(backendFactories))
+	for scheme := range backendFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+func newBackend(config *Config, scheme string) (Backend, error) {
+	factory, found := backendFactories[scheme]
+	if !found {
+		return nil, fmt.Errorf("Invalid URI scheme %s, must be one of %s", scheme, strings.Join(BackendSchemes(), "/"))
+	}
+	return factory(config)
+}
+
+// Local file system
+type fileBackend struct{}
+
+func (fileBackend) List(uri *FileURI) ([]FileObject, error) {
+	files := make([]FileObject, 0)
+	err := filepath.Walk(uri.Path, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			// Like an empty bucket, a directory to create has no files
+			if path == uri.Path && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if info.IsDir() {
+			return nil
+		}
+		files = append(files, FileObject{
+			Name:    path,
+			Size:    info.Size(),
+			ModTime: info.ModTime(),
+		})
+		return nil
+	})
+	return files, err
+}
+
+func (fileBackend) Stat(uri *FileURI) (*FileObject, error) {
+	info, err := os.Stat(uri.Path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FileObject{Name: uri.Path, Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (fileBackend) Put(uri *FileURI, r io.Reader, size int64) error {
+	if err := os.MkdirAll(filepath.Dir(uri.Path), 0755); err != nil {
+		return fmt.Errorf("Error making directory dir=%s error=%v", filepath.Dir(uri.Path), err)
+	}
+
+	fd, err := os.Create(uri.Path)
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(fd, r); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func (fileBackend) Get(uri *FileURI) (io.ReadCloser, error) {
+	return os.Open(uri.Path)
+}
+
+func (fileBackend) Delete(uris []*FileURI) error {
+	for _, uri := range uris {
+		if err := os.Remove(uri.Path); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+func (b fileBackend) Copy(src, dst *FileURI) error {
+	fd, err := os.Open(src.Path)
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+	return b.Put(dst, fd, -1)
+}
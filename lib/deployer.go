@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"net/url"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/otiai10/copy"
+)
+
+// Deployer publishes the work directory built by BuildWorkDir
+type Deployer interface {
+	Deploy(workdir string) error
+}
+
+// DeployerFactory creates the deployer of a destination URI
+type DeployerFactory func(destination *url.URL, config *Config) (Deployer, error)
+
+var deployerFactories = make(map[string]DeployerFactory)
+
+// RegisterDeployer makes a deployer available for the <scheme>:// destinations
+func RegisterDeployer(scheme string, factory DeployerFactory) {
+	deployerFactories[scheme] = factory
+}
+
+func init() {
+	RegisterDeployer("file", newFileDeployer)
+	RegisterDeployer("s3", newSyncDeployer)
+	RegisterDeployer("gs", newSyncDeployer)
+	RegisterDeployer("az", newSyncDeployer)
+	RegisterDeployer("sftp", newSyncDeployer)
+}
+
+// DeployerSchemes returns the schemes of the registered deployers.
+func DeployerSchemes() []string {
+	schemes := make([]string, 0, len(deployerFactories))
+	for scheme := range deployerFactories {
+		schemes = append(schemes, scheme)
+	}
+	sort.Strings(schemes)
+	return schemes
+}
+
+// NewDeployer returns the deployer of a destination URI, a destination
+// without scheme being a local directory.
+func NewDeployer(destination string, config *Config) (Deployer, error) {
+	u, err := url.Parse(destination)
+	if err != nil {
+		return nil, fmt.Errorf("Invalid destination %s: %v", destination, err)
+	}
+	if u.Scheme == "" {
+		u.Scheme = "file"
+	}
+
+	factory, found := deployerFactories[u.Scheme]
+	if !found {
+		return nil, fmt.Errorf("Invalid destination %s, the scheme must be one of %s", destination, strings.Join(DeployerSchemes(), "/"))
+	}
+	return factory(u, config)
+}
+
+// Deploy builds the work directory of the application found in srcDir and
+// publishes it to destination. The work directory is removed afterwards.
+func Deploy(srcDir string, destination string, dotEnv *DotEnvConfig, config *Config) error {
+	deployer, err := NewDeployer(destination, config)
+	if err != nil {
+		return err
+	}
+
+	// The hashed config can be cached forever, a new deployment changes its name
+	if dotEnv.HashConfig {
+		globs, err := HashedConfigGlobs(dotEnv)
+		if err != nil {
+			return err
+		}
+		config.ImmutableFiles = append(config.ImmutableFiles, globs...)
+	}
+
+	err, workdir := BuildWorkDir(srcDir, dotEnv)
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(workdir)
+
+	return deployer.Deploy(workdir)
+}
+
+// Copies the application into a local directory, usually a Docker volume
+type fileDeployer struct {
+	dir string
+}
+
+func newFileDeployer(destination *url.URL, config *Config) (Deployer, error) {
+	dir := destination.Path
+	if destination.Host != "" {
+		// file://relative/dir
+		dir = destination.Host + dir
+	}
+	if dir == "" {
+		return nil, fmt.Errorf("Invalid destination %s: no directory", destination)
+	}
+	return fileDeployer{dir: dir}, nil
+}
+
+func (d fileDeployer) Deploy(workdir string) error {
+	return copy.Copy(workdir, d.dir)
+}
+
+// Synchronizes the application with a remote backend, removing the files
+// of the previous deployment
+type syncDeployer struct {
+	config      *Config
+	destination string
+}
+
+func newSyncDeployer(destination *url.URL, config *Config) (Deployer, error) {
+	if destination.Host == "" {
+		return nil, fmt.Errorf("Invalid destination %s: no bucket", destination)
+	}
+	return syncDeployer{config: config, destination: destination.String()}, nil
+}
+
+func (d syncDeployer) Deploy(workdir string) error {
+	return S3Sync(d.config, workdir+"/", d.destination)
+}
@@ -0,0 +1,172 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Records what it is asked to deploy
+type stubDeployer struct {
+	destination *url.URL
+	config      *Config
+	workdir     string
+	files       []string // content of the work directory while deploying
+}
+
+var stubDeployers []*stubDeployer
+
+func init() {
+	RegisterDeployer("stub", func(destination *url.URL, config *Config) (Deployer, error) {
+		d := &stubDeployer{destination: destination, config: config}
+		stubDeployers = append(stubDeployers, d)
+		return d, nil
+	})
+}
+
+func (d *stubDeployer) Deploy(workdir string) error {
+	d.workdir = workdir
+	err := filepath.Walk(workdir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(workdir, path)
+		d.files = append(d.files, filepath.ToSlash(rel))
+		return err
+	})
+	return err
+}
+
+func TestNewDeployer(t *testing.T) {
+	config := &Config{}
+	tests := []struct {
+		destination string
+		deployer    Deployer
+	}{
+		{"/var/www/html", fileDeployer{dir: "/var/www/html"}},
+		{"relative/html", fileDeployer{dir: "relative/html"}},
+		{"file:///var/www/html", fileDeployer{dir: "/var/www/html"}},
+		{"file://relative/html", fileDeployer{dir: "relative/html"}},
+		{"s3://bucket/prefix", syncDeployer{config: config, destination: "s3://bucket/prefix"}},
+		{"gs://bucket", syncDeployer{config: config, destination: "gs://bucket"}},
+		{"az://account/container", syncDeployer{config: config, destination: "az://account/container"}},
+		{"sftp://deploy@host/var/www", syncDeployer{config: config, destination: "sftp://deploy@host/var/www"}},
+	}
+	for _, test := range tests {
+		deployer, err := NewDeployer(test.destination, config)
+		if err != nil || !reflect.DeepEqual(deployer, test.deployer) {
+			t.Errorf("%s: got %#v %v, want %#v", test.destination, deployer, err, test.deployer)
+		}
+	}
+
+	stubDeployers = nil
+	if _, err := NewDeployer("stub://host/path?x=1", config); err != nil {
+		t.Fatal(err)
+	}
+	if len(stubDeployers) != 1 || stubDeployers[0].destination.String() != "stub://host/path?x=1" || stubDeployers[0].config != config {
+		t.Errorf("the stub deployer got %+v", stubDeployers)
+	}
+
+	errors := []struct {
+		destination string
+		err         string
+	}{
+		{"ftp://host/www", "Invalid destination ftp://host/www, the scheme must be one of " + strings.Join(DeployerSchemes(), "/")},
+		{"s3:///prefix", "Invalid destination s3:///prefix: no bucket"},
+		{"file://", "Invalid destination file:: no directory"},
+		{"%zz", `Invalid destination %zz: parse "%zz": invalid URL escape "%zz"`},
+	}
+	for _, test := range errors {
+		if _, err := NewDeployer(test.destination, config); err == nil || err.Error() != test.err {
+			t.Errorf("%s: got %v, want %s", test.destination, err, test.err)
+		}
+	}
+}
+
+func TestDeployerSchemes(t *testing.T) {
+	want := []string{"az", "file", "git+file", "git+ssh", "gs", "s3", "sftp", "stub", "tar", "zip"}
+	if schemes := DeployerSchemes(); !reflect.DeepEqual(schemes, want) {
+		t.Errorf("got %v, want %v", schemes, want)
+	}
+}
+
+// Deploy hands the work directory to the deployer of the destination then
+// removes it, the hashed config being immutable
+func TestDeploy(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(t, srcDir, map[string]string{
+		".env":       "API_URL=https://api.example.com\n",
+		"index.html": `<script src="/env-config.js"></script>`,
+	})
+
+	tests := []struct {
+		hash      bool
+		immutable []string
+	}{
+		{false, []string{"*.css"}},
+		{true, []string{"*.css", "env-config." + strings.Repeat("[0-9a-f]", hashLength) + ".js"}},
+	}
+	for _, test := range tests {
+		stubDeployers = nil
+		config := &Config{ImmutableFiles: []string{"*.css"}}
+		dotEnv := &DotEnvConfig{ConfigName: "env-config.js", Formats: []string{"js", "json"}, HashConfig: test.hash}
+		if err := Deploy(srcDir, "stub://site", dotEnv, config); err != nil {
+			t.Fatal(err)
+		}
+
+		if !reflect.DeepEqual(config.ImmutableFiles, test.immutable) {
+			t.Errorf("hash %v: got the immutable files %v, want %v", test.hash, config.ImmutableFiles, test.immutable)
+		}
+		if len(stubDeployers) != 1 {
+			t.Fatalf("hash %v: %d deployers created", test.hash, len(stubDeployers))
+		}
+		d := stubDeployers[0]
+		if d.config != config {
+			t.Errorf("hash %v: the deployer got another config", test.hash)
+		}
+		if len(d.files) != 3 || d.files[1] != "env-config.json" || d.files[2] != "index.html" {
+			t.Fatalf("hash %v: deployed %v", test.hash, d.files)
+		}
+		if ok, _ := filepath.Match(test.immutable[len(test.immutable)-1], d.files[0]); test.hash && !ok {
+			t.Errorf("hash %v: %s is not hashed", test.hash, d.files[0])
+		} else if !test.hash && d.files[0] != "env-config.js" {
+			t.Errorf("hash %v: %s is hashed", test.hash, d.files[0])
+		}
+		if _, err := os.Stat(d.workdir); !os.IsNotExist(err) {
+			t.Errorf("hash %v: the work directory %s is left: %v", test.hash, d.workdir, err)
+		}
+	}
+
+	// An invalid destination fails before building anything
+	stubDeployers = nil
+	config := &Config{}
+	if err := Deploy(srcDir, "ftp://site", &DotEnvConfig{ConfigName: "env-config.js", HashConfig: true}, config); err == nil {
+		t.Errorf("expected an error for an unknown scheme")
+	}
+	if len(config.ImmutableFiles) != 0 {
+		t.Errorf("got the immutable files %v", config.ImmutableFiles)
+	}
+}
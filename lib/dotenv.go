@@ -18,47 +18,276 @@ package lib
 import (
 	"os"
 	"errors"
-	"bufio"
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"path/filepath"
 	"strings"
 	"text/template"
 )
 
 type EnvVar struct {
-	Name string
-	Value string
+	Name   string `json:"name"`
+	Value  string `json:"value"`
+	Source string `json:"source"` // where the value comes from, the environment or a dotenv file
+	Type   string `json:"type"`   // type of the value in the generated config: string, number, boolean, null or json
+}
+
+// Source of the values read from the process environment
+const sourceEnvironment = "environment"
+
+// DotEnvConfig holds the options used to generate the runtime configuration
+type DotEnvConfig struct {
+	EnvFiles          []string // dotenv files, relative to the source directory, the later ones override the former ones
+	Mode              string   // deployment mode, adds the .env.<mode> layer below .env.local
+	Verbose           bool     // print where the value of each variable comes from
+	Prefixes          []string // export every environment variable starting with one of these prefixes
+	StripPrefix       bool     // remove the prefix from the name of the exported variables
+	Deny              []string // globs of the environment variables never exported by prefix, added to DefaultDeny
+	AllowSecrets      []string // variables published even though they look like secrets
+	EnvDir            string   // directory where each file holds the value of the variable it is named after
+	SSMEndpoint       string   // endpoint of the SSM service resolving the ref+ssm:// values
+	Exclude           []string // globs of the source files left out of the deployment
+	ConfigName        string   // name of the generated script, other formats derive their name from it
+	Formats           []string // output formats, each one is "format" or "format=filename"
+	GlobalName        string   // global variable set by the js format
+	Template          string   // template replacing the built-in js format, relative to the source directory
+	RenderTemplates   bool     // render the *.tmpl files of the source directory
+	Inject            string   // inline the config in HTML files as a "script" or a "meta" tag
+	InjectFiles       []string // HTML files to inject the config into, relative to the source directory
+	Placeholders      bool     // replace the variable placeholders found in the text assets
+	PlaceholderGlobs  []string // files scanned for placeholders
+	PlaceholderDelims []string // placeholder delimiters, either "open:close" or a single string used on both sides
+	PlaceholderRaw    bool     // insert the values as is instead of encoding them for the type of the file
+	PlaceholderIgnore []string // globs of the placeholder names not reported when they have no value
+	HashConfig        bool     // add a hash of the content to the names of the generated config files
+	SchemaFile        string   // schema validating the variables, relative to the source directory, defaults to the dotenv file + .schema
+	Production        bool     // enforce the no-default schema rule
+	TypedValues       bool     // emit booleans, numbers, null and JSON natively instead of strings
+	SettingsFile      string   // config file of go-deploy, left out of the deployment when it is in the source directory
 }
 
 var tpl = `'use strict'
-window._env_ = { {{ range . }}
-    {{ .Name }}: "{{ .Value }}",{{end}}
+window.{{ global }} = { {{ range . }}
+    {{ jsKey .Name }}: {{ jsValue . }},{{end}}
+}
+`
+
+var jsonTpl = `{ {{ range $i, $v := . }}{{ if $i }},{{ end }}
+    {{ jsString $v.Name }}: {{ jsValue $v }}{{ end }}
+}
+`
+
+var esmTpl = `export default { {{ range . }}
+    {{ jsKey .Name }}: {{ jsValue . }},{{end}}
+}
+`
+
+var dtsTpl = `export interface Env { {{ range . }}
+    readonly {{ jsKey .Name }}: {{ tsType . }};{{ end }}
 }
+
+declare global {
+    interface Window {
+        {{ global }}: Env;
+    }
+}
+
+declare const env: Env;
+export default env;
 `
 
+type outputFormat struct {
+	Ext      string
+	Template string
+}
+
+// Supported formats of the generated configuration
+var outputFormats = map[string]outputFormat{
+	"js":   {".js", tpl},
+	"json": {".json", jsonTpl},
+	"esm":  {".mjs", esmTpl},
+	"dts":  {".d.ts", dtsTpl},
+}
+
+// A configuration file to generate
+type configOutput struct {
+	Format   string
+	Filename string
+}
 
-func GenerateDotEnv(srcEnv string, dstEnvJs string ) error {
+var tplFuncs = template.FuncMap{
+	"jsKey":    jsKey,
+	"jsString": jsString,
+	"jsValue":  jsValue,
+	"tsType":   tsType,
+}
+
+// Encode a value as a JavaScript string literal. JSON strings are valid JS
+// literals, and encoding/json also escapes <, >, &, U+2028 and U+2029 so the
+// result can safely be inlined in a <script> tag.
+func jsString(value string) string {
+	b, err := json.Marshal(value)
+	if err != nil {
+		return `""`
+	}
+	return string(b)
+}
 
-		if _, err := os.Stat(srcEnv); os.IsNotExist(err) {
-			return errors.New(".env file is not present (" + srcEnv + ")")
+// Encode a key of an object literal, quoting it when it is not a valid
+// identifier. A __proto__ key would set the prototype of the object instead
+// of adding a property, unless it is computed.
+func jsKey(name string) string {
+	if name == "__proto__" {
+		return "[" + jsString(name) + "]"
+	}
+	if isJsIdentifier(name) {
+		return name
+	}
+	return jsString(name)
+}
+
+func isJsIdentifier(name string) bool {
+	if name == "" {
+		return false
+	}
+	for i, c := range name {
+		if c == '_' || c == '$' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') {
+			continue
+		}
+		if i > 0 && c >= '0' && c <= '9' {
+			continue
 		}
+		return false
+	}
+	return true
+}
+
+
+// GenerateDotEnv resolves the variables of the dotenv file of srcDir and
+// writes the configured config files into dstDir. The resolved variables are
+// returned so that other files can be rendered with them.
+func GenerateDotEnv(srcDir string, dstDir string, config *DotEnvConfig) (error, []EnvVar) {
 
-		err, vars := getVars(srcEnv)
+		err, vars := GetVars(srcDir, config)
 		if(err != nil) {
+			return err, nil
+		}
+
+		if err := CheckSecrets(vars, config.AllowSecrets); err != nil {
+			return err, nil
+		}
+
+		return renderDotEnv(vars, srcDir, dstDir, config), vars
+
+}
+
+// Resolve the list of files to generate from the configured formats. The js
+// format is written to ConfigName, the others replace its extension with their own.
+func configOutputs(config *DotEnvConfig) ([]configOutput, error) {
+	formats := config.Formats
+	if len(formats) == 0 {
+		formats = []string{"js"}
+	}
+
+	base := strings.TrimSuffix(config.ConfigName, filepath.Ext(config.ConfigName))
+
+	outputs := make([]configOutput, 0, len(formats))
+	for _, spec := range formats {
+		parts := strings.SplitN(spec, "=", 2)
+		format, found := outputFormats[parts[0]]
+		if !found {
+			return nil, fmt.Errorf("Unknown config format %s (valid formats: js, json, esm, dts)", parts[0])
+		}
+
+		output := configOutput{Format: parts[0]}
+		switch {
+		case len(parts) == 2 && parts[1] != "":
+			output.Filename = parts[1]
+		case parts[0] == "js":
+			output.Filename = config.ConfigName
+		default:
+			output.Filename = base + format.Ext
+		}
+		outputs = append(outputs, output)
+	}
+	return outputs, nil
+}
+
+func renderDotEnv(vars []EnvVar, srcDir string, dstDir string, config *DotEnvConfig) error {
+	outputs, err := configOutputs(config)
+	if err != nil {
+		return err
+	}
+
+	renamed := make(map[string]string)
+
+	for _, output := range outputs {
+		t, err := configTemplate(output.Format, vars, srcDir, config)
+		if err != nil {
+			return err
+		}
+
+		if config.HashConfig && isHashedFormat(output.Format) {
+			var content bytes.Buffer
+			if err := t.Execute(&content, vars); err != nil {
+				return err
+			}
+			hashed := hashedName(output.Filename, content.Bytes())
+			renamed[filepath.Base(output.Filename)] = filepath.Base(hashed)
+			output.Filename = hashed
+		}
+
+		if err := renderTemplate(t, vars, filepath.Join(dstDir, output.Filename)); err != nil {
 			return err
 		}
+	}
+
+	if len(renamed) > 0 {
+		return rewriteReferences(dstDir, renamed)
+	}
+	return nil
+}
+
+// Name of the global variable set by the js format, _env_ by default
+func configGlobalName(config *DotEnvConfig) (string, error) {
+	globalName := config.GlobalName
+	if globalName == "" {
+		globalName = "_env_"
+	}
+	if !isJsIdentifier(globalName) {
+		return "", fmt.Errorf("Invalid global variable name: %s", globalName)
+	}
+	return globalName, nil
+}
+
+// Build the template of a config format, the js format may be replaced by a user template
+func configTemplate(format string, vars []EnvVar, srcDir string, config *DotEnvConfig) (*template.Template, error) {
+	globalName, err := configGlobalName(config)
+	if err != nil {
+		return nil, err
+	}
 
-		return renderDotEnv(vars, dstEnvJs)
+	funcs := templateFuncs(vars, globalName)
 
+	if format == "js" && config.Template != "" {
+		return loadTemplate(filepath.Join(srcDir, config.Template), funcs)
+	}
+	return template.Must(template.New(format).Funcs(funcs).Parse(outputFormats[format].Template)), nil
 }
 
-func renderDotEnv(vars []EnvVar, dstEnvJs string) error {
-	envConfig, err := os.Create(dstEnvJs)
+func renderTemplate(t *template.Template, data interface{}, dstFile string) error {
+	if err := os.MkdirAll(filepath.Dir(dstFile), 0755); err != nil {
+		return err
+	}
+
+	envConfig, err := os.Create(dstFile)
   if err != nil {
-  	return errors.New("Unable to create destination file: " + dstEnvJs)
+  	return errors.New("Unable to create destination file: " + dstFile)
   }
   defer envConfig.Close()
 
-  t := template.Must(template.New("vars").Parse(tpl))
-  err = t.Execute(envConfig, vars)
+  err = t.Execute(envConfig, data)
   if err != nil {
   	return err
   }
@@ -67,30 +296,160 @@ func renderDotEnv(vars []EnvVar, dstEnvJs string) error {
 }
 
 
-func getVars(dotEnv string) (error, []EnvVar) {
-		file, err := os.Open(dotEnv)
+// GetVars resolves the variables of the dotenv files of srcDir, the values
+// set in the environment take precedence over the ones of the files.
+func GetVars(srcDir string, config *DotEnvConfig) (error, []EnvVar) {
+		layers, err := envLayers(srcDir, config)
 		if err != nil {
 			return err, nil
-    }
-    defer file.Close()
+		}
 
-    vars := make([]EnvVar,0)
+		entries := make([]dotEnvEntry, 0)
+		for _, layer := range layers {
+			layerEntries, err := readDotEnv(srcDir, layer)
+			if err != nil {
+				return err, nil
+			}
+			entries = append(entries, layerEntries...)
+		}
+
+		// The mounted directory has precedence over the dotenv files
+		if config.EnvDir != "" {
+			dirEntries, err := readEnvDir(config.EnvDir)
+			if err != nil {
+				return err, nil
+			}
+			entries = append(entries, dirEntries...)
+		}
 
-    scanner := bufio.NewScanner(file)
+    // A key defined twice keeps its first position but takes the last value,
+    // so the later layers override the former ones
+    names := make([]string, 0)
+    byName := make(map[string]dotEnvEntry)
+    for _, entry := range entries {
+        if _, found := byName[entry.Name]; !found {
+          names = append(names, entry.Name)
+        }
+        byName[entry.Name] = entry
+    }
 
-    for scanner.Scan() {
-        line := strings.Split(scanner.Text(), "=")
+    interpolator := newInterpolator(entries)
 
-        name := line[0]
-        value, exists := os.LookupEnv(name)
+    vars := make([]EnvVar,0)
+    for _, name := range names {
+        value, source, exists, err := lookupEnv(name)
+        if err != nil {
+          return err, nil
+        }
         if(!exists) {
-        	value = line[1]
+          source = byName[name].File
+          value, err = interpolator.resolve(byName[name])
+          if err != nil {
+            return err, nil
+          }
         }
-        vars = append(vars,EnvVar{name, value})
+        vars = append(vars,EnvVar{Name: name, Value: value, Source: source})
     }
 
-    if err := scanner.Err(); err != nil {
+    if len(config.Prefixes) > 0 {
+      vars, err = appendPrefixedVars(vars, config)
+      if err != nil {
+        return err, nil
+      }
+    }
+
+    if err := newRefResolver(srcDir, layers, config).resolveVars(vars); err != nil {
       return err, nil
     }
+
+    var schema []*varSchema
+    schemaFile := filepath.Join(srcDir, schemaFileName(layers, config))
+    if _, err := os.Stat(schemaFile); err == nil || config.SchemaFile != "" {
+      schema, err = loadSchema(schemaFile)
+      if err != nil {
+        return err, nil
+      }
+
+      // Variables declared in the schema are exported even when the .env file doesn't define them
+      for _, s := range schema {
+        if hasVar(vars, s.Name) {
+          continue
+        }
+        value, source, exists, err := lookupEnv(s.Name)
+        if err != nil {
+          return err, nil
+        }
+        if exists {
+          vars = append(vars, EnvVar{Name: s.Name, Value: value, Source: source})
+        }
+      }
+
+      if err := validateVars(vars, schema, layers, config.Production); err != nil {
+        return err, nil
+      }
+    }
+
+    setVarTypes(vars, schema, config.TypedValues)
+
     return nil, vars
 }
+
+// Schema of the variables relative to the source directory, the first
+// dotenv file with the .schema suffix unless configured
+func schemaFileName(layers []string, config *DotEnvConfig) string {
+	if config.SchemaFile != "" {
+		return config.SchemaFile
+	}
+	return layers[0] + schemaExt
+}
+
+// Files of the source directory that only feed the config: the dotenv layers
+// and the schema, they are not part of the deployed application
+func envSourceFiles(srcDir string, config *DotEnvConfig) ([]string, error) {
+	layers, err := envLayers(srcDir, config)
+	if err != nil {
+		return nil, err
+	}
+	return append(layers, schemaFileName(layers, config)), nil
+}
+
+// List the dotenv files to read, by increasing precedence: the configured
+// files, which must exist, then <first file>.<mode> when a mode is set and
+// <first file>.local when they exist.
+func envLayers(srcDir string, config *DotEnvConfig) ([]string, error) {
+	files := config.EnvFiles
+	if len(files) == 0 {
+		files = []string{".env"}
+	}
+
+	layers := make([]string, 0, len(files)+2)
+	for _, file := range files {
+		path := filepath.Join(srcDir, file)
+		if _, err := os.Stat(path); os.IsNotExist(err) {
+			return nil, errors.New(".env file is not present (" + path + ")")
+		}
+		layers = append(layers, file)
+	}
+
+	optional := []string{files[0] + ".local"}
+	if config.Mode != "" {
+		optional = []string{files[0] + "." + config.Mode, files[0] + ".local"}
+	}
+	for _, file := range optional {
+		if _, err := os.Stat(filepath.Join(srcDir, file)); err == nil {
+			layers = append(layers, file)
+		}
+	}
+	return layers, nil
+}
+
+// Parse a dotenv file of srcDir, its entries are attributed to its relative name
+func readDotEnv(srcDir string, file string) ([]dotEnvEntry, error) {
+	fd, err := os.Open(filepath.Join(srcDir, file))
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	return parseDotEnv(file, fd)
+}
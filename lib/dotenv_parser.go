@@ -0,0 +1,295 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"strings"
+)
+
+// A single KEY=value assignment read from a dotenv file
+type dotEnvEntry struct {
+	Name  string
+	Value string
+	File  string
+	Line  int
+	Quote byte // 0 when the value was not quoted, otherwise ', " or `
+}
+
+type dotEnvParser struct {
+	file string
+	src  string
+	pos  int
+	line int
+}
+
+// Parse a dotenv file. The following syntax is supported:
+//
+//   # full line comments and blank lines
+//   export KEY=value
+//   KEY=unquoted value # inline comment
+//   KEY='literal value, no escape sequences'
+//   KEY="value with \n escapes
+//   spanning several lines"
+//   KEY=`literal value that may contain ' and "
+//   and span several lines`
+//
+// Errors are reported with the file name and the line number.
+func parseDotEnv(file string, r io.Reader) ([]dotEnvEntry, error) {
+	data, err := ioutil.ReadAll(r)
+	if err != nil {
+		return nil, err
+	}
+
+	p := &dotEnvParser{
+		file: file,
+		src:  strings.Replace(string(data), "\r\n", "\n", -1),
+		line: 1,
+	}
+
+	entries := make([]dotEnvEntry, 0)
+	for {
+		p.skipSpaces()
+		if p.eof() {
+			break
+		}
+
+		switch p.peek() {
+		case '\n':
+			p.next()
+			continue
+		case '#':
+			p.skipLine()
+			continue
+		}
+
+		entry, err := p.parseEntry()
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, entry)
+	}
+	return entries, nil
+}
+
+func (p *dotEnvParser) parseEntry() (dotEnvEntry, error) {
+	entry := dotEnvEntry{File: p.file, Line: p.line}
+
+	name := p.readName()
+	if name == "export" && (p.peek() == ' ' || p.peek() == '\t') {
+		p.skipSpaces()
+		// "export = value" assigns a variable that is actually named export
+		if p.peek() != '=' {
+			name = p.readName()
+		}
+	}
+	if !isValidEnvName(name) {
+		return entry, p.errorf(entry.Line, "invalid variable name %q", name+p.rest())
+	}
+	entry.Name = name
+
+	p.skipSpaces()
+	if p.peek() != '=' {
+		return entry, p.errorf(entry.Line, "expected '=' after %s", name)
+	}
+	p.next()
+	p.skipSpaces()
+
+	var err error
+	switch p.peek() {
+	case '\'':
+		entry.Quote = '\''
+		entry.Value, err = p.readSingleQuoted()
+	case '"':
+		entry.Quote = '"'
+		entry.Value, err = p.readDoubleQuoted()
+	case '`':
+		entry.Quote = '`'
+		entry.Value, err = p.readBacktickQuoted()
+	default:
+		entry.Value = p.readUnquoted()
+	}
+	if err != nil {
+		return entry, err
+	}
+
+	if entry.Quote != 0 {
+		// Only a comment may follow a quoted value
+		p.skipSpaces()
+		if !p.eof() && p.peek() != '\n' && p.peek() != '#' {
+			return entry, p.errorf(p.line, "unexpected characters after quoted value of %s", name)
+		}
+		p.skipLine()
+	}
+	return entry, nil
+}
+
+func (p *dotEnvParser) readName() string {
+	start := p.pos
+	for !p.eof() {
+		c := p.peek()
+		if c == '_' || c == '.' || c == '-' ||
+			(c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z') || (c >= '0' && c <= '9') {
+			p.next()
+			continue
+		}
+		break
+	}
+	return p.src[start:p.pos]
+}
+
+func (p *dotEnvParser) readSingleQuoted() (string, error) {
+	line := p.line
+	p.next()
+	start := p.pos
+	for !p.eof() {
+		switch p.peek() {
+		case '\'':
+			value := p.src[start:p.pos]
+			p.next()
+			return value, nil
+		case '\n':
+			return "", p.errorf(line, "unterminated single-quoted value")
+		}
+		p.next()
+	}
+	return "", p.errorf(line, "unterminated single-quoted value")
+}
+
+func (p *dotEnvParser) readBacktickQuoted() (string, error) {
+	line := p.line
+	p.next()
+	start := p.pos
+	for !p.eof() {
+		if p.peek() == '`' {
+			value := p.src[start:p.pos]
+			p.next()
+			return value, nil
+		}
+		p.next()
+	}
+	return "", p.errorf(line, "unterminated backtick-quoted value")
+}
+
+func (p *dotEnvParser) readDoubleQuoted() (string, error) {
+	line := p.line
+	p.next()
+	var value strings.Builder
+	for !p.eof() {
+		c := p.next()
+		switch c {
+		case '"':
+			return value.String(), nil
+		case '\\':
+			if p.eof() {
+				break
+			}
+			e := p.next()
+			switch e {
+			case 'n':
+				value.WriteByte('\n')
+			case 'r':
+				value.WriteByte('\r')
+			case 't':
+				value.WriteByte('\t')
+			case '"', '\\':
+				value.WriteByte(e)
+			case '\n':
+				// Escaped newline: the value continues on the next line
+			default:
+				value.WriteByte('\\')
+				value.WriteByte(e)
+			}
+		default:
+			value.WriteByte(c)
+		}
+	}
+	return "", p.errorf(line, "unterminated double-quoted value")
+}
+
+func (p *dotEnvParser) readUnquoted() string {
+	start := p.pos
+	end := p.pos
+	for !p.eof() && p.peek() != '\n' {
+		c := p.next()
+		if c == '#' && (p.pos-1 == start || p.src[p.pos-2] == ' ' || p.src[p.pos-2] == '\t') {
+			// Inline comment, drop the rest of the line
+			p.skipLine()
+			break
+		}
+		end = p.pos
+	}
+	return strings.TrimRight(p.src[start:end], " \t")
+}
+
+func (p *dotEnvParser) eof() bool {
+	return p.pos >= len(p.src)
+}
+
+func (p *dotEnvParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.src[p.pos]
+}
+
+func (p *dotEnvParser) next() byte {
+	c := p.src[p.pos]
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+func (p *dotEnvParser) skipSpaces() {
+	for !p.eof() && (p.peek() == ' ' || p.peek() == '\t') {
+		p.next()
+	}
+}
+
+// Skip everything up to and including the next newline
+func (p *dotEnvParser) skipLine() {
+	for !p.eof() {
+		if p.next() == '\n' {
+			return
+		}
+	}
+}
+
+// Remaining characters of the current line, used in error messages
+func (p *dotEnvParser) rest() string {
+	end := strings.IndexByte(p.src[p.pos:], '\n')
+	if end < 0 {
+		return p.src[p.pos:]
+	}
+	return p.src[p.pos : p.pos+end]
+}
+
+func (p *dotEnvParser) errorf(line int, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s", p.file, line, fmt.Sprintf(format, args...))
+}
+
+// A valid variable name starts with a letter or an underscore
+func isValidEnvName(name string) bool {
+	if name == "" {
+		return false
+	}
+	c := name[0]
+	return c == '_' || (c >= 'a' && c <= 'z') || (c >= 'A' && c <= 'Z')
+}
@@ -0,0 +1,448 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Names and values that break a naively generated config
+var nastyVars = []EnvVar{
+	{Name: "API_URL", Value: "https://api.example.com/v1?a=1&b=2"},
+	{Name: "QUOTES", Value: `say "hi" and 'bye'`},
+	{Name: "BACKSLASH", Value: `C:\path\to\n\file\`},
+	{Name: "NEWLINES", Value: "line1\nline2\r\nline3\ttab"},
+	{Name: "SCRIPT", Value: `</script><script>alert(1)</script>`},
+	{Name: "COMMENT", Value: `<!-- hidden --> */ /*`},
+	{Name: "SEPARATORS", Value: "a\u2028b\u2029c"},
+	{Name: "TEMPLATE", Value: "`${window.alert(1)}`"},
+	{Name: "CONTROL", Value: "nul\x00bell\x07"},
+	{Name: "UNICODE", Value: "héllo 世界 🚀"},
+	{Name: "EMPTY", Value: ""},
+	{Name: "my-key", Value: "dash"},
+	{Name: "1LEADING_DIGIT", Value: "digit"},
+	{Name: "with space", Value: "space"},
+	{Name: `quote"key`, Value: "quote"},
+	{Name: "$dollar_ok", Value: "dollar"},
+	{Name: "__proto__", Value: "proto"},
+	{Name: "COUNT", Value: "42", Type: typeNumber},
+	{Name: "ENABLED", Value: "true", Type: typeBoolean},
+	{Name: "NOTHING", Value: "null", Type: typeNull},
+	{Name: "OBJECT", Value: `{"html": "</script>", "list": [1, "\u2028"]}`, Type: typeJSON},
+}
+
+func nastyVarsTyped() []EnvVar {
+	vars := make([]EnvVar, len(nastyVars))
+	copy(vars, nastyVars)
+	for i := range vars {
+		if vars[i].Type == "" {
+			vars[i].Type = typeString
+		}
+	}
+	return vars
+}
+
+func renderFormat(t *testing.T, format string, vars []EnvVar) string {
+	tmpl, err := configTemplate(format, vars, "", &DotEnvConfig{})
+	if err != nil {
+		t.Fatalf("%s: %v", format, err)
+	}
+	var out bytes.Buffer
+	if err := tmpl.Execute(&out, vars); err != nil {
+		t.Fatalf("%s: %v", format, err)
+	}
+	return out.String()
+}
+
+func TestJsStringParses(t *testing.T) {
+	for _, v := range nastyVars {
+		encoded := jsString(v.Value)
+		var decoded string
+		if err := json.Unmarshal([]byte(encoded), &decoded); err != nil {
+			t.Errorf("jsString(%q) = %s does not parse: %v", v.Value, encoded, err)
+			continue
+		}
+		if decoded != v.Value {
+			t.Errorf("jsString(%q) decodes to %q", v.Value, decoded)
+		}
+	}
+}
+
+func TestJsKey(t *testing.T) {
+	tests := []struct {
+		name string
+		key  string
+	}{
+		{"API_URL", "API_URL"},
+		{"$dollar_ok", "$dollar_ok"},
+		{"_private", "_private"},
+		{"my-key", `"my-key"`},
+		{"1LEADING_DIGIT", `"1LEADING_DIGIT"`},
+		{"with space", `"with space"`},
+		{`quote"key`, `"quote\"key"`},
+		{"</script>", `"\u003c/script\u003e"`},
+		{"", `""`},
+	}
+	for _, test := range tests {
+		if key := jsKey(test.name); key != test.key {
+			t.Errorf("jsKey(%q) = %s, want %s", test.name, key, test.key)
+		}
+	}
+}
+
+func TestJsValue(t *testing.T) {
+	tests := []struct {
+		v     EnvVar
+		value string
+	}{
+		{EnvVar{Value: "42", Type: typeNumber}, "42"},
+		{EnvVar{Value: "-1.5e3", Type: typeNumber}, "-1.5e3"},
+		{EnvVar{Value: "not a number", Type: typeNumber}, `"not a number"`},
+		{EnvVar{Value: "true", Type: typeBoolean}, "true"},
+		{EnvVar{Value: "yes", Type: typeBoolean}, `"yes"`},
+		{EnvVar{Value: "null", Type: typeNull}, "null"},
+		{EnvVar{Value: `{ "a": "</script>" }`, Type: typeJSON}, `{"a":"\u003c/script\u003e"}`},
+		{EnvVar{Value: `{ broken`, Type: typeJSON}, `"{ broken"`},
+		{EnvVar{Value: "</script>", Type: typeString}, `"\u003c/script\u003e"`},
+	}
+	for _, test := range tests {
+		if value := jsValue(test.v); value != test.value {
+			t.Errorf("jsValue(%q as %s) = %s, want %s", test.v.Value, test.v.Type, value, test.value)
+		}
+	}
+}
+
+// The exact literals of the nasty variables, as keys of the js and esm
+// object literals, as keys of the json object and as values
+var nastyLiterals = []struct {
+	jsKey   string
+	jsonKey string
+	value   string
+}{
+	{`API_URL`, `"API_URL"`, `"https://api.example.com/v1?a=1\u0026b=2"`},
+	{`QUOTES`, `"QUOTES"`, `"say \"hi\" and 'bye'"`},
+	{`BACKSLASH`, `"BACKSLASH"`, `"C:\\path\\to\\n\\file\\"`},
+	{`NEWLINES`, `"NEWLINES"`, `"line1\nline2\r\nline3\ttab"`},
+	{`SCRIPT`, `"SCRIPT"`, `"\u003c/script\u003e\u003cscript\u003ealert(1)\u003c/script\u003e"`},
+	{`COMMENT`, `"COMMENT"`, `"\u003c!-- hidden --\u003e */ /*"`},
+	{`SEPARATORS`, `"SEPARATORS"`, `"a\u2028b\u2029c"`},
+	{`TEMPLATE`, `"TEMPLATE"`, "\"`${window.alert(1)}`\""},
+	{`CONTROL`, `"CONTROL"`, `"nul\u0000bell\u0007"`},
+	{`UNICODE`, `"UNICODE"`, `"héllo 世界 🚀"`},
+	{`EMPTY`, `"EMPTY"`, `""`},
+	{`"my-key"`, `"my-key"`, `"dash"`},
+	{`"1LEADING_DIGIT"`, `"1LEADING_DIGIT"`, `"digit"`},
+	{`"with space"`, `"with space"`, `"space"`},
+	{`"quote\"key"`, `"quote\"key"`, `"quote"`},
+	{`$dollar_ok`, `"$dollar_ok"`, `"dollar"`},
+	{`["__proto__"]`, `"__proto__"`, `"proto"`},
+	{`COUNT`, `"COUNT"`, `42`},
+	{`ENABLED`, `"ENABLED"`, `true`},
+	{`NOTHING`, `"NOTHING"`, `null`},
+	{`OBJECT`, `"OBJECT"`, `{"html":"\u003c/script\u003e","list":[1,"\u2028"]}`},
+}
+
+// Whatever the names and values, each variable is a single line of the
+// object literal that cannot close an inline script nor break a string
+func TestConfigFormatsLiterals(t *testing.T) {
+	vars := nastyVarsTyped()
+	if len(vars) != len(nastyLiterals) {
+		t.Fatalf("%d variables for %d literals", len(vars), len(nastyLiterals))
+	}
+
+	var js, json []string
+	for i, literal := range nastyLiterals {
+		js = append(js, "\n    "+literal.jsKey+": "+literal.value+",")
+		sep := ","
+		if i == 0 {
+			sep = ""
+		}
+		json = append(json, sep+"\n    "+literal.jsonKey+": "+literal.value)
+	}
+	tests := map[string]string{
+		"js":   "'use strict'\nwindow._env_ = { " + strings.Join(js, "") + "\n}\n",
+		"esm":  "export default { " + strings.Join(js, "") + "\n}\n",
+		"json": "{ " + strings.Join(json, "") + "\n}\n",
+	}
+	for format, want := range tests {
+		if out := renderFormat(t, format, vars); out != want {
+			t.Errorf("%s: got\n%s\nwant\n%s", format, out, want)
+		}
+	}
+}
+
+func TestConfigFormatsShape(t *testing.T) {
+	vars := []EnvVar{{Name: "A", Value: "1", Type: typeString}}
+	tests := map[string]string{
+		"js":  "'use strict'\nwindow._env_ = { \n    A: \"1\",\n}\n",
+		"esm": "export default { \n    A: \"1\",\n}\n",
+	}
+	for format, want := range tests {
+		if out := renderFormat(t, format, vars); out != want {
+			t.Errorf("%s: got %q, want %q", format, out, want)
+		}
+	}
+}
+
+func TestParseDotEnv(t *testing.T) {
+	type entry struct {
+		name  string
+		value string
+		line  int
+		quote byte
+	}
+	tests := []struct {
+		src     string
+		entries []entry
+	}{
+		{"A=b", []entry{{"A", "b", 1, 0}}},
+		{"export A=b\nexport\tB=c", []entry{{"A", "b", 1, 0}, {"B", "c", 2, 0}}},
+		{"export = b", []entry{{"export", "b", 1, 0}}},
+		{"A = b ", []entry{{"A", "b", 1, 0}}},
+		{"A=b=c", []entry{{"A", "b=c", 1, 0}}},
+		{"A=\nB=''\nC=\"\"\nD=``", []entry{{"A", "", 1, 0}, {"B", "", 2, '\''}, {"C", "", 3, '"'}, {"D", "", 4, '`'}}},
+
+		// Comments and blank lines
+		{"\n# comment\n  \n\t# indented comment\nA=b\n\n", []entry{{"A", "b", 5, 0}}},
+		{"A=b # comment\nB=b\t# comment", []entry{{"A", "b", 1, 0}, {"B", "b", 2, 0}}},
+		{"A=b#c\nB=#c", []entry{{"A", "b#c", 1, 0}, {"B", "", 2, 0}}},
+		{"A='b # c' # comment\nB=\"b # c\"# comment\nC=`b # c` #", []entry{{"A", "b # c", 1, '\''}, {"B", "b # c", 2, '"'}, {"C", "b # c", 3, '`'}}},
+
+		// Quotes
+		{`A='say "hi" \n'`, []entry{{"A", `say "hi" \n`, 1, '\''}}},
+		{`A="say \"hi\"\n\tand 'bye' \\ \$x"`, []entry{{"A", "say \"hi\"\n\tand 'bye' \\ \\$x", 1, '"'}}},
+		{"A=`it's \"quoted\" \\n`", []entry{{"A", `it's "quoted" \n`, 1, '`'}}},
+
+		// Multi-line values
+		{"A=\"first\nsecond\"\nB=c", []entry{{"A", "first\nsecond", 1, '"'}, {"B", "c", 3, 0}}},
+		{"A=\"first \\\nsecond\"\nB=c", []entry{{"A", "first second", 1, '"'}, {"B", "c", 3, 0}}},
+		{"A=`first\n'second'\n\"third\"`\nB=c", []entry{{"A", "first\n'second'\n\"third\"", 1, '`'}, {"B", "c", 4, 0}}},
+		{"A=\"first\r\nsecond\"\r\nB=c\r\n", []entry{{"A", "first\nsecond", 1, '"'}, {"B", "c", 3, 0}}},
+	}
+
+	for _, test := range tests {
+		parsed, err := parseDotEnv(".env", strings.NewReader(test.src))
+		if err != nil {
+			t.Errorf("%q: %v", test.src, err)
+			continue
+		}
+		entries := make([]entry, 0)
+		for _, e := range parsed {
+			if e.File != ".env" {
+				t.Errorf("%q: file %s", test.src, e.File)
+			}
+			entries = append(entries, entry{e.Name, e.Value, e.Line, e.Quote})
+		}
+		if !reflect.DeepEqual(entries, test.entries) {
+			t.Errorf("%q: got %q, want %q", test.src, entries, test.entries)
+		}
+	}
+}
+
+func TestParseDotEnvErrors(t *testing.T) {
+	tests := []struct {
+		src string
+		err string
+	}{
+		{"A=b\n1A=c", `.env:2: invalid variable name "1A=c"`},
+		{"A=b\nexport A", ".env:2: expected '=' after A"},
+		{"\n\nA b", ".env:3: expected '=' after A"},
+		{"=b", `.env:1: invalid variable name "=b"`},
+		{"A='b\nB=c'", ".env:1: unterminated single-quoted value"},
+		{"A=b\nB=\"c\nD=e", ".env:2: unterminated double-quoted value"},
+		{"A=b\n\nB=`c\n", ".env:3: unterminated backtick-quoted value"},
+		{`A="b" c`, ".env:1: unexpected characters after quoted value of A"},
+		{"A=\"b\nc\" d", ".env:2: unexpected characters after quoted value of A"},
+		{"A='b'c", ".env:1: unexpected characters after quoted value of A"},
+	}
+	for _, test := range tests {
+		_, err := parseDotEnv(".env", strings.NewReader(test.src))
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%q: got %v, want %s", test.src, err, test.err)
+		}
+	}
+}
+
+func TestConfigOutputs(t *testing.T) {
+	tests := []struct {
+		config  DotEnvConfig
+		outputs []configOutput
+	}{
+		{
+			DotEnvConfig{ConfigName: "env-config.js"},
+			[]configOutput{{"js", "env-config.js"}},
+		},
+		{
+			DotEnvConfig{ConfigName: "config/app-env.js", Formats: []string{"json", "js", "esm", "dts"}},
+			[]configOutput{{"json", "config/app-env.json"}, {"js", "config/app-env.js"}, {"esm", "config/app-env.mjs"}, {"dts", "config/app-env.d.ts"}},
+		},
+		{
+			DotEnvConfig{ConfigName: "env", Formats: []string{"js", "json"}},
+			[]configOutput{{"js", "env"}, {"json", "env.json"}},
+		},
+		{
+			DotEnvConfig{ConfigName: "env-config.js", Formats: []string{"js=static/settings.js", "esm=", "dts=types/env.d.ts", "json=a=b.json"}},
+			[]configOutput{{"js", "static/settings.js"}, {"esm", "env-config.mjs"}, {"dts", "types/env.d.ts"}, {"json", "a=b.json"}},
+		},
+	}
+	for _, test := range tests {
+		outputs, err := configOutputs(&test.config)
+		if err != nil || !reflect.DeepEqual(outputs, test.outputs) {
+			t.Errorf("%v: got %v %v, want %v", test.config.Formats, outputs, err, test.outputs)
+		}
+	}
+
+	_, err := configOutputs(&DotEnvConfig{ConfigName: "env-config.js", Formats: []string{"js", "yaml=env.yml"}})
+	if err == nil || err.Error() != "Unknown config format yaml (valid formats: js, json, esm, dts)" {
+		t.Errorf("got %v", err)
+	}
+}
+
+// The generated files, byte for byte
+func TestRenderDotEnvGolden(t *testing.T) {
+	vars := []EnvVar{
+		{Name: "API_URL", Value: "https://api.example.com", Type: typeString},
+		{Name: "PORT", Value: "8080", Type: typeNumber},
+		{Name: "DEBUG", Value: "true", Type: typeBoolean},
+		{Name: "LOCALES", Value: `["en", "fr"]`, Type: typeJSON},
+		{Name: "my-key", Value: "it's", Type: typeString},
+	}
+	tests := []struct {
+		name    string
+		config  DotEnvConfig
+		written map[string]string
+	}{
+		{
+			name:   "default",
+			config: DotEnvConfig{ConfigName: "env-config.js"},
+			written: map[string]string{
+				"env-config.js": `'use strict'
+window._env_ = { 
+    API_URL: "https://api.example.com",
+    PORT: 8080,
+    DEBUG: true,
+    LOCALES: ["en","fr"],
+    "my-key": "it's",
+}
+`,
+			},
+		},
+		{
+			name: "all formats",
+			config: DotEnvConfig{
+				ConfigName: "config/app-env.js",
+				Formats:    []string{"js", "json", "esm", "dts=types/env.d.ts"},
+				GlobalName: "APP_CONFIG",
+			},
+			written: map[string]string{
+				"config/app-env.js": `'use strict'
+window.APP_CONFIG = { 
+    API_URL: "https://api.example.com",
+    PORT: 8080,
+    DEBUG: true,
+    LOCALES: ["en","fr"],
+    "my-key": "it's",
+}
+`,
+				"config/app-env.json": `{ 
+    "API_URL": "https://api.example.com",
+    "PORT": 8080,
+    "DEBUG": true,
+    "LOCALES": ["en","fr"],
+    "my-key": "it's"
+}
+`,
+				"config/app-env.mjs": `export default { 
+    API_URL: "https://api.example.com",
+    PORT: 8080,
+    DEBUG: true,
+    LOCALES: ["en","fr"],
+    "my-key": "it's",
+}
+`,
+				"types/env.d.ts": `export interface Env { 
+    readonly API_URL: string;
+    readonly PORT: number;
+    readonly DEBUG: boolean;
+    readonly LOCALES: any;
+    readonly "my-key": string;
+}
+
+declare global {
+    interface Window {
+        APP_CONFIG: Env;
+    }
+}
+
+declare const env: Env;
+export default env;
+`,
+			},
+		},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "go-deploy-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		if err := renderDotEnv(vars, "", dir, &test.config); err != nil {
+			t.Fatalf("%s: %v", test.name, err)
+		}
+		names := make([]string, 0)
+		for name := range test.written {
+			names = append(names, name)
+		}
+		sort.Strings(names)
+		if written := listFiles(t, dir); !reflect.DeepEqual(written, names) {
+			t.Errorf("%s: wrote %v, want %v", test.name, written, names)
+		}
+		for name, want := range test.written {
+			content, err := ioutil.ReadFile(filepath.Join(dir, name))
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+				continue
+			}
+			if string(content) != want {
+				t.Errorf("%s: %s is\n%s\nwant\n%s", test.name, name, content, want)
+			}
+		}
+	}
+}
+
+func TestConfigGlobalName(t *testing.T) {
+	tests := map[string]string{"": "_env_", "APP_CONFIG": "APP_CONFIG", "$env": "$env"}
+	for name, want := range tests {
+		if global, err := configGlobalName(&DotEnvConfig{GlobalName: name}); err != nil || global != want {
+			t.Errorf("%q: got %s %v, want %s", name, global, err, want)
+		}
+	}
+	for _, name := range []string{"app-config", "1env", "window.env"} {
+		if _, err := configGlobalName(&DotEnvConfig{GlobalName: name}); err == nil || err.Error() != "Invalid global variable name: "+name {
+			t.Errorf("%q: got %v", name, err)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+)
+
+// A difference between the resolved and the deployed config
+type ConfigChange struct {
+	Name     string
+	Deployed *string // nil when the variable is not deployed yet
+	Resolved *string // nil when the variable has been removed
+}
+
+var (
+	bareKeyRe       = regexp.MustCompile(`(?m)^(\s*)([A-Za-z_$][A-Za-z0-9_$]*)\s*:`)
+	computedKeyRe   = regexp.MustCompile(`(?m)^(\s*)\[("[^"]*")\]\s*:`)
+	trailingCommaRe = regexp.MustCompile(`,(\s*)}$`)
+)
+
+// DiffConfig compares the resolved variables with the config currently
+// deployed on target, a directory or a s3://bucket/prefix URI. The values
+// are compared as JSON literals so that typed values are handled. A js config
+// written by the template of srcDir is compared with the object literal the
+// template renders for the resolved variables.
+func DiffConfig(s3config *Config, target string, srcDir string, vars []EnvVar, config *DotEnvConfig) ([]ConfigChange, error) {
+	outputs, err := configOutputs(config)
+	if err != nil {
+		return nil, err
+	}
+
+	// Prefer the JSON config which doesn't need any parsing
+	output := outputs[0]
+	for _, o := range outputs {
+		if o.Format == "json" {
+			output = o
+		}
+	}
+	if output.Format != "json" && output.Format != "js" && output.Format != "esm" {
+		return nil, fmt.Errorf("Unable to compare the %s config format", output.Format)
+	}
+
+	hashed := config.HashConfig && isHashedFormat(output.Format)
+	content, filename, err := readDeployedFile(s3config, target, output.Filename, hashed)
+	if err != nil {
+		return nil, err
+	}
+	deployed, err := parseDeployedConfig(content, output.Format)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the deployed %s: %v", filename, err)
+	}
+
+	resolved := make(map[string]string)
+	if output.Format == "js" && config.Template != "" {
+		values, err := renderedConfig(vars, srcDir, config)
+		if err != nil {
+			return nil, fmt.Errorf("Unable to compare the config written by the template %s, add the json format: %v", config.Template, err)
+		}
+		for name, value := range values {
+			resolved[name] = canonicalJSON(value)
+		}
+	} else {
+		for _, v := range vars {
+			resolved[v.Name] = canonicalJSON(json.RawMessage(jsValue(v)))
+		}
+	}
+
+	names := make([]string, 0, len(resolved)+len(deployed))
+	for name := range resolved {
+		names = append(names, name)
+	}
+	for name := range deployed {
+		if _, found := resolved[name]; !found {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	changes := make([]ConfigChange, 0)
+	for _, name := range names {
+		r, inResolved := resolved[name]
+		d, inDeployed := deployed[name]
+		change := ConfigChange{Name: name}
+		if inResolved {
+			change.Resolved = &r
+		}
+		dc := canonicalJSON(d)
+		if inDeployed {
+			change.Deployed = &dc
+		}
+		if !inResolved || !inDeployed || r != dc {
+			changes = append(changes, change)
+		}
+	}
+	return changes, nil
+}
+
+// Variables of the js config rendered by the user template, it must write
+// an object literal like the js format
+func renderedConfig(vars []EnvVar, srcDir string, config *DotEnvConfig) (map[string]interface{}, error) {
+	t, err := configTemplate("js", vars, srcDir, config)
+	if err != nil {
+		return nil, err
+	}
+	var content bytes.Buffer
+	if err := t.Execute(&content, vars); err != nil {
+		return nil, err
+	}
+	return parseDeployedConfig(content.String(), "js")
+}
+
+// Read the config deployed on target, the name of a hashed config is found
+// by listing the directory it is deployed to
+func readDeployedFile(config *Config, target string, filename string, hashed bool) (string, string, error) {
+	uri, err := FileURINew(target)
+	if err != nil {
+		return "", "", err
+	}
+	backend, err := newBackend(config, uri.Scheme)
+	if err != nil {
+		return "", "", err
+	}
+
+	file := uri.SetPath(path.Join(uri.Path, filename))
+	if hashed {
+		file, err = findHashedFile(backend, file)
+		if err != nil {
+			return "", "", err
+		}
+	}
+
+	r, err := backend.Get(file)
+	if err != nil {
+		return "", "", fmt.Errorf("Unable to read %s: %v", file.String(), err)
+	}
+	defer r.Close()
+
+	content, err := ioutil.ReadAll(r)
+	return string(content), path.Base(file.Path), err
+}
+
+// Find the hashed variant of file, there must be exactly one
+func findHashedFile(backend Backend, file *FileURI) (*FileURI, error) {
+	dir := path.Dir(file.Path)
+	glob := hashedGlob(path.Base(file.Path))
+
+	files, err := backend.List(file.SetPath(dir))
+	if err != nil {
+		return nil, fmt.Errorf("Unable to list %s: %v", file.SetPath(dir).String(), err)
+	}
+
+	found := make([]string, 0)
+	for _, f := range files {
+		name := filepath.ToSlash(f.Name)
+		if ok, _ := path.Match(glob, path.Base(name)); ok && path.Clean("/"+path.Dir(name)) == path.Clean("/"+dir) {
+			found = append(found, path.Base(name))
+		}
+	}
+	sort.Strings(found)
+
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("No hashed config %s found in %s", glob, file.SetPath(dir).String())
+	case 1:
+		return file.SetPath(path.Join(dir, found[0])), nil
+	}
+	return nil, fmt.Errorf("Several hashed configs found in %s (%s), unable to tell which one is deployed", file.SetPath(dir).String(), strings.Join(found, ", "))
+}
+
+// Extract the variables of a generated config. Scripts are turned into JSON
+// by quoting the keys of the object literal and dropping its trailing comma.
+func parseDeployedConfig(content string, format string) (map[string]interface{}, error) {
+	if format != "json" {
+		start := strings.Index(content, "{")
+		end := strings.LastIndex(content, "}")
+		if start < 0 || end < start {
+			return nil, fmt.Errorf("no object literal found")
+		}
+		content = content[start : end+1]
+		content = bareKeyRe.ReplaceAllString(content, `$1"$2":`)
+		content = computedKeyRe.ReplaceAllString(content, `$1$2:`)
+		content = trailingCommaRe.ReplaceAllString(content, `$1}`)
+	}
+
+	values := make(map[string]interface{})
+	if err := json.Unmarshal([]byte(content), &values); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
+
+func canonicalJSON(value interface{}) string {
+	if raw, ok := value.(json.RawMessage); ok {
+		var decoded interface{}
+		if err := json.Unmarshal(raw, &decoded); err != nil {
+			return string(raw)
+		}
+		value = decoded
+	}
+	b, err := json.Marshal(value)
+	if err != nil {
+		return fmt.Sprint(value)
+	}
+	return string(b)
+}
@@ -0,0 +1,169 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// The config deployed with --hash-config is found under its hashed name
+func TestDiffConfigHashed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	config := &DotEnvConfig{ConfigName: "env-config.js", HashConfig: true}
+	deployed := []EnvVar{
+		{Name: "API_URL", Value: "https://api.example.com", Type: typeString},
+		{Name: "THEME", Value: "dark", Type: typeString},
+	}
+	if err := renderDotEnv(deployed, "", dir, config); err != nil {
+		t.Fatal(err)
+	}
+	// Neither the unhashed name nor a nested directory are looked at
+	writeFiles(t, dir, map[string]string{
+		"env-config.js":                "window._env_ = { API_URL: \"stale\" }",
+		"old/env-config.0123456789.js": "window._env_ = { API_URL: \"old\" }",
+		"env-config.0123456789.js.map": "{}",
+	})
+
+	resolved := []EnvVar{
+		{Name: "API_URL", Value: "https://api.example.com", Type: typeString},
+		{Name: "THEME", Value: "light", Type: typeString},
+	}
+	changes, err := DiffConfig(&Config{}, dir, "", resolved, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Name != "THEME" || *changes[0].Deployed != `"dark"` || *changes[0].Resolved != `"light"` {
+		t.Errorf("got %+v, want THEME changed from dark to light", changes)
+	}
+
+	// The previous hashed config is still there
+	writeFiles(t, dir, map[string]string{"env-config.abcdef0123.js": "window._env_ = {}"})
+	if _, err := DiffConfig(&Config{}, dir, "", resolved, config); err == nil || !strings.Contains(err.Error(), "Several hashed configs") {
+		t.Errorf("got %v, want an error listing the hashed configs", err)
+	}
+}
+
+func TestDiffConfigHashedNotDeployed(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	writeFiles(t, dir, map[string]string{"env-config.js": "window._env_ = {}"})
+	config := &DotEnvConfig{ConfigName: "env-config.js", HashConfig: true}
+	_, err = DiffConfig(&Config{}, dir, "", nil, config)
+	if err == nil || !strings.Contains(err.Error(), "No hashed config env-config.[0-9a-f]") {
+		t.Errorf("got %v, want a missing hashed config error", err)
+	}
+
+	// The json config is never hashed
+	config.Formats = []string{"js", "json"}
+	if err := renderDotEnv(nil, "", dir, &DotEnvConfig{ConfigName: "env-config.js", Formats: []string{"json"}}); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := os.Stat(filepath.Join(dir, "env-config.json")); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := DiffConfig(&Config{}, dir, "", nil, config); err != nil || len(changes) != 0 {
+		t.Errorf("got %v %v, want no change", changes, err)
+	}
+}
+
+// The variables read back from the generated configs, computed keys included
+func TestParseDeployedConfig(t *testing.T) {
+	vars := []EnvVar{
+		{Name: "API_URL", Value: "https://api.example.com", Type: typeString},
+		{Name: "my-key", Value: "dash", Type: typeString},
+		{Name: "__proto__", Value: "proto", Type: typeString},
+		{Name: "COUNT", Value: "42", Type: typeNumber},
+	}
+	for _, format := range []string{"js", "esm", "json"} {
+		values, err := parseDeployedConfig(renderFormat(t, format, vars), format)
+		if err != nil {
+			t.Errorf("%s: %v", format, err)
+			continue
+		}
+		if len(values) != 4 || values["__proto__"] != "proto" || values["my-key"] != "dash" || values["COUNT"] != float64(42) {
+			t.Errorf("%s: got %v", format, values)
+		}
+	}
+}
+
+// The config written by a template is compared with what the template
+// renders for the resolved variables, under the keys of the template
+func TestDiffConfigTemplate(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	target := filepath.Join(srcDir, "deployed")
+	writeFiles(t, srcDir, map[string]string{
+		"env.tmpl":    "window.{{ global }} = {\n  apiUrl: {{ json (env \"API_URL\") }},\n  theme: {{ json (env \"THEME\") }},\n};\n",
+		"broken.tmpl": "window.apiUrl = {{ json (env \"API_URL\") }};\n",
+	})
+
+	config := &DotEnvConfig{ConfigName: "env-config.js", Template: "env.tmpl"}
+	deployed := []EnvVar{
+		{Name: "API_URL", Value: "https://old.example.com", Type: typeString},
+		{Name: "THEME", Value: "dark", Type: typeString},
+	}
+	if err := renderDotEnv(deployed, srcDir, target, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if changes, err := DiffConfig(&Config{}, target, srcDir, deployed, config); err != nil || len(changes) != 0 {
+		t.Errorf("got %v %v, want no change", changes, err)
+	}
+
+	resolved := []EnvVar{
+		{Name: "API_URL", Value: "https://api.example.com", Type: typeString},
+		{Name: "THEME", Value: "dark", Type: typeString},
+		{Name: "UNUSED", Value: "not in the template", Type: typeString},
+	}
+	changes, err := DiffConfig(&Config{}, target, srcDir, resolved, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(changes) != 1 || changes[0].Name != "apiUrl" || *changes[0].Deployed != `"https://old.example.com"` || *changes[0].Resolved != `"https://api.example.com"` {
+		t.Errorf("got %+v", changes)
+	}
+
+	config.Template = "broken.tmpl"
+	_, err = DiffConfig(&Config{}, target, srcDir, resolved, config)
+	if want := "Unable to compare the config written by the template broken.tmpl, add the json format: no object literal found"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+
+	// The json config doesn't depend on the template
+	config.Formats = []string{"js", "json"}
+	if err := renderDotEnv(resolved, srcDir, target, config); err != nil {
+		t.Fatal(err)
+	}
+	if changes, err := DiffConfig(&Config{}, target, srcDir, resolved, config); err != nil || len(changes) != 0 {
+		t.Errorf("json: got %v %v, want no change", changes, err)
+	}
+}
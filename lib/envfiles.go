@@ -0,0 +1,92 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+// Suffix of the variables naming the file holding the value of another one
+const fileEnvSuffix = "_FILE"
+
+// Look a variable up in the environment. Following the Docker and
+// Kubernetes convention, when NAME is not set but NAME_FILE is, the value is
+// read from that file. Setting both is an error. The source is either the
+// environment or the file.
+func lookupEnv(name string) (value string, source string, exists bool, err error) {
+	value, exists = os.LookupEnv(name)
+	file, fileExists := os.LookupEnv(name + fileEnvSuffix)
+	if exists && fileExists {
+		return "", "", false, fmt.Errorf("Both %s and %s%s are set, only one of them can be", name, name, fileEnvSuffix)
+	}
+	if exists {
+		return value, sourceEnvironment, true, nil
+	}
+	if !fileExists {
+		return "", "", false, nil
+	}
+	value, err = readValueFile(file)
+	if err != nil {
+		return "", "", false, fmt.Errorf("%s%s: %v", name, fileEnvSuffix, err)
+	}
+	return value, file, true, nil
+}
+
+// Read a value from a file, without its trailing newline
+func readValueFile(file string) (string, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(content), "\r\n"), nil
+}
+
+// Read a directory where each file holds the value of the variable it is
+// named after, like a mounted ConfigMap or Secret. Hidden files, such as the
+// ..data links created by Kubernetes, and subdirectories are ignored. The
+// values are taken literally.
+func readEnvDir(dir string) ([]dotEnvEntry, error) {
+	files, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return nil, err
+	}
+
+	entries := make([]dotEnvEntry, 0, len(files))
+	for _, file := range files {
+		name := file.Name()
+		if strings.HasPrefix(name, ".") || !isValidEnvName(name) {
+			continue
+		}
+
+		path := filepath.Join(dir, name)
+		// Kubernetes mounts each key as a symbolic link, follow it
+		info, err := os.Stat(path)
+		if err != nil || info.IsDir() {
+			continue
+		}
+
+		value, err := readValueFile(path)
+		if err != nil {
+			return nil, err
+		}
+		entries = append(entries, dotEnvEntry{Name: name, Value: value, File: path, Quote: '\''})
+	}
+	return entries, nil
+}
@@ -0,0 +1,219 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// Set variables of the environment until the returned function is called
+func setTestEnv(env map[string]string) func() {
+	for name, value := range env {
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name := range env {
+			os.Unsetenv(name)
+		}
+	}
+}
+
+func TestLookupEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"api_url":   "https://api.example.com\n",
+		"crlf":      "secret\r\n",
+		"multiline": "line1\nline2\n\n",
+		"empty":     "",
+	})
+
+	tests := []struct {
+		name   string
+		env    map[string]string
+		value  string
+		source string
+		exists bool
+		err    string
+	}{
+		{name: "unset"},
+		{
+			name:   "environment",
+			env:    map[string]string{"GO_DEPLOY_TEST_VAR": "value"},
+			value:  "value",
+			source: sourceEnvironment,
+			exists: true,
+		},
+		{
+			name:   "empty",
+			env:    map[string]string{"GO_DEPLOY_TEST_VAR": ""},
+			source: sourceEnvironment,
+			exists: true,
+		},
+		{
+			name:   "file",
+			env:    map[string]string{"GO_DEPLOY_TEST_VAR_FILE": filepath.Join(dir, "api_url")},
+			value:  "https://api.example.com",
+			source: filepath.Join(dir, "api_url"),
+			exists: true,
+		},
+		{
+			name:   "crlf",
+			env:    map[string]string{"GO_DEPLOY_TEST_VAR_FILE": filepath.Join(dir, "crlf")},
+			value:  "secret",
+			source: filepath.Join(dir, "crlf"),
+			exists: true,
+		},
+		{
+			name:   "multi-line",
+			env:    map[string]string{"GO_DEPLOY_TEST_VAR_FILE": filepath.Join(dir, "multiline")},
+			value:  "line1\nline2",
+			source: filepath.Join(dir, "multiline"),
+			exists: true,
+		},
+		{
+			name:   "empty file",
+			env:    map[string]string{"GO_DEPLOY_TEST_VAR_FILE": filepath.Join(dir, "empty")},
+			source: filepath.Join(dir, "empty"),
+			exists: true,
+		},
+		{
+			name: "missing file",
+			env:  map[string]string{"GO_DEPLOY_TEST_VAR_FILE": filepath.Join(dir, "missing")},
+			err:  "GO_DEPLOY_TEST_VAR_FILE: open " + filepath.Join(dir, "missing") + ": no such file or directory",
+		},
+		{
+			name: "both",
+			env: map[string]string{
+				"GO_DEPLOY_TEST_VAR":      "value",
+				"GO_DEPLOY_TEST_VAR_FILE": filepath.Join(dir, "api_url"),
+			},
+			err: "Both GO_DEPLOY_TEST_VAR and GO_DEPLOY_TEST_VAR_FILE are set, only one of them can be",
+		},
+	}
+
+	for _, test := range tests {
+		restore := setTestEnv(test.env)
+		value, source, exists, err := lookupEnv("GO_DEPLOY_TEST_VAR")
+		restore()
+
+		if test.err != "" {
+			if err == nil || err.Error() != test.err {
+				t.Errorf("%s: got %v, want %s", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil || value != test.value || source != test.source || exists != test.exists {
+			t.Errorf("%s: got %q %q %v %v, want %q %q %v", test.name, value, source, exists, err, test.value, test.source, test.exists)
+		}
+	}
+}
+
+// A Secret mounted by Kubernetes: each key is a link to ..data/<key>, ..data
+// being a link to the timestamped directory holding the files
+func writeMountedSecret(t *testing.T, dir string, files map[string]string) {
+	writeFiles(t, filepath.Join(dir, "..2019_10_17_10_00_00.123"), files)
+	if err := os.Symlink("..2019_10_17_10_00_00.123", filepath.Join(dir, "..data")); err != nil {
+		t.Fatal(err)
+	}
+	for name := range files {
+		if err := os.Symlink(filepath.Join("..data", name), filepath.Join(dir, name)); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestReadEnvDir(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeMountedSecret(t, dir, map[string]string{
+		"API_KEY": "s3cr3t\n",
+		"THEME":   "dark",
+	})
+	writeFiles(t, dir, map[string]string{
+		"QUOTED":       `"not unquoted" # nor a comment`,
+		".hidden":      "hidden",
+		"9LIVES":       "not a variable name",
+		"nested/LEVEL": "in a subdirectory",
+	})
+
+	entries, err := readEnvDir(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []dotEnvEntry{
+		{Name: "API_KEY", Value: "s3cr3t", File: filepath.Join(dir, "API_KEY"), Quote: '\''},
+		{Name: "QUOTED", Value: `"not unquoted" # nor a comment`, File: filepath.Join(dir, "QUOTED"), Quote: '\''},
+		{Name: "THEME", Value: "dark", File: filepath.Join(dir, "THEME"), Quote: '\''},
+	}
+	if !reflect.DeepEqual(entries, want) {
+		t.Errorf("got %+v, want %+v", entries, want)
+	}
+
+	if _, err := readEnvDir(filepath.Join(dir, "missing")); err == nil {
+		t.Errorf("expected an error for a missing directory")
+	}
+}
+
+// The environment, then the mounted directory, then the .env layers
+func TestGetVarsEnvDir(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	envDir := filepath.Join(srcDir, "mounted")
+	writeFiles(t, srcDir, map[string]string{
+		".env":       "GO_DEPLOY_TEST_URL=base\nGO_DEPLOY_TEST_THEME=dark\nGO_DEPLOY_TEST_LEVEL=info\nGO_DEPLOY_TEST_TITLE=${GO_DEPLOY_TEST_THEME} site\n",
+		".env.local": "GO_DEPLOY_TEST_THEME=local\nGO_DEPLOY_TEST_LEVEL=local\n",
+	})
+	writeMountedSecret(t, envDir, map[string]string{
+		"GO_DEPLOY_TEST_THEME": "mounted\n",
+		"GO_DEPLOY_TEST_LEVEL": "mounted",
+		"GO_DEPLOY_TEST_NEW":   "${NOT_INTERPOLATED}",
+	})
+	restore := setTestEnv(map[string]string{"GO_DEPLOY_TEST_LEVEL": "env"})
+	defer restore()
+
+	err, vars := GetVars(srcDir, &DotEnvConfig{ConfigName: "env-config.js", EnvDir: envDir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	got := make([]EnvVar, 0)
+	for _, v := range vars {
+		got = append(got, EnvVar{Name: v.Name, Value: v.Value, Source: v.Source})
+	}
+	want := []EnvVar{
+		{Name: "GO_DEPLOY_TEST_URL", Value: "base", Source: ".env"},
+		{Name: "GO_DEPLOY_TEST_THEME", Value: "mounted", Source: filepath.Join(envDir, "GO_DEPLOY_TEST_THEME")},
+		{Name: "GO_DEPLOY_TEST_LEVEL", Value: "env", Source: sourceEnvironment},
+		{Name: "GO_DEPLOY_TEST_TITLE", Value: "mounted site", Source: ".env"},
+		{Name: "GO_DEPLOY_TEST_NEW", Value: "${NOT_INTERPOLATED}", Source: filepath.Join(envDir, "GO_DEPLOY_TEST_NEW")},
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
@@ -21,12 +21,14 @@ import (
   "net/url"
   "path"
   "path/filepath"
+  "strings"
 )
 
 type FileURI struct {
   Scheme string
   Bucket string
   Path   string
+  User   *url.Userinfo // login of the sftp:// URIs
 }
 
 func FileURINew(path string) (*FileURI, error) {
@@ -34,23 +36,25 @@ func FileURINew(path string) (*FileURI, error) {
   if err != nil {
     return nil, err
   }
-  if u.Scheme != "" && u.Scheme != "s3" && u.Scheme != "file" {
-    return nil, fmt.Errorf("Invalid URI scheme must be one of file/s3/NONE")
+  if _, found := backendFactories[u.Scheme]; u.Scheme != "" && !found {
+    return nil, fmt.Errorf("Invalid URI scheme must be one of %s/NONE", strings.Join(BackendSchemes(), "/"))
   }
 
   uri := FileURI{
     Scheme: u.Scheme,
     Bucket: u.Host,
     Path:   u.Path,
+    User:   u.User,
   }
 
   if uri.Scheme == "" {
     uri.Scheme = "file"
   }
-  if uri.Scheme == "s3" && uri.Path != "" {
+  // The keys of the buckets are not absolute
+  if uri.Scheme != "file" && uri.Path != "" {
     uri.Path = uri.Path[1:]
   }
-  if uri.Path == "" && uri.Scheme == "s3" {
+  if uri.Path == "" && uri.Scheme != "file" {
     uri.Path = "/"
   }
 
@@ -68,8 +72,12 @@ func (uri *FileURI) Key() *string {
 
 // Return a string version of the path
 func (uri *FileURI) String() string {
-  if uri.Scheme == "s3" {
-    return fmt.Sprintf("s3://%s/%s", uri.Bucket, *uri.Key())
+  if uri.Scheme != "file" {
+    // The password is never displayed
+    if uri.User != nil {
+      return fmt.Sprintf("%s://%s@%s/%s", uri.Scheme, uri.User.Username(), uri.Bucket, *uri.Key())
+    }
+    return fmt.Sprintf("%s://%s/%s", uri.Scheme, uri.Bucket, *uri.Key())
   } else {
     return fmt.Sprintf("file://%s", uri.Path)
   }
@@ -80,6 +88,7 @@ func (uri *FileURI) Join(elem string) *FileURI {
   nuri := FileURI{
     Scheme: uri.Scheme,
     Bucket: uri.Bucket,
+    User:   uri.User,
   }
 
   if elem == "" {
@@ -102,6 +111,7 @@ func (uri *FileURI) SetPath(elem string) *FileURI {
     Scheme: uri.Scheme,
     Bucket: uri.Bucket,
     Path:   elem,
+    User:   uri.User,
   }
   if uri.Path == "" && uri.Scheme == "s3" {
     uri.Path = "/"
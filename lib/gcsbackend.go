@@ -0,0 +1,351 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"context"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"hash"
+	"hash/crc32"
+	"io"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/textproto"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+
+	"golang.org/x/oauth2"
+	"golang.org/x/oauth2/google"
+)
+
+const (
+	defaultGCSEndpoint = "https://storage.googleapis.com"
+	gcsScope           = "https://www.googleapis.com/auth/devstorage.read_write"
+	// Prefix of the checksums of the objects without MD5, like composite objects
+	crc32cPrefix = "crc32c:"
+)
+
+func init() {
+	RegisterBackend("gs", newGCSBackend)
+}
+
+// Google Cloud Storage buckets, through the JSON API
+type gcsBackend struct {
+	config   *Config
+	endpoint string
+	client   *http.Client
+}
+
+// An object of the JSON API
+type gcsObject struct {
+	Name    string `json:"name"`
+	Size    string `json:"size"`
+	MD5Hash string `json:"md5Hash"`
+	CRC32C  string `json:"crc32c"`
+}
+
+// The endpoint defaults to STORAGE_EMULATOR_HOST, like the Google client
+// libraries. A custom endpoint, usually an emulator, does not require
+// credentials.
+func newGCSBackend(config *Config) (Backend, error) {
+	endpoint := config.GCSEndpoint
+	if endpoint == "" {
+		endpoint = os.Getenv("STORAGE_EMULATOR_HOST")
+	}
+	if endpoint != "" && !strings.HasPrefix(endpoint, "http") {
+		endpoint = "http://" + endpoint
+	}
+
+	ctx := context.Background()
+	var creds *google.Credentials
+	var err error
+	if config.GCSCredentials != "" {
+		var data []byte
+		data, err = ioutil.ReadFile(config.GCSCredentials)
+		if err == nil {
+			creds, err = google.CredentialsFromJSON(ctx, data, gcsScope)
+		}
+	} else {
+		creds, err = google.FindDefaultCredentials(ctx, gcsScope)
+	}
+
+	b := &gcsBackend{config: config, endpoint: strings.TrimSuffix(endpoint, "/")}
+	switch {
+	case err == nil:
+		b.client = oauth2.NewClient(ctx, creds.TokenSource)
+	case endpoint != "" && config.GCSCredentials == "":
+		b.client = http.DefaultClient
+	default:
+		return nil, fmt.Errorf("Unable to find Google Cloud credentials: %v", err)
+	}
+	if b.endpoint == "" {
+		b.endpoint = defaultGCSEndpoint
+	}
+	return b, nil
+}
+
+func (b *gcsBackend) objectURL(bucket, name string) string {
+	return fmt.Sprintf("%s/storage/v1/b/%s/o/%s", b.endpoint, url.PathEscape(bucket), url.PathEscape(name))
+}
+
+// Send a request to the API, the errors being reported with their message
+func (b *gcsBackend) do(method, u string, body io.Reader, contentType string) (*http.Response, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return nil, err
+	}
+	if contentType != "" {
+		req.Header.Set("Content-Type", contentType)
+	}
+
+	resp, err := b.client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	if resp.StatusCode >= 300 {
+		defer resp.Body.Close()
+		var apiError struct {
+			Error struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		}
+		message := resp.Status
+		data, _ := ioutil.ReadAll(resp.Body)
+		if json.Unmarshal(data, &apiError) == nil && apiError.Error.Message != "" {
+			message = apiError.Error.Message
+		}
+		return resp, &gcsError{status: resp.StatusCode, message: fmt.Sprintf("%s %s: %s", method, u, message)}
+	}
+	return resp, nil
+}
+
+type gcsError struct {
+	status  int
+	message string
+}
+
+func (e *gcsError) Error() string {
+	return e.message
+}
+
+func isGCSNotFound(err error) bool {
+	e, ok := err.(*gcsError)
+	return ok && e.status == http.StatusNotFound
+}
+
+func (b *gcsBackend) List(uri *FileURI) ([]FileObject, error) {
+	prefix := ""
+	if uri.Path != "" && uri.Path != "/" {
+		prefix = *uri.Key()
+	}
+	// Only keep the objects "in the directory" of the prefix, see s3Backend.List
+	slen := len(prefix) - 1
+	if slen > 0 && prefix[slen] != '/' {
+		slen += 1
+	}
+
+	result := make([]FileObject, 0)
+	pageToken := ""
+	for {
+		query := url.Values{}
+		query.Set("prefix", prefix)
+		query.Set("fields", "items(name,size,md5Hash,crc32c),nextPageToken")
+		if pageToken != "" {
+			query.Set("pageToken", pageToken)
+		}
+
+		resp, err := b.do("GET", fmt.Sprintf("%s/storage/v1/b/%s/o?%s", b.endpoint, url.PathEscape(uri.Bucket), query.Encode()), nil, "")
+		if err != nil {
+			return nil, err
+		}
+		var page struct {
+			Items         []gcsObject `json:"items"`
+			NextPageToken string      `json:"nextPageToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&page)
+		resp.Body.Close()
+		if err != nil {
+			return nil, err
+		}
+
+		for _, obj := range page.Items {
+			if slen > 0 && len(obj.Name) > slen && obj.Name[slen] != '/' {
+				continue
+			}
+			result = append(result, obj.fileObject())
+		}
+
+		if page.NextPageToken == "" {
+			return result, nil
+		}
+		pageToken = page.NextPageToken
+	}
+}
+
+// The checksum is the hex MD5 like the S3 ETags, or the CRC32C for the
+// objects without MD5
+func (obj gcsObject) fileObject() FileObject {
+	size, _ := strconv.ParseInt(obj.Size, 10, 64)
+	file := FileObject{Name: obj.Name, Size: size}
+	if sum, err := base64.StdEncoding.DecodeString(obj.MD5Hash); err == nil && len(sum) > 0 {
+		file.Checksum = hex.EncodeToString(sum)
+	} else if sum, err := base64.StdEncoding.DecodeString(obj.CRC32C); err == nil && len(sum) > 0 {
+		file.Checksum = crc32cPrefix + hex.EncodeToString(sum)
+	}
+	return file
+}
+
+func (b *gcsBackend) Stat(uri *FileURI) (*FileObject, error) {
+	resp, err := b.do("GET", b.objectURL(uri.Bucket, *uri.Key()), nil, "")
+	if isGCSNotFound(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var obj gcsObject
+	if err := json.NewDecoder(resp.Body).Decode(&obj); err != nil {
+		return nil, err
+	}
+	file := obj.fileObject()
+	return &file, nil
+}
+
+// Upload the metadata and the content in a single multipart request
+func (b *gcsBackend) Put(uri *FileURI, r io.Reader, size int64) error {
+	name := strings.TrimPrefix(uri.Path, "/")
+	metadata := map[string]string{"name": name}
+	metadata["contentType"] = mime.TypeByExtension(filepath.Ext(name))
+	if metadata["contentType"] == "" {
+		metadata["contentType"] = "application/octet-stream"
+	}
+	if cacheControl := cacheControlFor(b.config, name); cacheControl != "" {
+		metadata["cacheControl"] = cacheControl
+	}
+
+	pr, pw := io.Pipe()
+	writer := multipart.NewWriter(pw)
+	go func() {
+		pw.CloseWithError(writeMultipartUpload(writer, metadata, r))
+	}()
+
+	u := fmt.Sprintf("%s/upload/storage/v1/b/%s/o?uploadType=multipart", b.endpoint, url.PathEscape(uri.Bucket))
+	resp, err := b.do("POST", u, pr, "multipart/related; boundary="+writer.Boundary())
+	pr.Close()
+	if err != nil {
+		return err
+	}
+	return resp.Body.Close()
+}
+
+func writeMultipartUpload(writer *multipart.Writer, metadata map[string]string, r io.Reader) error {
+	part, err := writer.CreatePart(textproto.MIMEHeader{"Content-Type": {"application/json; charset=UTF-8"}})
+	if err != nil {
+		return err
+	}
+	if err := json.NewEncoder(part).Encode(metadata); err != nil {
+		return err
+	}
+
+	part, err = writer.CreatePart(textproto.MIMEHeader{"Content-Type": {metadata["contentType"]}})
+	if err != nil {
+		return err
+	}
+	if _, err := io.Copy(part, r); err != nil {
+		return err
+	}
+	return writer.Close()
+}
+
+func (b *gcsBackend) Get(uri *FileURI) (io.ReadCloser, error) {
+	resp, err := b.do("GET", b.objectURL(uri.Bucket, *uri.Key())+"?alt=media", nil, "")
+	if err != nil {
+		return nil, err
+	}
+	return resp.Body, nil
+}
+
+// The JSON API has no batch delete outside of batch requests, the objects
+// are removed one by one
+func (b *gcsBackend) Delete(uris []*FileURI) error {
+	for _, uri := range uris {
+		resp, err := b.do("DELETE", b.objectURL(uri.Bucket, *uri.Key()), nil, "")
+		if isGCSNotFound(err) {
+			continue
+		}
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+	}
+	return nil
+}
+
+// Rewrite the object, large objects taking several calls
+func (b *gcsBackend) Copy(src, dst *FileURI) error {
+	u := fmt.Sprintf("%s/rewriteTo/b/%s/o/%s", b.objectURL(src.Bucket, *src.Key()),
+		url.PathEscape(dst.Bucket), url.PathEscape(*cleanBucketDestPath(src.Path, dst.Path)))
+
+	token := ""
+	for {
+		call := u
+		if token != "" {
+			call += "?rewriteToken=" + url.QueryEscape(token)
+		}
+		resp, err := b.do("POST", call, nil, "")
+		if err != nil {
+			return err
+		}
+		var result struct {
+			Done         bool   `json:"done"`
+			RewriteToken string `json:"rewriteToken"`
+		}
+		err = json.NewDecoder(resp.Body).Decode(&result)
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+		if result.Done || result.RewriteToken == "" {
+			return nil
+		}
+		token = result.RewriteToken
+	}
+}
+
+// Checksum computes the checksum of a content the way List reports it
+func (b *gcsBackend) Checksum(r io.Reader, size int64, like string) (string, error) {
+	var h hash.Hash = md5.New()
+	prefix := ""
+	if strings.HasPrefix(like, crc32cPrefix) {
+		h = crc32.New(crc32.MakeTable(crc32.Castagnoli))
+		prefix = crc32cPrefix
+	}
+	if _, err := io.Copy(h, r); err != nil {
+		return "", err
+	}
+	return prefix + hex.EncodeToString(h.Sum(nil)), nil
+}
@@ -0,0 +1,315 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"crypto/md5"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"mime"
+	"mime/multipart"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+type fakeGCSObject struct {
+	content      []byte
+	contentType  string
+	cacheControl string
+}
+
+// A stand-in of the JSON API of Cloud Storage, listing two objects by page
+type fakeGCS struct {
+	t        *testing.T
+	mutex    sync.Mutex
+	objects  map[string]*fakeGCSObject // by bucket/name
+	rewrites int
+}
+
+func (s *fakeGCS) error(w http.ResponseWriter, status int, message string) {
+	w.WriteHeader(status)
+	fmt.Fprintf(w, `{"error":{"code":%d,"message":%q}}`, status, message)
+}
+
+func (s *fakeGCS) metadata(name string, obj *fakeGCSObject) map[string]string {
+	sum := md5.Sum(obj.content)
+	return map[string]string{
+		"name":    name,
+		"size":    fmt.Sprint(len(obj.content)),
+		"md5Hash": base64.StdEncoding.EncodeToString(sum[:]),
+	}
+}
+
+func (s *fakeGCS) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	// The object names are escaped, a/b being a%2Fb
+	parts := strings.Split(strings.TrimPrefix(r.URL.EscapedPath(), "/"), "/")
+	for i := range parts {
+		parts[i], _ = url.PathUnescape(parts[i])
+	}
+	if len(parts) < 5 || parts[3] == "forbidden" {
+		s.error(w, http.StatusForbidden, "Access denied.")
+		return
+	}
+
+	switch {
+	case r.Method == "GET" && len(parts) == 5 && parts[0] == "storage":
+		s.list(w, r, parts[3])
+	case r.Method == "POST" && parts[0] == "upload":
+		s.upload(w, r, parts[4])
+	case r.Method == "POST" && len(parts) == 11 && parts[6] == "rewriteTo":
+		s.rewrite(w, r, parts[3]+"/"+parts[5], parts[8]+"/"+parts[10])
+	case len(parts) == 6:
+		key := parts[3] + "/" + parts[5]
+		obj, found := s.objects[key]
+		if !found {
+			s.error(w, http.StatusNotFound, "No such object: "+key)
+			return
+		}
+		switch {
+		case r.Method == "DELETE":
+			delete(s.objects, key)
+			w.WriteHeader(http.StatusNoContent)
+		case r.URL.Query().Get("alt") == "media":
+			w.Write(obj.content)
+		default:
+			json.NewEncoder(w).Encode(s.metadata(parts[5], obj))
+		}
+	default:
+		s.t.Errorf("unexpected request %s %s", r.Method, r.URL)
+		s.error(w, http.StatusBadRequest, "Unexpected request")
+	}
+}
+
+func (s *fakeGCS) list(w http.ResponseWriter, r *http.Request, bucket string) {
+	names := make([]string, 0)
+	for key := range s.objects {
+		if strings.HasPrefix(key, bucket+"/"+r.URL.Query().Get("prefix")) {
+			names = append(names, strings.TrimPrefix(key, bucket+"/"))
+		}
+	}
+	sort.Strings(names)
+
+	start := 0
+	if token := r.URL.Query().Get("pageToken"); token != "" {
+		fmt.Sscan(token, &start)
+	}
+	page := struct {
+		Items         []map[string]string `json:"items,omitempty"`
+		NextPageToken string              `json:"nextPageToken,omitempty"`
+	}{}
+	for i := start; i < len(names) && i < start+2; i++ {
+		page.Items = append(page.Items, s.metadata(names[i], s.objects[bucket+"/"+names[i]]))
+	}
+	if start+2 < len(names) {
+		page.NextPageToken = fmt.Sprint(start + 2)
+	}
+	json.NewEncoder(w).Encode(page)
+}
+
+func (s *fakeGCS) upload(w http.ResponseWriter, r *http.Request, bucket string) {
+	mediaType, params, err := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if err != nil || mediaType != "multipart/related" || r.URL.Query().Get("uploadType") != "multipart" {
+		s.error(w, http.StatusBadRequest, "Invalid upload")
+		return
+	}
+	reader := multipart.NewReader(r.Body, params["boundary"])
+
+	var metadata map[string]string
+	part, err := reader.NextPart()
+	if err == nil {
+		err = json.NewDecoder(part).Decode(&metadata)
+	}
+	if err == nil {
+		part, err = reader.NextPart()
+	}
+	if err != nil {
+		s.error(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	content, _ := ioutil.ReadAll(part)
+	if part.Header.Get("Content-Type") != metadata["contentType"] {
+		s.t.Errorf("%s: content type %s, metadata %s", metadata["name"], part.Header.Get("Content-Type"), metadata["contentType"])
+	}
+
+	obj := &fakeGCSObject{content: content, contentType: metadata["contentType"], cacheControl: metadata["cacheControl"]}
+	s.objects[bucket+"/"+metadata["name"]] = obj
+	json.NewEncoder(w).Encode(s.metadata(metadata["name"], obj))
+}
+
+// The first call of a rewrite only returns a token, like large objects
+func (s *fakeGCS) rewrite(w http.ResponseWriter, r *http.Request, src string, dst string) {
+	obj, found := s.objects[src]
+	if !found {
+		s.error(w, http.StatusNotFound, "No such object: "+src)
+		return
+	}
+	s.rewrites++
+	if r.URL.Query().Get("rewriteToken") == "" {
+		fmt.Fprint(w, `{"done":false,"rewriteToken":"next"}`)
+		return
+	}
+	copied := *obj
+	s.objects[dst] = &copied
+	fmt.Fprint(w, `{"done":true}`)
+}
+
+func (s *fakeGCS) names() []string {
+	names := make([]string, 0, len(s.objects))
+	for key := range s.objects {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func newTestGCSBackend(t *testing.T, config *Config) (*fakeGCS, *httptest.Server, Backend) {
+	// No credentials are needed by a custom endpoint
+	old, found := os.LookupEnv("GOOGLE_APPLICATION_CREDENTIALS")
+	os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", os.DevNull+"/none.json")
+	defer func() {
+		if found {
+			os.Setenv("GOOGLE_APPLICATION_CREDENTIALS", old)
+		} else {
+			os.Unsetenv("GOOGLE_APPLICATION_CREDENTIALS")
+		}
+	}()
+
+	fake := &fakeGCS{t: t, objects: make(map[string]*fakeGCSObject)}
+	server := httptest.NewServer(fake)
+	config.GCSEndpoint = server.URL
+	backend, err := newGCSBackend(config)
+	if err != nil {
+		server.Close()
+		t.Fatal(err)
+	}
+	return fake, server, backend
+}
+
+func TestGCSBackendSync(t *testing.T) {
+	config := &Config{CacheControl: "no-cache", ImmutableFiles: []string{"*.chunk.js"}}
+	fake, server, _ := newTestGCSBackend(t, config)
+	defer server.Close()
+
+	// More objects than a page
+	fake.objects["site/app/stale.html"] = &fakeGCSObject{content: []byte("stale")}
+	fake.objects["site/app/js/stale.js"] = &fakeGCSObject{content: []byte("stale")}
+	fake.objects["site/app/index.html"] = &fakeGCSObject{content: []byte("<html>previous</html>")}
+	fake.objects["site/other/keep.txt"] = &fakeGCSObject{content: []byte("keep")}
+
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(t, srcDir, map[string]string{
+		"index.html":            "<html>new</html>",
+		"js/main.1a2b.chunk.js": "main()",
+		"css/style.css":         "a{}",
+	})
+
+	if err := S3Sync(config, srcDir+"/", "gs://site/app"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"site/app/css/style.css", "site/app/index.html", "site/app/js/main.1a2b.chunk.js", "site/other/keep.txt"}
+	if names := fake.names(); !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+	if content := string(fake.objects["site/app/index.html"].content); content != "<html>new</html>" {
+		t.Errorf("index.html: got %s", content)
+	}
+
+	tests := []struct {
+		name         string
+		cacheControl string
+	}{
+		{"site/app/index.html", "no-cache"},
+		{"site/app/css/style.css", "no-cache"},
+		{"site/app/js/main.1a2b.chunk.js", immutableCacheControl},
+	}
+	for _, test := range tests {
+		obj := fake.objects[test.name]
+		contentType := mime.TypeByExtension(path.Ext(test.name))
+		if obj.contentType != contentType || obj.cacheControl != test.cacheControl {
+			t.Errorf("%s: got %s and %s, want %s and %s", test.name, obj.contentType, obj.cacheControl, contentType, test.cacheControl)
+		}
+	}
+}
+
+func TestGCSBackendObjects(t *testing.T) {
+	fake, server, backend := newTestGCSBackend(t, &Config{})
+	defer server.Close()
+
+	content := []byte("window._env_ = {}")
+	fake.objects["site/a/env-config.js"] = &fakeGCSObject{content: content}
+
+	uri := &FileURI{Scheme: "gs", Bucket: "site", Path: "a/env-config.js"}
+	file, err := backend.Stat(uri)
+	if err != nil || file == nil || file.Size != int64(len(content)) {
+		t.Fatalf("got %+v %v", file, err)
+	}
+	checksum, err := backend.(Checksummer).Checksum(bytes.NewReader(content), int64(len(content)), file.Checksum)
+	if err != nil || checksum != file.Checksum {
+		t.Errorf("checksum %s, listed %s (%v)", checksum, file.Checksum, err)
+	}
+
+	r, err := backend.Get(uri)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, _ := ioutil.ReadAll(r)
+	r.Close()
+	if !bytes.Equal(got, content) {
+		t.Errorf("got %s", got)
+	}
+
+	copied := &FileURI{Scheme: "gs", Bucket: "site", Path: "b/env-config.js"}
+	if err := backend.Copy(uri, copied); err != nil {
+		t.Fatal(err)
+	}
+	if fake.rewrites != 2 || fake.objects["site/b/env-config.js"] == nil {
+		t.Errorf("the rewrite was not completed in %d calls", fake.rewrites)
+	}
+
+	// Removing a missing object is not an error
+	missing := &FileURI{Scheme: "gs", Bucket: "site", Path: "a/missing.js"}
+	if err := backend.Delete([]*FileURI{uri, missing}); err != nil {
+		t.Fatal(err)
+	}
+	if file, err := backend.Stat(uri); file != nil || err != nil {
+		t.Errorf("got %+v %v after the removal", file, err)
+	}
+
+	// The errors carry the message of the API
+	_, err = backend.List(&FileURI{Scheme: "gs", Bucket: "forbidden", Path: "/"})
+	if err == nil || !strings.Contains(err.Error(), "Access denied.") {
+		t.Errorf("got %v, want the message of the API", err)
+	}
+}
@@ -0,0 +1,394 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/mail"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+	"text/template"
+	"time"
+
+	"github.com/go-git/go-billy/v5/osfs"
+	git "github.com/go-git/go-git/v5"
+	gitconfig "github.com/go-git/go-git/v5/config"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/cache"
+	"github.com/go-git/go-git/v5/plumbing/filemode"
+	"github.com/go-git/go-git/v5/plumbing/object"
+	"github.com/go-git/go-git/v5/plumbing/storer"
+	"github.com/go-git/go-git/v5/plumbing/transport"
+	"github.com/go-git/go-git/v5/plumbing/transport/client"
+	"github.com/go-git/go-git/v5/plumbing/transport/server"
+	"github.com/go-git/go-git/v5/storage/filesystem"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	RegisterDeployer("git+file", newGitDeployer)
+	RegisterDeployer("git+ssh", newGitDeployer)
+}
+
+// Commits the application on a branch of a repository, like the gh-pages
+// branch of the GitHub Pages
+type gitDeployer struct {
+	config  *Config
+	url     string
+	display string // url without password
+	auth    transport.AuthMethod
+}
+
+var installFileProtocol sync.Once
+
+// Data of the commit message template
+type gitMessage struct {
+	Branch string
+	Date   string // RFC 3339
+	Files  int
+	Parent string // previous commit of the branch, empty for a new or orphan branch
+}
+
+func newGitDeployer(destination *url.URL, config *Config) (Deployer, error) {
+	if config.GitBranch == "" {
+		return nil, fmt.Errorf("Invalid destination %s: no branch", destination)
+	}
+
+	u := *destination
+	u.Scheme = strings.TrimPrefix(u.Scheme, "git+")
+	d := &gitDeployer{config: config}
+
+	if u.Scheme == "file" {
+		dir := u.Path
+		if u.Host != "" {
+			// git+file://relative/repo.git
+			dir = u.Host + dir
+		}
+		if dir == "" {
+			return nil, fmt.Errorf("Invalid destination %s: no repository", destination)
+		}
+		d.url, d.display = dir, dir
+
+		// The local repositories are served in process, the git binaries are
+		// not part of the image. This replaces the file transport of go-git
+		// for the whole process, hence only when a deployer needs it.
+		installFileProtocol.Do(func() { client.InstallProtocol("file", server.DefaultServer) })
+		return d, nil
+	}
+
+	if u.Host == "" {
+		return nil, fmt.Errorf("Invalid destination %s: no host", destination)
+	}
+	d.url = u.String()
+	d.auth = &gitSSHAuth{config: config, userinfo: u.User, addr: sshAddress(u.Host)}
+	display := *destination
+	if display.User != nil {
+		display.User = url.User(display.User.Username())
+	}
+	d.display = display.String()
+	return d, nil
+}
+
+// Authenticate with the SSH settings of the SFTP backend
+type gitSSHAuth struct {
+	config   *Config
+	userinfo *url.Userinfo
+	addr     string
+	lock     sync.Mutex
+	agents   []func() // closes the ssh agent connections of the sessions
+}
+
+func (a *gitSSHAuth) Name() string {
+	return "ssh"
+}
+
+func (a *gitSSHAuth) String() string {
+	return "ssh " + sshLogin(a.userinfo) + "@" + a.addr
+}
+
+// go-git connects after getting the configuration, the agent connections
+// are closed at the end of the deployment
+func (a *gitSSHAuth) ClientConfig() (*ssh.ClientConfig, error) {
+	clientConfig, closeAgent, err := sshClientConfig(a.config, a.userinfo, a.addr)
+	if err != nil {
+		return nil, err
+	}
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	a.agents = append(a.agents, closeAgent)
+	return clientConfig, nil
+}
+
+func (a *gitSSHAuth) close() {
+	a.lock.Lock()
+	defer a.lock.Unlock()
+	for _, closeAgent := range a.agents {
+		closeAgent()
+	}
+	a.agents = nil
+}
+
+// Commit the work directory on top of the branch, or as the single commit
+// of an orphan branch, in a temporary repository then push it. Nothing is
+// pushed when the content did not change.
+func (d *gitDeployer) Deploy(workdir string) error {
+	if auth, ok := d.auth.(*gitSSHAuth); ok {
+		defer auth.close()
+	}
+
+	if d.config.GitCNAME != "" {
+		if err := ioutil.WriteFile(filepath.Join(workdir, "CNAME"), []byte(d.config.GitCNAME+"\n"), 0644); err != nil {
+			return err
+		}
+	}
+	if d.config.GitNoJekyll {
+		if err := ioutil.WriteFile(filepath.Join(workdir, ".nojekyll"), []byte{}, 0644); err != nil {
+			return err
+		}
+	}
+
+	gitdir, err := ioutil.TempDir("", "go-deploy-git")
+	if err != nil {
+		return err
+	}
+	defer os.RemoveAll(gitdir)
+
+	repo, err := git.Init(filesystem.NewStorage(osfs.New(gitdir), cache.NewObjectLRUDefault()), nil)
+	if err != nil {
+		return err
+	}
+	remote, err := repo.CreateRemote(&gitconfig.RemoteConfig{Name: git.DefaultRemoteName, URLs: []string{d.url}})
+	if err != nil {
+		return err
+	}
+
+	var progress io.Writer
+	if d.config.Verbose {
+		progress = os.Stdout
+	}
+
+	branch := plumbing.NewBranchReferenceName(d.config.GitBranch)
+	var parent *object.Commit
+	if !d.config.GitOrphan {
+		parent, err = d.fetchBranch(repo, remote, branch, progress)
+		if err != nil {
+			return err
+		}
+	}
+
+	tree, files, err := writeTree(repo.Storer, workdir)
+	if err != nil {
+		return err
+	}
+	if parent != nil && parent.TreeHash == tree {
+		fmt.Printf("Branch %s of %s is up to date\n", d.config.GitBranch, d.display)
+		return nil
+	}
+
+	signature, err := gitSignature(d.config.GitAuthor)
+	if err != nil {
+		return err
+	}
+	data := gitMessage{Branch: d.config.GitBranch, Date: signature.When.Format(time.RFC3339), Files: files}
+	commit := &object.Commit{Author: signature, Committer: signature, TreeHash: tree}
+	if parent != nil {
+		data.Parent = parent.Hash.String()
+		commit.ParentHashes = []plumbing.Hash{parent.Hash}
+	}
+	commit.Message, err = gitCommitMessage(d.config.GitMessage, data)
+	if err != nil {
+		return err
+	}
+
+	obj := repo.Storer.NewEncodedObject()
+	if err := commit.Encode(obj); err != nil {
+		return err
+	}
+	hash, err := repo.Storer.SetEncodedObject(obj)
+	if err != nil {
+		return err
+	}
+	if err := repo.Storer.SetReference(plumbing.NewHashReference(branch, hash)); err != nil {
+		return err
+	}
+
+	// An orphan commit replaces the history of the branch
+	refSpec := gitconfig.RefSpec(branch + ":" + branch)
+	if d.config.GitOrphan {
+		refSpec = "+" + refSpec
+	}
+	err = remote.Push(&git.PushOptions{RefSpecs: []gitconfig.RefSpec{refSpec}, Auth: d.auth, Progress: progress})
+	if err != nil {
+		return fmt.Errorf("Unable to push to %s: %v", d.display, err)
+	}
+	fmt.Printf("Pushed %s with %d files to branch %s of %s\n", hash.String()[:7], files, d.config.GitBranch, d.display)
+	return nil
+}
+
+// Fetch the branch, nil when it does not exist yet
+func (d *gitDeployer) fetchBranch(repo *git.Repository, remote *git.Remote, branch plumbing.ReferenceName, progress io.Writer) (*object.Commit, error) {
+	refs, err := remote.List(&git.ListOptions{Auth: d.auth})
+	if err == transport.ErrEmptyRemoteRepository {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read %s: %v", d.display, err)
+	}
+	found := false
+	for _, ref := range refs {
+		found = found || ref.Name() == branch
+	}
+	if !found {
+		return nil, nil
+	}
+
+	err = remote.Fetch(&git.FetchOptions{
+		RefSpecs: []gitconfig.RefSpec{gitconfig.RefSpec("+" + branch + ":" + branch)},
+		Auth:     d.auth,
+		Progress: progress,
+	})
+	if err != nil && err != git.NoErrAlreadyUpToDate {
+		return nil, fmt.Errorf("Unable to fetch %s of %s: %v", branch.Short(), d.display, err)
+	}
+	ref, err := repo.Reference(branch, true)
+	if err != nil {
+		return nil, err
+	}
+	return repo.CommitObject(ref.Hash())
+}
+
+// The author defaults to the GIT_AUTHOR_NAME and GIT_AUTHOR_EMAIL variables
+func gitSignature(author string) (object.Signature, error) {
+	signature := object.Signature{
+		Name:  firstNonEmpty(os.Getenv("GIT_AUTHOR_NAME"), "go-deploy"),
+		Email: firstNonEmpty(os.Getenv("GIT_AUTHOR_EMAIL"), "go-deploy@localhost"),
+		When:  time.Now(),
+	}
+	if author != "" {
+		address, err := mail.ParseAddress(author)
+		if err != nil {
+			return signature, fmt.Errorf("Invalid git author %s, must be like 'Name <email>': %v", author, err)
+		}
+		signature.Name, signature.Email = address.Name, address.Address
+	}
+	return signature, nil
+}
+
+func gitCommitMessage(text string, data gitMessage) (string, error) {
+	t, err := template.New("message").Funcs(template.FuncMap{"env": os.Getenv}).Parse(text)
+	if err != nil {
+		return "", fmt.Errorf("Invalid git message template: %v", err)
+	}
+	var message bytes.Buffer
+	if err := t.Execute(&message, data); err != nil {
+		return "", fmt.Errorf("Invalid git message template: %v", err)
+	}
+	return message.String(), nil
+}
+
+// Store the files of dir as a tree, returning its hash and the number of
+// files. Git does not track the empty directories.
+func writeTree(s storer.EncodedObjectStorer, dir string) (plumbing.Hash, int, error) {
+	infos, err := ioutil.ReadDir(dir)
+	if err != nil {
+		return plumbing.ZeroHash, 0, err
+	}
+
+	files := 0
+	entries := make([]object.TreeEntry, 0, len(infos))
+	for _, info := range infos {
+		file := filepath.Join(dir, info.Name())
+		entry := object.TreeEntry{Name: info.Name(), Mode: filemode.Regular}
+
+		switch {
+		case info.IsDir():
+			hash, count, err := writeTree(s, file)
+			if err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			if count == 0 {
+				continue
+			}
+			entry.Mode, entry.Hash = filemode.Dir, hash
+			files += count
+		case info.Mode()&os.ModeSymlink != 0:
+			target, err := os.Readlink(file)
+			if err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			entry.Mode = filemode.Symlink
+			if entry.Hash, err = writeBlob(s, strings.NewReader(target)); err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			files++
+		default:
+			if info.Mode()&0111 != 0 {
+				entry.Mode = filemode.Executable
+			}
+			fd, err := os.Open(file)
+			if err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			entry.Hash, err = writeBlob(s, fd)
+			fd.Close()
+			if err != nil {
+				return plumbing.ZeroHash, 0, err
+			}
+			files++
+		}
+		entries = append(entries, entry)
+	}
+
+	// Git sorts the directories as if their name ended with a slash
+	sortName := func(entry object.TreeEntry) string {
+		if entry.Mode == filemode.Dir {
+			return entry.Name + "/"
+		}
+		return entry.Name
+	}
+	sort.Slice(entries, func(i, j int) bool { return sortName(entries[i]) < sortName(entries[j]) })
+
+	obj := s.NewEncodedObject()
+	if err := (&object.Tree{Entries: entries}).Encode(obj); err != nil {
+		return plumbing.ZeroHash, 0, err
+	}
+	hash, err := s.SetEncodedObject(obj)
+	return hash, files, err
+}
+
+func writeBlob(s storer.EncodedObjectStorer, r io.Reader) (plumbing.Hash, error) {
+	obj := s.NewEncodedObject()
+	obj.SetType(plumbing.BlobObject)
+	w, err := obj.Writer()
+	if err != nil {
+		return plumbing.ZeroHash, err
+	}
+	if _, err := io.Copy(w, r); err != nil {
+		w.Close()
+		return plumbing.ZeroHash, err
+	}
+	if err := w.Close(); err != nil {
+		return plumbing.ZeroHash, err
+	}
+	return s.SetEncodedObject(obj)
+}
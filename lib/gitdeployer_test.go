@@ -0,0 +1,138 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+
+	git "github.com/go-git/go-git/v5"
+	"github.com/go-git/go-git/v5/plumbing"
+	"github.com/go-git/go-git/v5/plumbing/object"
+)
+
+// Deploy files to the branch of the bare repository of dir
+func gitDeploy(t *testing.T, dir string, config *Config, files map[string]string) {
+	workdir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(workdir)
+	writeFiles(t, workdir, files)
+
+	destination, err := url.Parse("git+file://" + filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	deployer, err := newGitDeployer(destination, config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := deployer.Deploy(workdir); err != nil {
+		t.Fatal(err)
+	}
+}
+
+// The head commit of the branch and the files of its tree, the repository
+// being opened again to see the packs of the last push
+func gitBranchHead(t *testing.T, dir string, branch string) (*object.Commit, []string) {
+	repo, err := git.PlainOpen(dir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ref, err := repo.Reference(plumbing.NewBranchReferenceName(branch), true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	commit, err := repo.CommitObject(ref.Hash())
+	if err != nil {
+		t.Fatal(err)
+	}
+	iter, err := commit.Files()
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := make([]string, 0)
+	iter.ForEach(func(file *object.File) error {
+		files = append(files, file.Name)
+		return nil
+	})
+	sort.Strings(files)
+	return commit, files
+}
+
+func TestGitDeployerBareRepository(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if _, err := git.PlainInit(dir, true); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		GitBranch:   "gh-pages",
+		GitAuthor:   "Deployer <deploy@example.com>",
+		GitMessage:  "Deploy {{.Files}} files on {{.Parent}}",
+		GitNoJekyll: true,
+	}
+
+	// The first commit of a new branch has no parent
+	gitDeploy(t, dir, config, map[string]string{"index.html": "v1", "js/main.js": "main()"})
+	first, files := gitBranchHead(t, dir, "gh-pages")
+	if len(first.ParentHashes) != 0 || first.Message != "Deploy 3 files on " {
+		t.Errorf("first commit: got %v parents, message %q", first.ParentHashes, first.Message)
+	}
+	if want := []string{".nojekyll", "index.html", "js/main.js"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("first commit: got %v, want %v", files, want)
+	}
+	if first.Author.Name != "Deployer" || first.Author.Email != "deploy@example.com" {
+		t.Errorf("got author %s", first.Author.String())
+	}
+
+	// The history is kept by default
+	gitDeploy(t, dir, config, map[string]string{"index.html": "v2"})
+	second, files := gitBranchHead(t, dir, "gh-pages")
+	if !reflect.DeepEqual(second.ParentHashes, []plumbing.Hash{first.Hash}) || second.Message != "Deploy 2 files on "+first.Hash.String() {
+		t.Errorf("second commit: got %v parents, message %q", second.ParentHashes, second.Message)
+	}
+	if want := []string{".nojekyll", "index.html"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("second commit: got %v, want %v", files, want)
+	}
+
+	// Nothing is pushed when the content did not change
+	gitDeploy(t, dir, config, map[string]string{"index.html": "v2"})
+	if head, _ := gitBranchHead(t, dir, "gh-pages"); head.Hash != second.Hash {
+		t.Errorf("unchanged content: got commit %s, want %s", head.Hash, second.Hash)
+	}
+
+	// An orphan commit replaces the history of the branch
+	config.GitOrphan = true
+	gitDeploy(t, dir, config, map[string]string{"index.html": "v3"})
+	orphan, files := gitBranchHead(t, dir, "gh-pages")
+	if orphan.Hash == second.Hash || len(orphan.ParentHashes) != 0 {
+		t.Errorf("orphan commit %s: got %v parents", orphan.Hash, orphan.ParentHashes)
+	}
+	if want := []string{".nojekyll", "index.html"}; !reflect.DeepEqual(files, want) {
+		t.Errorf("orphan commit: got %v, want %v", files, want)
+	}
+}
@@ -0,0 +1,101 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// Number of hexadecimal characters of the hash added to the file names
+const hashLength = 10
+
+// Only the script has its references rewritten: the json and esm files are
+// fetched or imported by the application under their plain names
+func isHashedFormat(format string) bool {
+	return format == "js"
+}
+
+// Insert the hash of content before the extension of filename:
+// env-config.js becomes env-config.<hash>.js
+func hashedName(filename string, content []byte) string {
+	ext := filepath.Ext(filename)
+	hash := fmt.Sprintf("%x", sha256.Sum256(content))[:hashLength]
+	return strings.TrimSuffix(filename, ext) + "." + hash + ext
+}
+
+// HashedConfigGlobs returns the globs matching the hashed names of the
+// config files generated with config, to give them long cache lifetimes.
+func HashedConfigGlobs(config *DotEnvConfig) ([]string, error) {
+	outputs, err := configOutputs(config)
+	if err != nil {
+		return nil, err
+	}
+
+	globs := make([]string, 0, len(outputs))
+	for _, output := range outputs {
+		if !isHashedFormat(output.Format) {
+			continue
+		}
+		globs = append(globs, hashedGlob(filepath.Base(output.Filename)))
+	}
+	return globs, nil
+}
+
+// Glob matching the hashed variants of name
+func hashedGlob(name string) string {
+	ext := filepath.Ext(name)
+	return strings.TrimSuffix(name, ext) + "." + strings.Repeat("[0-9a-f]", hashLength) + ext
+}
+
+// Replace the references to the renamed files in the HTML files of dir. Only
+// whole names are replaced, for instance "/env-config.js?v=1" but not
+// "my-env-config.js".
+func rewriteReferences(dir string, renamed map[string]string) error {
+	patterns := make(map[string]*regexp.Regexp)
+	for name := range renamed {
+		patterns[name] = regexp.MustCompile(`(^|[/"'=\s])` + regexp.QuoteMeta(name) + `([?#"'\s>]|$)`)
+	}
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.EqualFold(filepath.Ext(path), ".html") {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		rewritten := content
+		for name, re := range patterns {
+			rewritten = re.ReplaceAll(rewritten, []byte("${1}"+renamed[name]+"${2}"))
+		}
+
+		if string(rewritten) == string(content) {
+			return nil
+		}
+		return ioutil.WriteFile(path, rewritten, info.Mode())
+	})
+}
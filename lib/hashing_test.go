@@ -0,0 +1,93 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+// Only the js config is renamed, the application fetches the other formats
+// under their plain names
+func TestHashConfigOnlyRenamesScript(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	html := `<script src="/env-config.js"></script><script>fetch("/env-config.json")</script>`
+	if err := ioutil.WriteFile(filepath.Join(dir, "index.html"), []byte(html), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &DotEnvConfig{
+		ConfigName: "env-config.js",
+		Formats:    []string{"js", "json", "esm", "dts"},
+		HashConfig: true,
+	}
+	vars := []EnvVar{{Name: "API_URL", Value: "https://api.example.com", Type: typeString}}
+	if err := renderDotEnv(vars, "", dir, config); err != nil {
+		t.Fatal(err)
+	}
+
+	files, err := filepath.Glob(filepath.Join(dir, "env-config.*"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var script string
+	names := make([]string, 0)
+	for _, file := range files {
+		name := filepath.Base(file)
+		if strings.HasSuffix(name, ".js") {
+			script = name
+			name = "env-config.<hash>.js"
+		}
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	want := []string{"env-config.<hash>.js", "env-config.d.ts", "env-config.json", "env-config.mjs"}
+	if !reflect.DeepEqual(names, want) {
+		t.Fatalf("got %v, want %v", names, want)
+	}
+	if len(script) != len("env-config..js")+hashLength {
+		t.Errorf("%s is not hashed", script)
+	}
+
+	content, err := ioutil.ReadFile(filepath.Join(dir, "index.html"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Replace(html, "/env-config.js", "/"+script, 1); string(content) != want {
+		t.Errorf("index.html: got %s, want %s", content, want)
+	}
+
+	globs, err := HashedConfigGlobs(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(globs) != 1 {
+		t.Fatalf("got globs %v, want the script only", globs)
+	}
+	if ok, _ := filepath.Match(globs[0], script); !ok {
+		t.Errorf("%s does not match %s", globs[0], script)
+	}
+}
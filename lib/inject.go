@@ -0,0 +1,118 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+)
+
+// Marker comment replaced by the injected config
+const injectMarker = "<!-- go-deploy:config -->"
+
+// Name of the meta tag holding the JSON config
+const injectMetaName = "app-config"
+
+var headEndRe = regexp.MustCompile(`(?i)</head\s*>`)
+
+// Sequences ending an inline script or starting a comment in it
+var inlineScriptRe = regexp.MustCompile(`(?i)</script|<!--`)
+
+// Inline the rendered config into the configured HTML files of dir, either as
+// a <script> tag running the js format or as a <meta> tag holding the JSON
+// config. The tag replaces the marker comment or, when there is none, is
+// inserted before </head>.
+func injectConfig(vars []EnvVar, srcDir string, dir string, config *DotEnvConfig) error {
+	tag, err := injectTag(vars, srcDir, config)
+	if err != nil {
+		return err
+	}
+
+	files := config.InjectFiles
+	if len(files) == 0 {
+		files = []string{"index.html"}
+	}
+
+	for _, file := range files {
+		path := filepath.Join(dir, file)
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return fmt.Errorf("Unable to inject config in %s: %v", file, err)
+		}
+
+		if i := bytes.Index(content, []byte(injectMarker)); i >= 0 {
+			content = append(content[:i:i], append(tag, content[i+len(injectMarker):]...)...)
+		} else if loc := headEndRe.FindIndex(content); loc != nil {
+			content = append(content[:loc[0]:loc[0]], append(tag, content[loc[0]:]...)...)
+		} else {
+			return fmt.Errorf("Unable to inject config in %s: no %s marker nor </head> tag", file, injectMarker)
+		}
+
+		if err := ioutil.WriteFile(path, content, 0644); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func injectTag(vars []EnvVar, srcDir string, config *DotEnvConfig) ([]byte, error) {
+	var buf bytes.Buffer
+
+	switch config.Inject {
+	case "script":
+		t, err := configTemplate("js", vars, srcDir, config)
+		if err != nil {
+			return nil, err
+		}
+		var script bytes.Buffer
+		if err := t.Execute(&script, vars); err != nil {
+			return nil, err
+		}
+		buf.WriteString("<script>\n")
+		buf.Write(escapeInlineScript(script.Bytes()))
+		buf.WriteString("</script>")
+	case "meta":
+		t, err := configTemplate("json", vars, srcDir, config)
+		if err != nil {
+			return nil, err
+		}
+		var content, compact bytes.Buffer
+		if err := t.Execute(&content, vars); err != nil {
+			return nil, err
+		}
+		if err := json.Compact(&compact, content.Bytes()); err != nil {
+			return nil, err
+		}
+		fmt.Fprintf(&buf, `<meta name="%s" content="%s">`, injectMetaName, html.EscapeString(compact.String()))
+	default:
+		return nil, fmt.Errorf("Invalid inject mode %s (valid modes: script, meta)", config.Inject)
+	}
+	return buf.Bytes(), nil
+}
+
+// The values are encoded by the js format but a user template may write them
+// as is. A backslash after the < keeps the meaning of the strings holding
+// them, "<\/script>" being "</script>".
+func escapeInlineScript(script []byte) []byte {
+	return inlineScriptRe.ReplaceAllFunc(script, func(match []byte) []byte {
+		return append([]byte{'<', '\\'}, match[1:]...)
+	})
+}
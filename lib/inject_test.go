@@ -0,0 +1,192 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+var injectVars = []EnvVar{
+	{Name: "API_URL", Value: "https://api.example.com", Type: typeString},
+	{Name: "TITLE", Value: `</script><script>alert("x")</script><!--`, Type: typeString},
+}
+
+func TestInjectConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	tests := []struct {
+		name string
+		html string
+		want string // TAG standing for the injected tag
+	}{
+		{
+			name: "marker",
+			html: `<head><!-- go-deploy:config --><script src="/app.js"></script></head>`,
+			want: `<head>TAG<script src="/app.js"></script></head>`,
+		},
+		{
+			name: "first marker",
+			html: `<head><!-- go-deploy:config --></head><body><!-- go-deploy:config --></body>`,
+			want: `<head>TAG</head><body><!-- go-deploy:config --></body>`,
+		},
+		{
+			name: "marker in the body",
+			html: `<head></head><body><!-- go-deploy:config --></body>`,
+			want: `<head></head><body>TAG</body>`,
+		},
+		{
+			name: "end of head",
+			html: "<html><HEAD><title>App</title></HEAD >\n<body></body></html>",
+			want: "<html><HEAD><title>App</title>TAG</HEAD >\n<body></body></html>",
+		},
+	}
+
+	for _, mode := range []string{"script", "meta"} {
+		config := &DotEnvConfig{Inject: mode, InjectFiles: []string{"index.html", "admin/index.html"}}
+		tag, err := injectTag(injectVars, dir, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		for _, test := range tests {
+			writeFiles(t, dir, map[string]string{"index.html": test.html, "admin/index.html": test.html})
+			if err := injectConfig(injectVars, dir, dir, config); err != nil {
+				t.Errorf("%s %s: %v", mode, test.name, err)
+				continue
+			}
+			want := strings.Replace(test.want, "TAG", string(tag), 1)
+			for _, file := range config.InjectFiles {
+				content, err := ioutil.ReadFile(filepath.Join(dir, file))
+				if err != nil {
+					t.Fatal(err)
+				}
+				if string(content) != want {
+					t.Errorf("%s %s: %s is\n%s\nwant\n%s", mode, test.name, file, content, want)
+				}
+			}
+		}
+	}
+}
+
+func TestInjectConfigErrors(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"index.html":    "<html><head></head></html>",
+		"fragment.html": "<div></div>",
+	})
+
+	tests := []struct {
+		config DotEnvConfig
+		err    string
+	}{
+		{
+			DotEnvConfig{Inject: "script", InjectFiles: []string{"fragment.html"}},
+			"Unable to inject config in fragment.html: no <!-- go-deploy:config --> marker nor </head> tag",
+		},
+		{
+			DotEnvConfig{Inject: "meta", InjectFiles: []string{"index.html", "missing.html"}},
+			"Unable to inject config in missing.html: open " + filepath.Join(dir, "missing.html") + ": no such file or directory",
+		},
+		{
+			DotEnvConfig{Inject: "iframe"},
+			"Invalid inject mode iframe (valid modes: script, meta)",
+		},
+	}
+	for _, test := range tests {
+		err := injectConfig(injectVars, dir, dir, &test.config)
+		if err == nil || err.Error() != test.err {
+			t.Errorf("%v: got %v, want %s", test.config.InjectFiles, err, test.err)
+		}
+	}
+}
+
+// The script mode inlines the js format, nothing in the values can end the
+// script
+func TestInjectScript(t *testing.T) {
+	tag, err := injectTag(injectVars, "", &DotEnvConfig{Inject: "script"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := "<script>\n" + renderFormat(t, "js", injectVars) + "</script>"; string(tag) != want {
+		t.Errorf("got\n%s\nwant\n%s", tag, want)
+	}
+	if strings.Count(string(tag), "</script") != 1 || strings.Contains(string(tag), "<!--") {
+		t.Errorf("the values end the script: %s", tag)
+	}
+}
+
+// A user template may write the values without encoding them for HTML
+func TestInjectScriptTemplate(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"env.tmpl": "window.title = {{quote (env \"TITLE\")}}; /* </SCRIPT > */\n",
+	})
+
+	tag, err := injectTag(injectVars, dir, &DotEnvConfig{Inject: "script", Template: "env.tmpl"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := "<script>\n" +
+		`window.title = "<\/script><script>alert(\"x\")<\/script><\!--"; /* <\/SCRIPT > */` + "\n" +
+		"</script>"
+	if string(tag) != want {
+		t.Errorf("got\n%s\nwant\n%s", tag, want)
+	}
+}
+
+// The meta mode holds the compact JSON config, escaped for the attribute
+func TestInjectMeta(t *testing.T) {
+	tag, err := injectTag(injectVars, "", &DotEnvConfig{Inject: "meta"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	prefix, suffix := `<meta name="app-config" content="`, `">`
+	if !strings.HasPrefix(string(tag), prefix) || !strings.HasSuffix(string(tag), suffix) {
+		t.Fatalf("got %s", tag)
+	}
+	content := strings.TrimSuffix(strings.TrimPrefix(string(tag), prefix), suffix)
+	if strings.ContainsAny(content, "\"<>\n") {
+		t.Errorf("the content is not escaped: %s", content)
+	}
+
+	var values map[string]string
+	if err := json.Unmarshal([]byte(html.UnescapeString(content)), &values); err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"API_URL": injectVars[0].Value, "TITLE": injectVars[1].Value}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,207 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"strings"
+)
+
+// Expands the ${VAR} references of the dotenv values. A reference is
+// resolved against the process environment first, then against the keys
+// defined before the referencing one, in the order of the layers. The
+// supported forms are:
+//
+//   ${VAR}            value of VAR, empty when unset
+//   ${VAR:-default}   default when VAR is unset or empty
+//   ${VAR-default}    default when VAR is unset
+//   ${VAR:?message}   error when VAR is unset or empty
+//   ${VAR?message}    error when VAR is unset
+//   $$                a literal $
+//
+// Single-quoted values are taken literally.
+type interpolator struct {
+	entries  map[string]dotEnvEntry
+	first    map[string]int // position of the first definition of each key
+	last     map[string]int // position of the definition in effect
+	resolved map[string]string
+	stack    []string
+}
+
+// The entries are in the order of the layers, a key defined twice takes its
+// last value but keeps its first position, so a key of the base file can
+// reference one overridden by a later layer
+func newInterpolator(entries []dotEnvEntry) *interpolator {
+	r := &interpolator{
+		entries:  make(map[string]dotEnvEntry),
+		first:    make(map[string]int),
+		last:     make(map[string]int),
+		resolved: make(map[string]string),
+	}
+	for i, entry := range entries {
+		if _, found := r.entries[entry.Name]; !found {
+			r.first[entry.Name] = i
+		}
+		r.entries[entry.Name] = entry
+		r.last[entry.Name] = i
+	}
+	return r
+}
+
+// Value of a variable referenced by entry
+func (r *interpolator) lookup(entry dotEnvEntry, name string) (string, bool, error) {
+	if value, _, exists, err := lookupEnv(name); exists || err != nil {
+		return value, exists, err
+	}
+	referenced, found := r.entries[name]
+	if !found {
+		return "", false, nil
+	}
+	if r.first[name] >= r.last[entry.Name] {
+		return "", false, r.errorf(entry, "reference to %s, defined later at %s:%d", name, referenced.File, referenced.Line)
+	}
+	value, err := r.resolve(referenced)
+	return value, true, err
+}
+
+// Expanded value of a dotenv entry
+func (r *interpolator) resolve(entry dotEnvEntry) (string, error) {
+	if entry.Quote == '\'' {
+		return entry.Value, nil
+	}
+	if value, found := r.resolved[entry.Name]; found {
+		return value, nil
+	}
+
+	for i, name := range r.stack {
+		if name == entry.Name {
+			cycle := append(r.stack[i:], entry.Name)
+			return "", r.errorf(entry, "cyclic reference %s", strings.Join(cycle, " -> "))
+		}
+	}
+
+	r.stack = append(r.stack, entry.Name)
+	value, err := r.expand(entry, entry.Value)
+	r.stack = r.stack[:len(r.stack)-1]
+	if err != nil {
+		return "", err
+	}
+
+	r.resolved[entry.Name] = value
+	return value, nil
+}
+
+func (r *interpolator) expand(entry dotEnvEntry, s string) (string, error) {
+	var value strings.Builder
+	for i := 0; i < len(s); i++ {
+		if s[i] != '$' || i+1 >= len(s) {
+			value.WriteByte(s[i])
+			continue
+		}
+
+		switch s[i+1] {
+		case '$':
+			value.WriteByte('$')
+			i++
+		case '{':
+			end := matchingBrace(s, i+2)
+			if end < 0 {
+				return "", r.errorf(entry, "unterminated reference %s", s[i:])
+			}
+			expanded, err := r.expandReference(entry, s[i+2:end])
+			if err != nil {
+				return "", err
+			}
+			value.WriteString(expanded)
+			i = end
+		default:
+			value.WriteByte('$')
+		}
+	}
+	return value.String(), nil
+}
+
+// Expand the content of a ${...} reference
+func (r *interpolator) expandReference(entry dotEnvEntry, ref string) (string, error) {
+	n := 0
+	for n < len(ref) && (ref[n] == '_' || (ref[n] >= 'a' && ref[n] <= 'z') ||
+		(ref[n] >= 'A' && ref[n] <= 'Z') || (n > 0 && ref[n] >= '0' && ref[n] <= '9')) {
+		n++
+	}
+	name, op := ref[:n], ref[n:]
+	if name == "" {
+		return "", r.errorf(entry, "invalid reference ${%s}", ref)
+	}
+
+	value, exists, err := r.lookup(entry, name)
+	if err != nil {
+		return "", err
+	}
+
+	switch {
+	case op == "":
+		return value, nil
+	case strings.HasPrefix(op, ":-"):
+		if value == "" {
+			return r.expand(entry, op[2:])
+		}
+	case strings.HasPrefix(op, "-"):
+		if !exists {
+			return r.expand(entry, op[1:])
+		}
+	case strings.HasPrefix(op, ":?"):
+		if value == "" {
+			return "", r.requiredError(entry, name, op[2:])
+		}
+	case strings.HasPrefix(op, "?"):
+		if !exists {
+			return "", r.requiredError(entry, name, op[1:])
+		}
+	default:
+		return "", r.errorf(entry, "invalid reference ${%s}", ref)
+	}
+	return value, nil
+}
+
+func (r *interpolator) requiredError(entry dotEnvEntry, name string, message string) error {
+	if message == "" {
+		message = "is required"
+	}
+	return r.errorf(entry, "%s %s", name, message)
+}
+
+func (r *interpolator) errorf(entry dotEnvEntry, format string, args ...interface{}) error {
+	return fmt.Errorf("%s:%d: %s: %s", entry.File, entry.Line, entry.Name, fmt.Sprintf(format, args...))
+}
+
+// Index of the brace closing a reference whose content starts at start,
+// taking nested references into account
+func matchingBrace(s string, start int) int {
+	depth := 0
+	for i := start; i < len(s); i++ {
+		switch {
+		case s[i] == '$' && i+1 < len(s) && s[i+1] == '{':
+			depth++
+			i++
+		case s[i] == '}':
+			if depth == 0 {
+				return i
+			}
+			depth--
+		}
+	}
+	return -1
+}
@@ -0,0 +1,92 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"os"
+	"strings"
+	"testing"
+)
+
+func TestInterpolateEarlierKeys(t *testing.T) {
+	os.Setenv("GO_DEPLOY_TEST_LATER", "from env")
+	defer os.Unsetenv("GO_DEPLOY_TEST_LATER")
+
+	tests := []struct {
+		entries []dotEnvEntry
+		value   string // of URL
+		err     string
+	}{
+		{
+			entries: []dotEnvEntry{{Name: "HOST", Value: "example.com"}, {Name: "URL", Value: "https://${HOST}/v1"}},
+			value:   "https://example.com/v1",
+		},
+		{
+			entries: []dotEnvEntry{{Name: "URL", Value: "https://${HOST}/v1", Line: 1}, {Name: "HOST", Value: "example.com", Line: 2}},
+			err:     "reference to HOST, defined later at .env:2",
+		},
+		{
+			entries: []dotEnvEntry{{Name: "URL", Value: "${HOST:-localhost}"}, {Name: "HOST", Value: "example.com"}},
+			err:     "reference to HOST",
+		},
+		{
+			entries: []dotEnvEntry{{Name: "URL", Value: "${URL}"}},
+			err:     "reference to URL",
+		},
+		{
+			// The environment is not ordered
+			entries: []dotEnvEntry{{Name: "URL", Value: "${GO_DEPLOY_TEST_LATER}"}, {Name: "GO_DEPLOY_TEST_LATER", Value: "from file"}},
+			value:   "from env",
+		},
+		{
+			// A later layer overrides a key referenced by the base file
+			entries: []dotEnvEntry{
+				{Name: "HOST", Value: "example.com"},
+				{Name: "URL", Value: "https://${HOST}/v1"},
+				{Name: "HOST", Value: "localhost", File: ".env.local"},
+				{Name: "URL", Value: "https://${HOST}/v1"},
+			},
+			value: "https://localhost/v1",
+		},
+		{
+			entries: []dotEnvEntry{
+				{Name: "HOST", Value: "example.com"},
+				{Name: "URL", Value: "https://${HOST}/v1"},
+				{Name: "HOST", Value: "${URL}", File: ".env.local"},
+				{Name: "URL", Value: "https://${HOST}/v1"},
+			},
+			err: "cyclic reference URL -> HOST -> URL",
+		},
+	}
+
+	for i, test := range tests {
+		for j := range test.entries {
+			if test.entries[j].File == "" {
+				test.entries[j].File = ".env"
+			}
+		}
+		r := newInterpolator(test.entries)
+		value, err := r.resolve(r.entries["URL"])
+		switch {
+		case test.err != "" && (err == nil || !strings.Contains(err.Error(), test.err)):
+			t.Errorf("%d: got error %v, want %s", i, err, test.err)
+		case test.err == "" && err != nil:
+			t.Errorf("%d: %v", i, err)
+		case test.err == "" && value != test.value:
+			t.Errorf("%d: got %q, want %q", i, value, test.value)
+		}
+	}
+}
@@ -0,0 +1,261 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"fmt"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// Files scanned for placeholders when no glob is configured
+var defaultPlaceholderGlobs = []string{"*.js", "*.css", "*.html", "*.json"}
+
+// Placeholder delimiters used when none is configured
+var defaultPlaceholderDelims = []string{"__", "%%"}
+
+// Globs of the placeholder names never reported when they have no value, the
+// hooks of the browser extensions are found in every build of some frameworks
+var DefaultPlaceholderIgnore = []string{"*DEVTOOLS*"}
+
+// Encoding of the values by file extension so that they can't break out of
+// the string or attribute holding the placeholder. The values are inserted
+// as is in the other files.
+var placeholderEncodings = map[string]func(string) string{
+	".js":   jsStringContent,
+	".mjs":  jsStringContent,
+	".cjs":  jsStringContent,
+	".json": jsStringContent,
+	".html": html.EscapeString,
+	".htm":  html.EscapeString,
+	".svg":  html.EscapeString,
+	".xml":  html.EscapeString,
+	".css":  cssStringContent,
+}
+
+type placeholderDelim struct {
+	Open  string
+	Close string
+}
+
+// Parse a delimiter, either "open:close" or a single string used on both sides
+func parsePlaceholderDelim(spec string) placeholderDelim {
+	if parts := strings.SplitN(spec, ":", 2); len(parts) == 2 && parts[0] != "" && parts[1] != "" {
+		return placeholderDelim{parts[0], parts[1]}
+	}
+	return placeholderDelim{spec, spec}
+}
+
+// Escape a value for any JavaScript string literal, single or double quoted
+// or template, the result being a valid JSON string content as well
+func jsStringContent(value string) string {
+	quoted := jsString(value)
+	return strings.NewReplacer("'", `\u0027`, "`", `\u0060`, "${", `\u0024{`).Replace(quoted[1 : len(quoted)-1])
+}
+
+// Escape a value for a CSS string or url(), the characters that could end
+// them or the style element are written as hexadecimal escapes
+func cssStringContent(value string) string {
+	var escaped strings.Builder
+	for _, c := range value {
+		alnum := c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9'
+		if alnum || strings.ContainsRune("-_.,:/?=#%+@!~*&; ", c) || c >= 0x80 && c != 0x2028 && c != 0x2029 {
+			escaped.WriteRune(c)
+		} else {
+			fmt.Fprintf(&escaped, "\\%x ", c)
+		}
+	}
+	return escaped.String()
+}
+
+// Replace the placeholders like __API_URL__ or %%API_URL%% found in the text
+// assets of dir with the value of the matching variable, encoded for the type
+// of the file unless raw values are requested. Placeholders that look like a
+// variable name but have no value are reported. The modified files having a
+// content hash in their name are renamed, and the integrity attributes and
+// precompressed variants depending on them are updated.
+func replacePlaceholders(vars []EnvVar, dir string, config *DotEnvConfig) error {
+	globs := config.PlaceholderGlobs
+	if len(globs) == 0 {
+		globs = defaultPlaceholderGlobs
+	}
+	specs := config.PlaceholderDelims
+	if len(specs) == 0 {
+		specs = defaultPlaceholderDelims
+	}
+
+	ignore := config.PlaceholderIgnore
+	if ignore == nil {
+		ignore = DefaultPlaceholderIgnore
+	}
+
+	unreplaced := make([]*regexp.Regexp, 0)
+	for _, spec := range specs {
+		delim := parsePlaceholderDelim(spec)
+		// Only upper case names are reported, lower case ones are usually code (__proto__, __esModule...)
+		unreplaced = append(unreplaced, regexp.MustCompile(regexp.QuoteMeta(delim.Open)+`([A-Z][A-Z0-9_]*?)`+regexp.QuoteMeta(delim.Close)))
+	}
+
+	// One replacer by encoding, built on first use
+	replacers := make(map[string]*strings.Replacer)
+	replacerFor := func(path string) *strings.Replacer {
+		ext := strings.ToLower(filepath.Ext(path))
+		encode, found := placeholderEncodings[ext]
+		if config.PlaceholderRaw || !found {
+			ext, encode = "", func(value string) string { return value }
+		}
+		if replacer, found := replacers[ext]; found {
+			return replacer
+		}
+		pairs := make([]string, 0)
+		for _, spec := range specs {
+			delim := parsePlaceholderDelim(spec)
+			for _, v := range vars {
+				pairs = append(pairs, delim.Open+v.Name+delim.Close, encode(v.Value))
+			}
+		}
+		replacers[ext] = strings.NewReplacer(pairs...)
+		return replacers[ext]
+	}
+
+	modified := make(map[string]bool)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !matchesGlobs(dir, path, globs) {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+
+		replaced := replacerFor(path).Replace(string(content))
+
+		for _, name := range findPlaceholders(replaced, unreplaced, ignore) {
+			log.Warnf("Unreplaced placeholder %s in %s", name, path[len(dir)+1:])
+		}
+
+		if replaced == string(content) {
+			return nil
+		}
+		modified[path] = true
+		return ioutil.WriteFile(path, []byte(replaced), info.Mode())
+	})
+	if err != nil || len(modified) == 0 {
+		return err
+	}
+
+	// The names and integrity computed from the former content are stale
+	if err := rehashFiles(dir, modified, globs); err != nil {
+		return err
+	}
+	if err := updateIntegrity(dir, modified); err != nil {
+		return err
+	}
+
+	paths := make([]string, 0, len(modified))
+	for path := range modified {
+		paths = append(paths, path)
+	}
+	sort.Strings(paths)
+	for _, path := range paths {
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		if err := refreshCompressed(path, content); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Report whether a file matches one of the globs, either by its path relative
+// to dir or by its base name
+func matchesGlobs(dir string, path string, globs []string) bool {
+	rel, err := filepath.Rel(dir, path)
+	if err != nil {
+		return false
+	}
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, rel); ok {
+			return true
+		}
+		if ok, _ := filepath.Match(glob, filepath.Base(path)); ok {
+			return true
+		}
+	}
+	return false
+}
+
+// Find the placeholders of content, except the ones whose name matches an
+// ignored glob
+func findPlaceholders(content string, patterns []*regexp.Regexp, ignore []string) []string {
+	found := make(map[string]bool)
+	for _, re := range patterns {
+		for _, match := range re.FindAllStringSubmatch(content, -1) {
+			if !matchesAny(match[1], ignore) {
+				found[match[0]] = true
+			}
+		}
+	}
+
+	names := make([]string, 0, len(found))
+	for name := range found {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+// Precompressed variants of a modified file would still serve the old
+// content: the gzip one is regenerated and the brotli one removed.
+func refreshCompressed(path string, content []byte) error {
+	if _, err := os.Stat(path + ".gz"); err == nil {
+		var buf bytes.Buffer
+		zw, _ := gzip.NewWriterLevel(&buf, gzip.BestCompression)
+		zw.Name = filepath.Base(path)
+		if _, err := zw.Write(content); err != nil {
+			return err
+		}
+		if err := zw.Close(); err != nil {
+			return err
+		}
+		if err := ioutil.WriteFile(path+".gz", buf.Bytes(), 0644); err != nil {
+			return err
+		}
+	}
+
+	if _, err := os.Stat(path + ".br"); err == nil {
+		log.Warnf("Removing outdated %s.br", filepath.Base(path))
+		if err := os.Remove(path + ".br"); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,269 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+	http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"compress/gzip"
+	"crypto/sha512"
+	"encoding/base64"
+	"encoding/json"
+	"html"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"testing"
+)
+
+const injection = `x";alert(1);"` + "'`${alert(2)}`</script><script>alert(3)</script>\n\u2028"
+
+func replaceInFiles(t *testing.T, files map[string]string, vars []EnvVar, config *DotEnvConfig) map[string]string {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	for name, content := range files {
+		if err := ioutil.WriteFile(filepath.Join(dir, name), []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := replacePlaceholders(vars, dir, config); err != nil {
+		t.Fatal(err)
+	}
+
+	replaced := make(map[string]string)
+	for name := range files {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		replaced[name] = string(content)
+	}
+	return replaced
+}
+
+// The value stays inside the JavaScript string, whatever its quotes
+func TestPlaceholdersEscapeJs(t *testing.T) {
+	vars := []EnvVar{{Name: "API_URL", Value: injection}}
+	tests := []struct {
+		name   string
+		before string
+		after  string
+	}{
+		{"double.js", `var a="`, `";`},
+		{"single.js", `var a='`, `';`},
+		{"template.js", "var a=`", "`;"},
+		{"config.json", `{"a":"`, `"}`},
+	}
+	files := make(map[string]string)
+	for _, test := range tests {
+		files[test.name] = test.before + "__API_URL__" + test.after
+	}
+	replaced := replaceInFiles(t, files, vars, &DotEnvConfig{})
+
+	for _, test := range tests {
+		content := replaced[test.name]
+		for _, unsafe := range []string{"</script", "${", "\n", "\u2028"} {
+			if strings.Contains(content, unsafe) {
+				t.Errorf("%s: the value is not escaped: %s", test.name, content)
+			}
+		}
+
+		// Every quote style accepts the JSON escapes
+		literal := strings.TrimSuffix(strings.TrimPrefix(content, test.before), test.after)
+		var value string
+		if err := json.Unmarshal([]byte(`"`+literal+`"`), &value); err != nil {
+			t.Errorf("%s: invalid string %s: %v", test.name, literal, err)
+		} else if value != injection {
+			t.Errorf("%s: got %q, want %q", test.name, value, injection)
+		}
+	}
+}
+
+func TestPlaceholdersEscapeHtmlAndCss(t *testing.T) {
+	vars := []EnvVar{{Name: "TITLE", Value: `"><script>alert(1)</script>`}}
+	files := map[string]string{
+		"index.html": `<a title="__TITLE__">%%TITLE%%</a>`,
+		"style.css":  `a::after{content:"__TITLE__"}`,
+	}
+	replaced := replaceInFiles(t, files, vars, &DotEnvConfig{})
+
+	escaped := html.EscapeString(vars[0].Value)
+	if want := `<a title="` + escaped + `">` + escaped + `</a>`; replaced["index.html"] != want {
+		t.Errorf("index.html: got %s, want %s", replaced["index.html"], want)
+	}
+	if want := `a::after{content:"\22 \3e \3c script\3e alert\28 1\29 \3c /script\3e "}`; replaced["style.css"] != want {
+		t.Errorf("style.css: got %s, want %s", replaced["style.css"], want)
+	}
+}
+
+func TestPlaceholdersRaw(t *testing.T) {
+	vars := []EnvVar{{Name: "DEBUG", Value: `window.debug && "on"`}}
+	files := map[string]string{
+		"main.js":    `var debug=__DEBUG__;`,
+		"index.html": `<script>__DEBUG__</script>`,
+	}
+	replaced := replaceInFiles(t, files, vars, &DotEnvConfig{PlaceholderRaw: true})
+
+	if want := `var debug=window.debug && "on";`; replaced["main.js"] != want {
+		t.Errorf("main.js: got %s, want %s", replaced["main.js"], want)
+	}
+	if want := `<script>window.debug && "on"</script>`; replaced["index.html"] != want {
+		t.Errorf("index.html: got %s, want %s", replaced["index.html"], want)
+	}
+}
+
+func TestFindPlaceholders(t *testing.T) {
+	patterns := []*regexp.Regexp{regexp.MustCompile(`__([A-Z][A-Z0-9_]*?)__`)}
+	content := `if (window.__REACT_DEVTOOLS_GLOBAL_HOOK__) {}; var a="__API_URL__", b=x.__proto__, c="__API_URL__";`
+
+	tests := []struct {
+		ignore []string
+		found  []string
+	}{
+		{DefaultPlaceholderIgnore, []string{"__API_URL__"}},
+		{[]string{}, []string{"__API_URL__", "__REACT_DEVTOOLS_GLOBAL_HOOK__"}},
+		{[]string{"*"}, []string{}},
+	}
+	for _, test := range tests {
+		found := findPlaceholders(content, patterns, test.ignore)
+		if strings.Join(found, ",") != strings.Join(test.found, ",") {
+			t.Errorf("ignore %v: got %v, want %v", test.ignore, found, test.found)
+		}
+	}
+}
+
+// The hashed names, the references to them and the integrity computed from
+// the former content follow the replaced one
+func TestPlaceholdersRehash(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"index.html": `<script src="/static/js/runtime.0a1b2c3d.js"></script>` +
+			`<script src="static/js/main.3f2a1b9c.js" integrity="sha256-stale sha384-stale" crossorigin></script>` +
+			`<link rel="stylesheet" href="/static/css/main.9e8d7c6b.css" integrity="sha384-unchanged">`,
+		"asset-manifest.json":            `{"main.js":"/static/js/main.3f2a1b9c.js","main.css":"/static/css/main.9e8d7c6b.css"}`,
+		"static/js/runtime.0a1b2c3d.js":  `var chunks={2:"5d4c3b2a"};`,
+		"static/js/main.3f2a1b9c.js":     "var url=\"__API_URL__\";\n//# sourceMappingURL=main.3f2a1b9c.js.map",
+		"static/js/main.3f2a1b9c.js.map": "{}",
+		"static/js/main.3f2a1b9c.js.gz":  "stale",
+		"static/js/2.5d4c3b2a.chunk.js":  `var title="__TITLE__";`,
+		"static/css/main.9e8d7c6b.css":   `body{color:red}`,
+	})
+
+	vars := []EnvVar{{Name: "API_URL", Value: "https://api.example.com"}, {Name: "TITLE", Value: "App"}}
+	if err := replacePlaceholders(vars, dir, &DotEnvConfig{}); err != nil {
+		t.Fatal(err)
+	}
+
+	names := make(map[string]string)
+	for _, file := range listFiles(t, dir) {
+		if hash := nameHash(file); hash != "" {
+			names[strings.Replace(filepath.Base(file), hash+".", "", 1)] = file
+		}
+	}
+	main, chunk, runtime := names["main.js"], names["2.chunk.js"], names["runtime.js"]
+	if main == "" || main == "static/js/main.3f2a1b9c.js" || chunk == "" || chunk == "static/js/2.5d4c3b2a.chunk.js" {
+		t.Fatalf("the modified files are not renamed: %v", listFiles(t, dir))
+	}
+	// The runtime is renamed in turn, its chunk map having changed
+	if runtime == "" || runtime == "static/js/runtime.0a1b2c3d.js" {
+		t.Errorf("the runtime is not renamed: %v", listFiles(t, dir))
+	}
+	if names["main.css"] != "static/css/main.9e8d7c6b.css" {
+		t.Errorf("the unmodified css is renamed: %v", listFiles(t, dir))
+	}
+
+	read := func(name string) string {
+		content, err := ioutil.ReadFile(filepath.Join(dir, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return string(content)
+	}
+	for _, ext := range []string{".map", ".gz"} {
+		if _, err := os.Stat(filepath.Join(dir, main+ext)); err != nil {
+			t.Errorf("%s is not renamed: %v", ext, err)
+		}
+	}
+	zr, err := gzip.NewReader(bytes.NewReader([]byte(read(main + ".gz"))))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unzipped, _ := ioutil.ReadAll(zr); string(unzipped) != read(main) {
+		t.Errorf("%s.gz is not regenerated: %s", main, unzipped)
+	}
+	if want := "//# sourceMappingURL=" + filepath.Base(main) + ".map"; !strings.HasSuffix(read(main), want) {
+		t.Errorf("%s: got %s, want the source map %s", main, read(main), want)
+	}
+	if want := `var chunks={2:"` + nameHash(chunk) + `"};`; read(runtime) != want {
+		t.Errorf("%s: got %s, want %s", runtime, read(runtime), want)
+	}
+	if want := `{"main.js":"/` + main + `","main.css":"/static/css/main.9e8d7c6b.css"}`; read("asset-manifest.json") != want {
+		t.Errorf("asset-manifest.json: got %s, want %s", read("asset-manifest.json"), want)
+	}
+
+	sum := sha512.Sum384([]byte(read(main)))
+	want := `<script src="/` + runtime + `"></script>` +
+		`<script src="` + main + `" integrity="sha384-` + base64.StdEncoding.EncodeToString(sum[:]) + `" crossorigin></script>` +
+		`<link rel="stylesheet" href="/static/css/main.9e8d7c6b.css" integrity="sha384-unchanged">`
+	if read("index.html") != want {
+		t.Errorf("index.html: got\n%s\nwant\n%s", read("index.html"), want)
+	}
+}
+
+func TestPlaceholdersRehashCircular(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{
+		"a.1a2b3c4d.js": `import "./b.5e6f7a8b.js"; var url="__API_URL__";`,
+		"b.5e6f7a8b.js": `import "./a.1a2b3c4d.js"; var url="__API_URL__";`,
+	})
+
+	err = replacePlaceholders([]EnvVar{{Name: "API_URL", Value: "https://api.example.com"}}, dir, &DotEnvConfig{})
+	if err == nil || !strings.HasPrefix(err.Error(), "Unable to rename the hashed files referencing each other") {
+		t.Errorf("got %v, want a circular reference error", err)
+	}
+}
+
+func TestNameHash(t *testing.T) {
+	tests := map[string]string{
+		"static/js/main.3f2a1b9c.js":     "3f2a1b9c",
+		"2.5d4c3b2a.chunk.js":            "5d4c3b2a",
+		"assets/index-4f3a2b1c.css":      "4f3a2b1c",
+		"main.3f2a1b9c.js.map":           "3f2a1b9c",
+		"main.js":                        "",
+		"backup.20191017.js":             "",
+		"deadbeefcafe.js":                "",
+		"env-config.0123456789abcdef.js": "0123456789abcdef",
+		"vendor.0A1B2C3D.js":             "",
+	}
+	for name, want := range tests {
+		if got := nameHash(name); got != want {
+			t.Errorf("%s: got %q, want %q", name, got, want)
+		}
+	}
+}
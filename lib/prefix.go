@@ -0,0 +1,119 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// DefaultDeny lists the environment variables that are never exported by
+// prefix, the configured deny list is added to it
+var DefaultDeny = []string{
+	"AWS_*",
+	"*SECRET*",
+	"*PASSWORD*",
+	"*PASSWD*",
+	"*PRIVATE_KEY*",
+	"*TOKEN*",
+	"*CREDENTIALS*",
+}
+
+// Add the environment variables starting with one of the configured
+// prefixes to vars. A variable that is already defined, once its prefix is
+// stripped, takes the value of the environment.
+func appendPrefixedVars(vars []EnvVar, config *DotEnvConfig) ([]EnvVar, error) {
+	deny := append(append([]string{}, DefaultDeny...), config.Deny...)
+
+	environ := os.Environ()
+	sort.Strings(environ)
+
+	for _, kv := range environ {
+		parts := strings.SplitN(kv, "=", 2)
+		if len(parts) != 2 {
+			continue
+		}
+		name, value, source := parts[0], parts[1], sourceEnvironment
+
+		prefix := matchingPrefix(name, config.Prefixes)
+		if prefix == "" || matchesAny(name, deny) {
+			continue
+		}
+
+		// APP_KEY_FILE exports APP_KEY with the content of the file
+		if strings.HasSuffix(name, fileEnvSuffix) && len(name) > len(prefix)+len(fileEnvSuffix) {
+			file := value
+			name = strings.TrimSuffix(name, fileEnvSuffix)
+			if _, exists := os.LookupEnv(name); exists || matchesAny(name, deny) {
+				continue
+			}
+			content, err := readValueFile(file)
+			if err != nil {
+				return nil, fmt.Errorf("%s%s: %v", name, fileEnvSuffix, err)
+			}
+			value, source = content, file
+		}
+
+		if config.StripPrefix {
+			name = strings.TrimPrefix(name, prefix)
+			if name == "" || matchesAny(name, deny) {
+				continue
+			}
+		}
+
+		v := EnvVar{Name: name, Value: value, Source: source}
+		if i := indexOfVar(vars, name); i >= 0 {
+			vars[i] = v
+		} else {
+			vars = append(vars, v)
+		}
+	}
+	return vars, nil
+}
+
+func matchingPrefix(name string, prefixes []string) string {
+	for _, prefix := range prefixes {
+		if prefix != "" && strings.HasPrefix(name, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+func matchesAny(name string, globs []string) bool {
+	for _, glob := range globs {
+		if ok, _ := filepath.Match(glob, name); ok {
+			return true
+		}
+	}
+	return false
+}
+
+func indexOfVar(vars []EnvVar, name string) int {
+	for i, v := range vars {
+		if v.Name == name {
+			return i
+		}
+	}
+	return -1
+}
+
+func hasVar(vars []EnvVar, name string) bool {
+	return indexOfVar(vars, name) >= 0
+}
@@ -0,0 +1,58 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"os"
+	"reflect"
+	"testing"
+)
+
+// A configured deny list adds to the default one instead of replacing it
+func TestAppendPrefixedVarsDeny(t *testing.T) {
+	env := map[string]string{
+		"GDT_API_URL":      "https://api.example.com",
+		"GDT_API_TOKEN":    "t0k3n",
+		"GDT_DB_PASSWORD":  "hunter2",
+		"GDT_INTERNAL_URL": "http://10.0.0.1",
+	}
+	for name, value := range env {
+		os.Setenv(name, value)
+		defer os.Unsetenv(name)
+	}
+
+	tests := []struct {
+		deny  []string
+		names []string
+	}{
+		{nil, []string{"GDT_API_URL", "GDT_INTERNAL_URL"}},
+		{[]string{"*INTERNAL*"}, []string{"GDT_API_URL"}},
+	}
+	for _, test := range tests {
+		config := &DotEnvConfig{Prefixes: []string{"GDT_"}, Deny: test.deny}
+		vars, err := appendPrefixedVars(nil, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		names := make([]string, 0)
+		for _, v := range vars {
+			names = append(names, v.Name)
+		}
+		if !reflect.DeepEqual(names, test.names) {
+			t.Errorf("deny %v: got %v, want %v", test.deny, names, test.names)
+		}
+	}
+}
@@ -0,0 +1,270 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+// Prefix of the values resolved by a provider, e.g. ref+ssm:///app/api_url
+const refPrefix = "ref+"
+
+// Provider resolves the values referencing an external source
+type Provider interface {
+	// Fetch the document a reference points to, the fragment is ignored
+	Fetch(ref *url.URL) (string, error)
+}
+
+// ProviderFactory creates a provider for a deployment
+type ProviderFactory func(config *DotEnvConfig) (Provider, error)
+
+var providerFactories = make(map[string]ProviderFactory)
+
+// RegisterProvider makes a provider available for the ref+<scheme>:// values
+func RegisterProvider(scheme string, factory ProviderFactory) {
+	providerFactories[scheme] = factory
+}
+
+func init() {
+	RegisterProvider("file", func(config *DotEnvConfig) (Provider, error) { return fileProvider{}, nil })
+	RegisterProvider("http", newHTTPProvider)
+	RegisterProvider("https", newHTTPProvider)
+	RegisterProvider("ssm", newSSMProvider)
+}
+
+// Resolves the references of a deployment, the providers are created on
+// first use and the fetched documents are cached for the whole run.
+type refResolver struct {
+	config    *DotEnvConfig
+	srcDir    string
+	layers    []string // dotenv files of srcDir
+	providers map[string]Provider
+	cache     map[string]string
+}
+
+func newRefResolver(srcDir string, layers []string, config *DotEnvConfig) *refResolver {
+	return &refResolver{
+		config:    config,
+		srcDir:    srcDir,
+		layers:    layers,
+		providers: make(map[string]Provider),
+		cache:     make(map[string]string),
+	}
+}
+
+// Replace the values of the form ref+<scheme>://<location>#<path> by the
+// value they reference. The optional fragment is a dotted path in the JSON
+// document found at location, e.g. #database.hosts.0
+func (r *refResolver) resolveVars(vars []EnvVar) error {
+	for i, v := range vars {
+		if !strings.HasPrefix(v.Value, refPrefix) {
+			continue
+		}
+		value, err := r.resolve(v.Value, r.sourceDir(v.Source))
+		if err != nil {
+			return fmt.Errorf("%s: %v", v.Name, err)
+		}
+		vars[i].Value = value
+		vars[i].Source = v.Value
+	}
+	return nil
+}
+
+// Directory of the file a value comes from, a dotenv file of srcDir or a
+// file read for NAME_FILE or --env-dir, empty for the environment
+func (r *refResolver) sourceDir(source string) string {
+	if source == "" || source == sourceEnvironment {
+		return ""
+	}
+	for _, layer := range r.layers {
+		if source == layer {
+			return filepath.Dir(filepath.Join(r.srcDir, layer))
+		}
+	}
+	return filepath.Dir(source)
+}
+
+// Resolve a reference, the relative ref+file:// paths being relative to dir
+func (r *refResolver) resolve(value string, dir string) (string, error) {
+	ref, err := url.Parse(strings.TrimPrefix(value, refPrefix))
+	if err != nil {
+		return "", fmt.Errorf("invalid reference %s: %v", value, err)
+	}
+	if file := ref.Host + ref.Path; ref.Scheme == "file" && dir != "" && !filepath.IsAbs(file) {
+		ref.Host, ref.Path = "", filepath.Join(dir, file)
+	}
+
+	fragment := ref.Fragment
+	ref.Fragment = ""
+	key := ref.String()
+
+	document, found := r.cache[key]
+	if !found {
+		provider, err := r.provider(ref.Scheme)
+		if err != nil {
+			return "", err
+		}
+		document, err = provider.Fetch(ref)
+		if err != nil {
+			return "", fmt.Errorf("unable to resolve %s: %v", value, err)
+		}
+		r.cache[key] = document
+	}
+
+	if fragment == "" {
+		return document, nil
+	}
+	return jsonPath(document, fragment)
+}
+
+func (r *refResolver) provider(scheme string) (Provider, error) {
+	if provider, found := r.providers[scheme]; found {
+		return provider, nil
+	}
+	factory, found := providerFactories[scheme]
+	if !found {
+		return nil, fmt.Errorf("no provider for %s%s:// references", refPrefix, scheme)
+	}
+	provider, err := factory(r.config)
+	if err != nil {
+		return nil, err
+	}
+	r.providers[scheme] = provider
+	return provider, nil
+}
+
+// Select a value in a JSON document with a dotted path, strings are
+// returned as is and other values JSON encoded
+func jsonPath(document string, path string) (string, error) {
+	var value interface{}
+	if err := json.Unmarshal([]byte(document), &value); err != nil {
+		return "", fmt.Errorf("unable to select %s, not a JSON document: %v", path, err)
+	}
+
+	for _, key := range strings.Split(path, ".") {
+		switch node := value.(type) {
+		case map[string]interface{}:
+			child, found := node[key]
+			if !found {
+				return "", fmt.Errorf("%s not found", path)
+			}
+			value = child
+		case []interface{}:
+			i, err := strconv.Atoi(key)
+			if err != nil || i < 0 || i >= len(node) {
+				return "", fmt.Errorf("%s not found", path)
+			}
+			value = node[i]
+		default:
+			return "", fmt.Errorf("%s not found", path)
+		}
+	}
+
+	if s, ok := value.(string); ok {
+		return s, nil
+	}
+	b, err := json.Marshal(value)
+	return string(b), err
+}
+
+// ref+file://relative/path or ref+file:///absolute/path, a relative path
+// being relative to the file defining the value
+type fileProvider struct{}
+
+func (fileProvider) Fetch(ref *url.URL) (string, error) {
+	return readValueFile(ref.Host + ref.Path)
+}
+
+// ref+http://host/path or ref+https://host/path, the body of the response
+type httpProvider struct {
+	client *http.Client
+}
+
+func newHTTPProvider(config *DotEnvConfig) (Provider, error) {
+	return httpProvider{&http.Client{Timeout: 30 * time.Second}}, nil
+}
+
+func (p httpProvider) Fetch(ref *url.URL) (string, error) {
+	resp, err := p.client.Get(ref.String())
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		return "", fmt.Errorf("%s returned %s", ref.String(), resp.Status)
+	}
+	body, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+	return strings.TrimRight(string(body), "\r\n"), nil
+}
+
+// ref+ssm:///path/to/parameter, a (possibly encrypted) SSM Parameter Store parameter
+type ssmProvider struct {
+	svc *ssm.SSM
+}
+
+func newSSMProvider(config *DotEnvConfig) (Provider, error) {
+	awsConfig := aws.Config{}
+	if config.SSMEndpoint != "" {
+		awsConfig.Endpoint = aws.String(config.SSMEndpoint)
+	}
+
+	sess, err := session.NewSessionWithOptions(session.Options{
+		Config:            awsConfig,
+		SharedConfigState: session.SharedConfigEnable,
+	})
+	if err != nil {
+		return nil, err
+	}
+	if aws.StringValue(sess.Config.Region) == "" {
+		sess.Config.Region = aws.String(defaultRegion)
+	}
+	return ssmProvider{ssm.New(sess)}, nil
+}
+
+func (p ssmProvider) Fetch(ref *url.URL) (string, error) {
+	name := ref.Path
+	if ref.Host != "" {
+		name = ref.Host + ref.Path
+		if ref.Path != "" {
+			name = "/" + name
+		}
+	}
+
+	out, err := p.svc.GetParameter(&ssm.GetParameterInput{
+		Name:           aws.String(name),
+		WithDecryption: aws.Bool(true),
+	})
+	if err != nil {
+		return "", err
+	}
+	return aws.StringValue(out.Parameter.Value), nil
+}
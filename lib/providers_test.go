@@ -0,0 +1,233 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// Use static credentials so that the SDK never looks for real ones
+func setTestAWSEnv() func() {
+	env := map[string]string{
+		"AWS_ACCESS_KEY_ID":           "AKIDTEST",
+		"AWS_SECRET_ACCESS_KEY":       "test",
+		"AWS_SESSION_TOKEN":           "",
+		"AWS_REGION":                  "eu-west-1",
+		"AWS_CONFIG_FILE":             os.DevNull,
+		"AWS_SHARED_CREDENTIALS_FILE": os.DevNull,
+	}
+	saved := make(map[string]*string)
+	for name, value := range env {
+		if old, found := os.LookupEnv(name); found {
+			saved[name] = &old
+		} else {
+			saved[name] = nil
+		}
+		os.Setenv(name, value)
+	}
+	return func() {
+		for name, old := range saved {
+			if old == nil {
+				os.Unsetenv(name)
+			} else {
+				os.Setenv(name, *old)
+			}
+		}
+	}
+}
+
+// A stand-in of the GetParameter action of SSM
+func newSSMServer(t *testing.T, parameters map[string]string, requests *[]string) *httptest.Server {
+	return httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if target := r.Header.Get("X-Amz-Target"); target != "AmazonSSM.GetParameter" {
+			t.Errorf("unexpected action %s", target)
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		if !strings.Contains(r.Header.Get("Authorization"), "AKIDTEST/") {
+			t.Errorf("unsigned request: %s", r.Header.Get("Authorization"))
+		}
+
+		var input struct {
+			Name           string
+			WithDecryption bool
+		}
+		if err := json.NewDecoder(r.Body).Decode(&input); err != nil {
+			t.Errorf("invalid request: %v", err)
+		}
+		if !input.WithDecryption {
+			t.Errorf("%s is not decrypted", input.Name)
+		}
+		*requests = append(*requests, input.Name)
+
+		w.Header().Set("Content-Type", "application/x-amz-json-1.1")
+		value, found := parameters[input.Name]
+		if !found {
+			w.WriteHeader(http.StatusBadRequest)
+			fmt.Fprintf(w, `{"__type":"ParameterNotFound","message":"Parameter %s not found."}`, input.Name)
+			return
+		}
+		json.NewEncoder(w).Encode(map[string]interface{}{
+			"Parameter": map[string]interface{}{"Name": input.Name, "Type": "SecureString", "Value": value},
+		})
+	}))
+}
+
+func TestSSMProvider(t *testing.T) {
+	defer setTestAWSEnv()()
+
+	requests := make([]string, 0)
+	server := newSSMServer(t, map[string]string{
+		"/app/api_url":  "https://api.example.com",
+		"/app/database": `{"hosts":["db1","db2"],"port":5432}`,
+		"plain":         "value",
+	}, &requests)
+	defer server.Close()
+
+	vars := []EnvVar{
+		{Name: "API_URL", Value: "ref+ssm:///app/api_url"},
+		{Name: "DB_HOST", Value: "ref+ssm://app/database#hosts.1"},
+		{Name: "DB_PORT", Value: "ref+ssm://app/database#port"},
+		{Name: "PLAIN", Value: "ref+ssm://plain"},
+	}
+	resolver := newRefResolver("", nil, &DotEnvConfig{SSMEndpoint: server.URL})
+	if err := resolver.resolveVars(vars); err != nil {
+		t.Fatal(err)
+	}
+
+	want := map[string]string{"API_URL": "https://api.example.com", "DB_HOST": "db2", "DB_PORT": "5432", "PLAIN": "value"}
+	for _, v := range vars {
+		if v.Value != want[v.Name] {
+			t.Errorf("%s: got %q, want %q", v.Name, v.Value, want[v.Name])
+		}
+		if !strings.HasPrefix(v.Source, "ref+ssm://") {
+			t.Errorf("%s: source %s", v.Name, v.Source)
+		}
+	}
+
+	// The parameters referenced twice are fetched once
+	if got := strings.Join(requests, ","); got != "/app/api_url,/app/database,plain" {
+		t.Errorf("requested %s", got)
+	}
+}
+
+func TestSSMProviderNotFound(t *testing.T) {
+	defer setTestAWSEnv()()
+
+	requests := make([]string, 0)
+	server := newSSMServer(t, map[string]string{}, &requests)
+	defer server.Close()
+
+	vars := []EnvVar{{Name: "API_URL", Value: "ref+ssm:///app/missing"}}
+	err := newRefResolver("", nil, &DotEnvConfig{SSMEndpoint: server.URL}).resolveVars(vars)
+	if err == nil || !strings.Contains(err.Error(), "API_URL") || !strings.Contains(err.Error(), "ParameterNotFound") {
+		t.Errorf("got %v, want a ParameterNotFound error for API_URL", err)
+	}
+}
+
+func TestHTTPProvider(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		switch r.URL.Path {
+		case "/config.json":
+			fmt.Fprintln(w, `{"api":{"url":"https://api.example.com"}}`)
+		case "/token":
+			fmt.Fprint(w, "plain text\r\n")
+		default:
+			http.NotFound(w, r)
+		}
+	}))
+	defer server.Close()
+
+	vars := []EnvVar{
+		{Name: "API_URL", Value: "ref+" + server.URL + "/config.json#api.url"},
+		{Name: "PLAIN", Value: "ref+" + server.URL + "/token"},
+	}
+	if err := newRefResolver("", nil, &DotEnvConfig{}).resolveVars(vars); err != nil {
+		t.Fatal(err)
+	}
+	if vars[0].Value != "https://api.example.com" || vars[1].Value != "plain text" {
+		t.Errorf("got %q and %q", vars[0].Value, vars[1].Value)
+	}
+
+	vars = []EnvVar{{Name: "MISSING", Value: "ref+" + server.URL + "/missing"}}
+	if err := newRefResolver("", nil, &DotEnvConfig{}).resolveVars(vars); err == nil || !strings.Contains(err.Error(), "404") {
+		t.Errorf("got %v, want a 404 error", err)
+	}
+}
+
+// The relative paths are relative to the file defining the value, the ones
+// set in the environment to the working directory
+func TestFileProvider(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	absolute := filepath.ToSlash(filepath.Join(srcDir, "config/app.json"))
+	writeFiles(t, srcDir, map[string]string{
+		".env":                "DB_HOST=ref+file://config/app.json#database.hosts.0\nABSOLUTE=ref+file://" + absolute + "#database.hosts.1\n",
+		"config/app.json":     `{"database": {"hosts": ["db1", "db2"]}}`,
+		"env/.env.extra":      "OTHER_HOST=ref+file://config/app.json#database.hosts.0\nTOKEN=ref+file://../token\nGO_DEPLOY_TEST_CWD=\nGO_DEPLOY_TEST_PASSWORD=\n",
+		"env/config/app.json": `{"database": {"hosts": ["other1"]}}`,
+		"token":               "t0k3n\n",
+		"secrets/password":    "ref+file://db.json#password\n",
+		"secrets/db.json":     `{"password": "s3cr3t"}`,
+		"cwd.txt":             "from the working directory\n",
+	})
+
+	cwd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	relative, err := filepath.Rel(cwd, filepath.Join(srcDir, "cwd.txt"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	restore := setTestEnv(map[string]string{
+		"GO_DEPLOY_TEST_CWD":           "ref+file://" + filepath.ToSlash(relative),
+		"GO_DEPLOY_TEST_PASSWORD_FILE": filepath.Join(srcDir, "secrets/password"),
+	})
+	defer restore()
+
+	err, vars := GetVars(srcDir, &DotEnvConfig{ConfigName: "env-config.js", EnvFiles: []string{".env", "env/.env.extra"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	values := make(map[string]string)
+	for _, v := range vars {
+		values[v.Name] = v.Value
+	}
+	want := map[string]string{
+		"DB_HOST":                 "db1",
+		"ABSOLUTE":                "db2",
+		"OTHER_HOST":              "other1",
+		"TOKEN":                   "t0k3n",
+		"GO_DEPLOY_TEST_CWD":      "from the working directory",
+		"GO_DEPLOY_TEST_PASSWORD": "s3cr3t",
+	}
+	if !reflect.DeepEqual(values, want) {
+		t.Errorf("got %v, want %v", values, want)
+	}
+}
@@ -0,0 +1,274 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"crypto/sha256"
+	"crypto/sha512"
+	"encoding/base64"
+	"fmt"
+	"hash"
+	"io/ioutil"
+	"net/url"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+
+	log "github.com/sirupsen/logrus"
+)
+
+// A hexadecimal content hash in a file name, like main.3f2a1b9c.js,
+// 2.a1b2c3d4.chunk.js or index-4f3a2b1c.css
+var hashedNameRe = regexp.MustCompile(`^(.+?[.-])([0-9a-f]{8,})((?:\.[0-9A-Za-z]+)+)$`)
+
+// Files renamed along with a hashed file
+var hashedSiblingExts = []string{".gz", ".br", ".map"}
+
+// Hash of a file name, empty when it has none. Both digits and letters are
+// required so that dates like 20191017 are not taken for hashes.
+func nameHash(path string) string {
+	m := hashedNameRe.FindStringSubmatch(filepath.Base(path))
+	if m == nil || !strings.ContainsAny(m[2], "0123456789") || !strings.ContainsAny(m[2], "abcdef") {
+		return ""
+	}
+	return m[2]
+}
+
+// Rename the hashed files of modified after their new content, the former
+// hashes being replaced in the text files of dir matching globs. The files
+// changed by the replacement are renamed in turn, until none is left.
+// modified is updated with the new paths and the changed files.
+func rehashFiles(dir string, modified map[string]bool, globs []string) error {
+	texts := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err == nil && !info.IsDir() && matchesGlobs(dir, path, globs) {
+			texts = append(texts, path)
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	sort.Strings(texts)
+
+	pending := make([]string, 0)
+	for _, path := range texts {
+		if modified[path] && nameHash(path) != "" {
+			pending = append(pending, path)
+		}
+	}
+
+	for round := 0; len(pending) > 0; round++ {
+		if round > len(texts) {
+			return fmt.Errorf("Unable to rename the hashed files referencing each other: %s", strings.Join(relPaths(dir, pending), ", "))
+		}
+
+		// Former hash -> new hash
+		hashes := make(map[string]string)
+		for _, path := range pending {
+			newPath, err := rehashFile(path)
+			if err != nil {
+				return err
+			}
+			if newPath == path {
+				continue
+			}
+			hashes[nameHash(path)] = nameHash(newPath)
+			delete(modified, path)
+			modified[newPath] = true
+			for i := range texts {
+				if texts[i] == path {
+					texts[i] = newPath
+				}
+			}
+		}
+
+		pending = pending[:0]
+		if len(hashes) == 0 {
+			break
+		}
+		olds := make([]string, 0, len(hashes))
+		for old := range hashes {
+			olds = append(olds, regexp.QuoteMeta(old))
+		}
+		sort.Strings(olds)
+		tokenRe := regexp.MustCompile(`\b(` + strings.Join(olds, "|") + `)\b`)
+
+		for _, path := range texts {
+			content, err := ioutil.ReadFile(path)
+			if err != nil {
+				return err
+			}
+			replaced := tokenRe.ReplaceAllStringFunc(string(content), func(old string) string { return hashes[old] })
+			if replaced == string(content) {
+				continue
+			}
+			if err := ioutil.WriteFile(path, []byte(replaced), 0644); err != nil {
+				return err
+			}
+			modified[path] = true
+			if nameHash(path) != "" {
+				pending = append(pending, path)
+			}
+		}
+	}
+	return nil
+}
+
+// Rename a hashed file after its content, the hash being the beginning of
+// its SHA-256. The former hash is left out of the content hashed so that a
+// reference to the file itself, like the one to its source map, doesn't
+// change its hash.
+func rehashFile(path string) (string, error) {
+	content, err := ioutil.ReadFile(path)
+	if err != nil {
+		return "", err
+	}
+	old := nameHash(path)
+	normalized := strings.Replace(string(content), old, strings.Repeat("0", len(old)), -1)
+	sum := fmt.Sprintf("%x", sha256.Sum256([]byte(normalized)))
+	if len(old) > len(sum) {
+		return path, nil
+	}
+
+	m := hashedNameRe.FindStringSubmatch(filepath.Base(path))
+	newPath := filepath.Join(filepath.Dir(path), m[1]+sum[:len(old)]+m[3])
+	if newPath == path {
+		return path, nil
+	}
+	if err := os.Rename(path, newPath); err != nil {
+		return "", err
+	}
+	for _, ext := range hashedSiblingExts {
+		if _, err := os.Stat(path + ext); err == nil {
+			if err := os.Rename(path+ext, newPath+ext); err != nil {
+				return "", err
+			}
+		}
+	}
+	return newPath, nil
+}
+
+func relPaths(dir string, paths []string) []string {
+	rels := make([]string, 0, len(paths))
+	for _, path := range paths {
+		rel, err := filepath.Rel(dir, path)
+		if err != nil {
+			rel = path
+		}
+		rels = append(rels, filepath.ToSlash(rel))
+	}
+	return rels
+}
+
+var (
+	integrityTagRe  = regexp.MustCompile(`(?i)<(?:script|link)\b[^>]*\bintegrity\s*=[^>]*>`)
+	integrityAttrRe = regexp.MustCompile(`(?i)(\bintegrity\s*=\s*)("[^"]*"|'[^']*')`)
+	resourceAttrRe  = regexp.MustCompile(`(?i)\b(?:src|href)\s*=\s*("[^"]*"|'[^']*')`)
+)
+
+// Digests of the Subresource Integrity, by increasing strength
+var integrityHashes = []struct {
+	name string
+	new  func() hash.Hash
+}{
+	{"sha256", sha256.New},
+	{"sha384", sha512.New384},
+	{"sha512", sha512.New},
+}
+
+// Recompute the integrity attributes of the <script> and <link> tags of the
+// HTML files of dir that reference a modified file, with the strongest digest
+// they list. The HTML files changed are added to modified.
+func updateIntegrity(dir string, modified map[string]bool) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		ext := strings.ToLower(filepath.Ext(path))
+		if info.IsDir() || (ext != ".html" && ext != ".htm") {
+			return nil
+		}
+
+		content, err := ioutil.ReadFile(path)
+		if err != nil {
+			return err
+		}
+		var tagErr error
+		replaced := integrityTagRe.ReplaceAllStringFunc(string(content), func(tag string) string {
+			updated, err := updateTagIntegrity(dir, path, tag, modified)
+			if err != nil && tagErr == nil {
+				tagErr = err
+			}
+			return updated
+		})
+		if tagErr != nil {
+			return tagErr
+		}
+		if replaced == string(content) {
+			return nil
+		}
+		modified[path] = true
+		return ioutil.WriteFile(path, []byte(replaced), info.Mode())
+	})
+}
+
+func updateTagIntegrity(dir string, page string, tag string, modified map[string]bool) (string, error) {
+	ref := resourceAttrRe.FindStringSubmatch(tag)
+	if ref == nil {
+		return tag, nil
+	}
+	u, err := url.Parse(strings.TrimSpace(ref[1][1 : len(ref[1])-1]))
+	if err != nil || u.Scheme != "" || u.Host != "" || u.Path == "" {
+		return tag, nil
+	}
+	// Absolute paths are relative to the root of the application
+	file := filepath.Join(filepath.Dir(page), filepath.FromSlash(u.Path))
+	if strings.HasPrefix(u.Path, "/") {
+		file = filepath.Join(dir, filepath.FromSlash(u.Path))
+	}
+
+	attr := integrityAttrRe.FindStringSubmatch(tag)
+	strongest := -1
+	for _, token := range strings.Fields(attr[2][1 : len(attr[2])-1]) {
+		for i, h := range integrityHashes {
+			if strings.HasPrefix(token, h.name+"-") && i > strongest {
+				strongest = i
+			}
+		}
+	}
+	if strongest < 0 {
+		return tag, nil
+	}
+
+	if !modified[file] {
+		if _, err := os.Stat(file); os.IsNotExist(err) {
+			log.Warnf("Unable to check the integrity of %s in %s, the file is not found", u.Path, filepath.Base(page))
+		}
+		return tag, nil
+	}
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return "", err
+	}
+	hasher := integrityHashes[strongest].new()
+	hasher.Write(content)
+	quote := attr[2][:1]
+	integrity := integrityHashes[strongest].name + "-" + base64.StdEncoding.EncodeToString(hasher.Sum(nil))
+	return strings.Replace(tag, attr[0], attr[1]+quote+integrity+quote, 1), nil
+}
@@ -0,0 +1,231 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"io"
+	"mime"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/s3"
+	"github.com/aws/aws-sdk-go/service/s3/s3manager"
+)
+
+// Amazon S3 buckets, the sessions being created once per bucket
+type s3Backend struct {
+	config   *Config
+	mutex    sync.Mutex
+	sessions map[string]*s3.S3
+}
+
+func newS3Backend(config *Config) (Backend, error) {
+	return &s3Backend{
+		config:   config,
+		sessions: make(map[string]*s3.S3),
+	}, nil
+}
+
+func (b *s3Backend) session(bucket string) (*s3.S3, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	if svc, found := b.sessions[bucket]; found {
+		return svc, nil
+	}
+	svc, err := SessionForBucket(b.config, bucket)
+	if err != nil {
+		return nil, err
+	}
+	b.sessions[bucket] = svc
+	return svc, nil
+}
+
+func (b *s3Backend) List(uri *FileURI) ([]FileObject, error) {
+	svc, err := b.session(uri.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	params := &s3.ListObjectsV2Input{
+		Bucket:  aws.String(uri.Bucket), // Required
+		MaxKeys: aws.Int64(1000),
+	}
+	key := ""
+	if uri.Path != "" && uri.Path != "/" {
+		key = *uri.Key()
+		params.Prefix = aws.String(key)
+	}
+
+	// Only keep the objects "in the directory" of the key, a/b being a
+	// prefix of a/bc as well
+	slen := len(key) - 1
+	if slen > 0 && key[slen] != '/' {
+		slen += 1
+	}
+
+	result := make([]FileObject, 0)
+	err = svc.ListObjectsV2Pages(params, func(page *s3.ListObjectsV2Output, lastPage bool) bool {
+		for _, obj := range page.Contents {
+			if slen > 0 && len(*obj.Key) > slen && (*obj.Key)[slen] != '/' {
+				continue
+			}
+			result = append(result, FileObject{
+				Name:     *obj.Key,
+				Size:     *obj.Size,
+				Checksum: strings.Trim(*obj.ETag, `"`),
+			})
+		}
+		return true
+	})
+	return result, err
+}
+
+func (b *s3Backend) Stat(uri *FileURI) (*FileObject, error) {
+	svc, err := b.session(uri.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	response, err := svc.HeadObject(&s3.HeadObjectInput{
+		Bucket: aws.String(uri.Bucket),
+		Key:    uri.Key(),
+	})
+	if aerr, ok := err.(awserr.RequestFailure); ok && aerr.StatusCode() == 404 {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FileObject{
+		Name:     uri.Path,
+		Size:     *response.ContentLength,
+		Checksum: strings.Trim(*response.ETag, `"`),
+	}, nil
+}
+
+func (b *s3Backend) Put(uri *FileURI, r io.Reader, size int64) error {
+	svc, err := b.session(uri.Bucket)
+	if err != nil {
+		return err
+	}
+
+	uploader := s3manager.NewUploaderWithClient(svc, func(u *s3manager.Uploader) {
+		u.PartSize = b.config.PartSize * 1024 * 1024
+		u.Concurrency = b.config.Concurrency
+	})
+
+	mimetype := mime.TypeByExtension(filepath.Ext(uri.Path))
+	acl := "public-read"
+
+	params := &s3manager.UploadInput{
+		Bucket:      aws.String(uri.Bucket), // Required
+		Key:         aws.String(strings.TrimPrefix(uri.Path, "/")),
+		Body:        r,
+		ContentType: &mimetype,
+		ACL:         &acl,
+	}
+
+	if b.config.StorageClass != "" {
+		params.StorageClass = aws.String(b.config.StorageClass)
+	}
+
+	if cacheControl := cacheControlFor(b.config, uri.Path); cacheControl != "" {
+		params.CacheControl = aws.String(cacheControl)
+	}
+
+	_, err = uploader.Upload(params)
+	return err
+}
+
+func (b *s3Backend) Get(uri *FileURI) (io.ReadCloser, error) {
+	svc, err := b.session(uri.Bucket)
+	if err != nil {
+		return nil, err
+	}
+
+	out, err := svc.GetObject(&s3.GetObjectInput{
+		Bucket: aws.String(uri.Bucket),
+		Key:    uri.Key(),
+	})
+	if err != nil {
+		return nil, err
+	}
+	return out.Body, nil
+}
+
+// Delete the objects by batches of a thousand, the maximum of DeleteObjects
+func (b *s3Backend) Delete(uris []*FileURI) error {
+	byBucket := make(map[string][]*s3.ObjectIdentifier)
+	for _, uri := range uris {
+		byBucket[uri.Bucket] = append(byBucket[uri.Bucket], &s3.ObjectIdentifier{Key: uri.Key()})
+	}
+
+	for bucket, objects := range byBucket {
+		svc, err := b.session(bucket)
+		if err != nil {
+			return err
+		}
+		for len(objects) > 0 {
+			n := len(objects)
+			if n > 1000 {
+				n = 1000
+			}
+			params := &s3.DeleteObjectsInput{
+				Bucket: aws.String(bucket), // Required
+				Delete: &s3.Delete{ // Required
+					Objects: objects[:n],
+				},
+			}
+			if _, err := svc.DeleteObjects(params); err != nil {
+				return err
+			}
+			objects = objects[n:]
+		}
+	}
+	return nil
+}
+
+// Copy from S3 to S3
+//  -- if src and dst are the same it effects a "touch"
+func (b *s3Backend) Copy(src, dst *FileURI) error {
+	svc, err := b.session(dst.Bucket)
+	if err != nil {
+		return err
+	}
+
+	if strings.HasSuffix(src.Path, "/") {
+		return fmt.Errorf("Invalid source for bucket to bucket copy path ends in '/'")
+	}
+
+	params := &s3.CopyObjectInput{
+		Bucket:     aws.String(dst.Bucket),
+		CopySource: aws.String(fmt.Sprintf("/%s/%s", src.Bucket, *src.Key())),
+		Key:        cleanBucketDestPath(src.Path, dst.Path),
+	}
+
+	// if this is an overwrite - note that
+	if src.Bucket == dst.Bucket && *params.CopySource == fmt.Sprintf("/%s/%s", dst.Bucket, *params.Key) {
+		params.MetadataDirective = aws.String("REPLACE")
+	}
+
+	_, err = svc.CopyObject(params)
+	return err
+}
@@ -16,7 +16,13 @@ limitations under the License.
 package lib
 
 import (
+  "bytes"
+  "crypto/tls"
+  "fmt"
+  "io/ioutil"
+  "net/http"
   "strings"
+  "time"
 
   "github.com/aws/aws-sdk-go/aws"
   "github.com/aws/aws-sdk-go/aws/credentials"
@@ -31,14 +37,63 @@ const defaultRegion = "us-east-1"
 func buildSessionConfig(config *Config) aws.Config {
   // By default make sure a region is specified, this is required for S3 operations
   sessionConfig := aws.Config{Region: aws.String(defaultRegion)}
+  if config.Region != "" {
+    sessionConfig.Region = aws.String(config.Region)
+  }
 
   if config.AccessKey != "" && config.SecretKey != "" {
     sessionConfig.Credentials = credentials.NewStaticCredentials(config.AccessKey, config.SecretKey, "")
   }
 
+  if config.PathStyle {
+    sessionConfig.S3ForcePathStyle = aws.Bool(true)
+  }
+
+  if config.SkipVerify {
+    sessionConfig.HTTPClient = &http.Client{Transport: &http.Transport{
+      Proxy:               http.ProxyFromEnvironment,
+      TLSClientConfig:     &tls.Config{InsecureSkipVerify: true},
+      MaxIdleConnsPerHost: 10,
+      IdleConnTimeout:     90 * time.Second,
+    }}
+  }
+
   return sessionConfig
 }
 
+// Create the S3 client of a session, the CA bundle having priority over the
+// AWS_CA_BUNDLE environment variable
+func newS3Session(config *Config, sessionConfig aws.Config) (*s3.S3, error) {
+  opts := session.Options{
+    Config:            sessionConfig,
+    SharedConfigState: session.SharedConfigEnable,
+  }
+
+  if config.CABundle != "" {
+    pem, err := ioutil.ReadFile(config.CABundle)
+    if err != nil {
+      return nil, fmt.Errorf("Unable to read the CA bundle: %v", err)
+    }
+    opts.CustomCABundle = bytes.NewReader(pem)
+    // The SDK sets the bundle on the transport of the client, by default
+    // http.DefaultClient which is shared by the whole process
+    if opts.Config.HTTPClient == nil {
+      opts.Config.HTTPClient = &http.Client{}
+    }
+  }
+
+  sess, err := session.NewSessionWithOptions(opts)
+  if err != nil {
+    return nil, err
+  }
+  return s3.New(sess), nil
+}
+
+// Whether the buckets are not hosted by AWS but by a S3 compatible service
+func customEndpoint(config *Config) bool {
+  return config.HostBase != "" && config.HostBase != "s3.amazonaws.com" && config.HostBase != "s3.amazon.com"
+}
+
 func buildEndpointResolver(hostname string) endpoints.Resolver {
   defaultResolver := endpoints.DefaultResolver()
 
@@ -59,26 +114,28 @@ func buildEndpointResolver(hostname string) endpoints.Resolver {
 }
 
 // SessionNew - Read the config for default credentials, if not provided use environment based variables
-func SessionNew(config *Config) *s3.S3 {
+func SessionNew(config *Config) (*s3.S3, error) {
   sessionConfig := buildSessionConfig(config)
 
-  if config.HostBase != "" && config.HostBase != "s3.amazon.com" {
+  if customEndpoint(config) {
     sessionConfig.EndpointResolver = buildEndpointResolver(config.HostBase)
   }
 
-  return s3.New(session.Must(session.NewSessionWithOptions(session.Options{
-    Config:            sessionConfig,
-    SharedConfigState: session.SharedConfigEnable,
-  })))
+  return newS3Session(config, sessionConfig)
 }
 
 // SessionForBucket - For a given S3 bucket, create an approprate session that references the region
 // that this bucket is located in
+//  -- custom endpoints often don't implement GetBucketLocation, like a region
+//     given explicitly they are used as is
 func SessionForBucket(config *Config, bucket string) (*s3.S3, error) {
   sessionConfig := buildSessionConfig(config)
 
   if config.HostBucket == "" || config.HostBucket == "%(bucket)s.s3.amazonaws.com" {
-    svc := SessionNew(config)
+    svc, err := SessionNew(config)
+    if err != nil || customEndpoint(config) || config.Region != "" {
+      return svc, err
+    }
 
     if loc, err := svc.GetBucketLocation(&s3.GetBucketLocationInput{Bucket: &bucket}); err != nil {
       return nil, err
@@ -94,8 +151,5 @@ func SessionForBucket(config *Config, bucket string) (*s3.S3, error) {
     sessionConfig.EndpointResolver = buildEndpointResolver(host)
   }
 
-  return s3.New(session.Must(session.NewSessionWithOptions(session.Options{
-    Config:            sessionConfig,
-    SharedConfigState: session.SharedConfigEnable,
-  }))), nil
+  return newS3Session(config, sessionConfig)
 }
\ No newline at end of file
@@ -0,0 +1,138 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"encoding/pem"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/s3"
+)
+
+// A S3 compatible service that doesn't implement GetBucketLocation, like
+// many of them
+type fakeS3 struct {
+	lock     sync.Mutex
+	requests []string
+}
+
+func (s *fakeS3) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.lock.Lock()
+	s.requests = append(s.requests, r.Method+" "+r.URL.RequestURI())
+	s.lock.Unlock()
+
+	if _, found := r.URL.Query()["location"]; found {
+		w.WriteHeader(http.StatusNotImplemented)
+		return
+	}
+	w.Header().Set("Content-Length", "0")
+	w.WriteHeader(http.StatusOK)
+}
+
+func TestSessionForBucketEndpoint(t *testing.T) {
+	defer setTestAWSEnv()()
+
+	fake := &fakeS3{}
+	server := httptest.NewTLSServer(fake)
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	caBundle := filepath.Join(dir, "ca.pem")
+	ca := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: server.Certificate().Raw})
+	if err := ioutil.WriteFile(caBundle, ca, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name   string
+		config Config
+		err    string // of the request, not of the session
+	}{
+		{name: "CA bundle", config: Config{HostBase: server.URL, PathStyle: true, CABundle: caBundle}},
+		{name: "insecure", config: Config{HostBase: server.URL, PathStyle: true, SkipVerify: true}},
+		{name: "region", config: Config{HostBase: server.URL, PathStyle: true, SkipVerify: true, Region: "eu-central-1"}},
+		// The CA bundle of the first session is not trusted by the others
+		{name: "untrusted", config: Config{HostBase: server.URL, PathStyle: true}, err: "certificate"},
+	}
+	for _, test := range tests {
+		fake.requests = nil
+		svc, err := SessionForBucket(&test.config, "bucket")
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+			continue
+		}
+		region := "us-east-1"
+		if test.config.Region != "" {
+			region = test.config.Region
+		}
+		if aws.StringValue(svc.Config.Region) != region {
+			t.Errorf("%s: got the region %s, want %s", test.name, aws.StringValue(svc.Config.Region), region)
+		}
+
+		_, err = svc.HeadObject(&s3.HeadObjectInput{Bucket: aws.String("bucket"), Key: aws.String("index.html")})
+		if test.err != "" {
+			if err == nil || !strings.Contains(err.Error(), test.err) {
+				t.Errorf("%s: got %v, want a %s error", test.name, err, test.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", test.name, err)
+		}
+		// Path-style, and no GetBucketLocation
+		if want := []string{"HEAD /bucket/index.html"}; strings.Join(fake.requests, ",") != strings.Join(want, ",") {
+			t.Errorf("%s: got the requests %v, want %v", test.name, fake.requests, want)
+		}
+	}
+}
+
+// An explicit region is used as is on AWS too
+func TestSessionForBucketRegion(t *testing.T) {
+	defer setTestAWSEnv()()
+
+	svc, err := SessionForBucket(&Config{Region: "ap-southeast-2"}, "bucket")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if region := aws.StringValue(svc.Config.Region); region != "ap-southeast-2" {
+		t.Errorf("got the region %s", region)
+	}
+	if !strings.Contains(svc.Endpoint, "ap-southeast-2") {
+		t.Errorf("got the endpoint %s", svc.Endpoint)
+	}
+}
+
+// A missing CA bundle is reported
+func TestSessionForBucketMissingCABundle(t *testing.T) {
+	defer setTestAWSEnv()()
+
+	config := &Config{HostBase: "https://localhost:9000", CABundle: filepath.Join(os.TempDir(), "go-deploy-missing-ca.pem")}
+	if _, err := SessionForBucket(config, "bucket"); err == nil || !strings.HasPrefix(err.Error(), "Unable to read the CA bundle: ") {
+		t.Errorf("got %v", err)
+	}
+}
@@ -23,8 +23,6 @@ import (
   "time"
   "os"
   "fmt"
-  "github.com/aws/aws-sdk-go/aws"
-  "github.com/aws/aws-sdk-go/service/s3"
   "strings"
   "path/filepath"
 )
@@ -42,8 +40,29 @@ type Config struct {
   Recursive    bool
   Force        bool
   SkipExisting bool
-  HostBase   string
+  HostBase   string // S3 compatible endpoint, like MinIO or LocalStack
   HostBucket string
+  Region     string // region of the buckets, looked up with GetBucketLocation when empty
+  PathStyle  bool   // address the buckets as endpoint/bucket instead of bucket.endpoint
+  SkipVerify bool   // do not verify the TLS certificate of the endpoint
+  CABundle   string // PEM file of the certificate authorities trusted for the endpoint
+  CacheControl   string   // Cache-Control header of the uploaded files
+  ImmutableFiles []string // globs of the file names that never change, cached for a year
+  GCSEndpoint    string   // Google Cloud Storage endpoint, e.g. a fake-gcs-server
+  GCSCredentials string   // Google Cloud service account key file, defaults to the application default credentials
+  AzureAccount   string   // Azure storage account
+  AzureKey       string   // Azure storage account shared key
+  AzureSAS       string   // Azure shared access signature, used when there is no shared key
+  AzureEndpoint  string   // Azure blob service endpoint, e.g. an Azurite emulator
+  SSHKey         string   // private key of the SFTP logins, defaults to the ssh agent and the ~/.ssh/id_* keys
+  SSHKnownHosts  string   // known_hosts file verifying the SFTP hosts, defaults to ~/.ssh/known_hosts
+  GitBranch      string   // branch committed by the git deployer
+  GitOrphan      bool     // replace the history of the branch by a single commit
+  GitAuthor      string   // author of the commits, like "Name <email>"
+  GitMessage     string   // template of the commit messages
+  GitCNAME       string   // custom domain of the GitHub Pages, written to the CNAME file
+  GitNoJekyll    bool     // add a .nojekyll file to skip the Jekyll build of the GitHub Pages
+  ArchiveManifest string  // name of the SHA-256 manifest added to the archives, none when empty
 }
 
 type FileObject struct {
@@ -51,6 +70,7 @@ type FileObject struct {
   Name     string
   Size     int64
   Checksum string
+  ModTime  time.Time // last modification, zero when the backend does not keep it
 }
 
 
@@ -60,7 +80,8 @@ type Action struct {
   Src      *FileURI
   Dst      *FileURI
   Size     int64
-  Checksum string
+  Checksum    string // checksum of Dst when known
+  SrcChecksum string // checksum of Src when known
 }
 
 const (
@@ -70,6 +91,9 @@ const (
 )
 
 
+// S3Sync synchronizes bucket with srcdir, removing the files that are not
+// in srcdir anymore. Despite its name it works between any two registered
+// backends, the local file system included.
 func S3Sync(config *Config, srcdir string, bucket string) error {
   const (
     ACT_COPY     = iota
@@ -99,6 +123,15 @@ func S3Sync(config *Config, srcdir string, bucket string) error {
     src.Scheme = "file"
   }
 
+  srcBackend, err := newBackend(config, src.Scheme)
+  if err != nil {
+    return err
+  }
+  dstBackend, err := newBackend(config, dst_uri.Scheme)
+  if err != nil {
+    return err
+  }
+
 
   ///==================
   // Note: General improvement here that's pending is to make this a channel based system
@@ -116,27 +149,22 @@ func S3Sync(config *Config, srcdir string, bucket string) error {
 
   go workerProgress(chanProgress)
 
+  // The files that could not be removed fail the sync once it is done
+  removeErrors := make([]string, 0)
   wg.Add(1)
-  go workerRemove(config, &wg, chanRemove, chanProgress)
+  go workerRemove(config, dstBackend, &wg, chanRemove, chanProgress, &removeErrors)
 
   wg.Add(NUM_CHECKSUM)
   for i := 0; i < NUM_CHECKSUM; i++ {
-    go workerChecksum(config, &wg, chanChecksum, chanProgress)
+    go workerChecksum(config, srcBackend, dstBackend, &wg, chanChecksum, chanProgress)
   }
 
   wg.Add(NUM_COPY)
   for i := 0; i < NUM_COPY; i++ {
-    go workerCopy(config, &wg, chanCopy, chanProgress)
+    go workerCopy(config, srcBackend, dstBackend, &wg, chanCopy, chanProgress)
   }
 
   addWork := func(src *FileURI, src_info *FileObject, dst *FileURI, dst_info *FileObject) {
-    /*
-       if src == nil {
-           fmt.Println("NIL", " -> ", dst.String())
-       } else {
-           fmt.Println(src.String(), " -> ", dst.String())
-       }
-    */
     file_count += 1
 
     if src_info == nil {
@@ -154,7 +182,7 @@ func S3Sync(config *Config, srcdir string, bucket string) error {
       }
       estimated_bytes += src_info.Size
       chanProgress <- src_info.Size
-    } else if src_info.Size != dst_info.Size {
+    } else if src_info.Size != dst_info.Size || isNewer(src_info, dst_info) {
       chanCopy <- Action{
         Type: ACT_COPY,
         Src:  src,
@@ -164,26 +192,25 @@ func S3Sync(config *Config, srcdir string, bucket string) error {
       estimated_bytes += src_info.Size
       chanProgress <- src_info.Size
     } else if config.CheckMD5 {
-      if src_info.Checksum != "" && dst_info.Checksum != "" && src_info.Checksum != dst_info.Checksum {
-        chanCopy <- Action{
-          Type: ACT_COPY,
-          Src:  src,
-          Dst:  dst,
-          Size: src_info.Size,
+      if src_info.Checksum != "" && dst_info.Checksum != "" {
+        if src_info.Checksum != dst_info.Checksum {
+          chanCopy <- Action{
+            Type: ACT_COPY,
+            Src:  src,
+            Dst:  dst,
+            Size: src_info.Size,
+          }
+          estimated_bytes += src_info.Size
+          chanProgress <- src_info.Size
         }
-        estimated_bytes += src_info.Size
-        chanProgress <- src_info.Size
       } else {
-        check := src_info.Checksum
-        if check == "" {
-          check = dst_info.Checksum
-        }
         chanChecksum <- Action{
-          Type:     ACT_CHECKSUM,
-          Src:      src,
-          Dst:      dst,
-          Checksum: check,
-          Size:     src_info.Size,
+          Type:        ACT_CHECKSUM,
+          Src:         src,
+          Dst:         dst,
+          Checksum:    dst_info.Checksum,
+          SrcChecksum: src_info.Checksum,
+          Size:        src_info.Size,
         }
         estimated_bytes += src_info.Size
       }
@@ -203,28 +230,30 @@ func S3Sync(config *Config, srcdir string, bucket string) error {
     prefix += filepath.Base(src.Path) + "/"
     dropLen += 1
   }
+  // Only the local paths are absolute, the keys of the buckets are not
+  if dst_uri.Scheme != "file" {
+    prefix = strings.TrimPrefix(prefix, "/")
+  }
 
-  src_files, err := buildFileInfo(config, src, dropLen, prefix)
+  src_files, err := buildFileInfo(srcBackend, src, dropLen, prefix)
   if err != nil {
     return err
   }
 
-  dst_files, err := buildFileInfo(config, dst_uri, 0, "")
+  dst_files, err := buildFileInfo(dstBackend, dst_uri, 0, "")
   if err != nil {
     return err
   }
 
   // This loop will add COPIES
   for file, _ := range src_files {
-    // fmt.Println(" FILE = ", file)
     src_info := src_files[file]
     addWork(src.SetPath(src_info.Name), src_info, dst_uri.SetPath(file), dst_files[file])
   }
   // This loop will add REMOVES from DST
   for file, _ := range dst_files {
-    // fmt.Println("Remove Check", file)
     if src_info := src_files[file]; src_info == nil {
-      addWork(nil, nil, dst_uri.Join(file), dst_files[file])
+      addWork(nil, nil, dst_uri.SetPath(file), dst_files[file])
     }
   }
 
@@ -243,125 +272,49 @@ func S3Sync(config *Config, srcdir string, bucket string) error {
   close(chanProgress)
   os.Stdout.Write([]byte{'\n'})
 
+  if len(removeErrors) > 0 {
+    return fmt.Errorf("Unable to remove: %s", strings.Join(removeErrors, "; "))
+  }
   return nil
 }
 
-//  Walk either S3 or the local file system gathering files
-//    files_only == true -- only consider file names, not directories
+// A file changed without changing its size is newer than the copy, when
+// both backends keep the modification times. SFTP only keeps the seconds.
+func isNewer(src_info, dst_info *FileObject) bool {
+  if src_info.ModTime.IsZero() || dst_info.ModTime.IsZero() {
+    return false
+  }
+  return src_info.ModTime.Truncate(time.Second).After(dst_info.ModTime.Truncate(time.Second))
+}
+
+//  Walk a backend gathering files
 //
 //  dropPrefix -- number of characters to remove from the front of the filename
 //
-func buildFileInfo(config *Config, src *FileURI, dropPrefix int, addPrefix string) (map[string]*FileObject, error) {
+func buildFileInfo(backend Backend, src *FileURI, dropPrefix int, addPrefix string) (map[string]*FileObject, error) {
   files := make(map[string]*FileObject, 0)
 
-  if src.Scheme == "s3" {
-    slen := len(*src.Key()) - 1
-    if slen > 0 && (*src.Key())[slen] != '/' {
-      slen += 1
-    }
-    objs, err := remoteList(config, nil, []string{src.String()})
-    if err != nil {
-      return files, err
-    }
-    // dropPrefix -= 1 // no leading '/'
-    for idx, obj := range objs {
-      if slen > 0 && len(obj.Name) > slen && obj.Name[slen] != '/' {
-        // fmt.Printf("SKIP: %s %d %c %s\n", obj.Name, slen, obj.Name[slen], *src.Key())
-        continue
-      }
-      name := addPrefix + obj.Name[dropPrefix:]
-      files[name] = &objs[idx]
-      // fmt.Println("s3 -- name=", name, " path=", obj.Name, " file=", files[name])
-    }
-  } else {
-    // dropPrefix = len(src.Path)
-    err := filepath.Walk(src.Path, func(path string, info os.FileInfo, _ error) error {
-      if info == nil || info.IsDir() {
-        return nil
-      }
-
-      name := addPrefix + path[dropPrefix:]
-      files[name] = &FileObject{
-        Name: path,
-        Size: info.Size(),
-      }
-      // fmt.Println("local -- name=", name, " path=", path, " file=", files[name])
-
-      return nil
-    })
-
-    if err != nil {
-      return files, err
-    }
+  objs, err := backend.List(src)
+  if err != nil {
+    return files, err
   }
-  return files, nil
-}
-
-// Get the file info for a simple list of files this is used in the
-//    file -> file
-//    file(s) -> directory
-//  cases, since there is little reason to go walk huge directories trees to get information
-func getFileInfo(config *Config, srcs []*FileURI) map[FileURI]*FileObject {
-  result := make(map[FileURI]*FileObject)
-
-  for _, src := range srcs {
-    if src.Scheme == "file" {
-      info, err := os.Stat(src.Path)
-      if err != nil {
-        continue
-      }
-      result[*src] = &FileObject{
-        Name: src.Path,
-        Size: info.Size(),
-      }
-    } else {
-      bsvc, err := SessionForBucket(config, src.Bucket)
-      if err != nil {
-        continue
-      }
-
-      params := &s3.HeadObjectInput{
-        Bucket: aws.String(src.Bucket),
-        Key:    src.Key(),
-      }
-      response, err := bsvc.HeadObject(params)
-      if err != nil {
-        continue
-      }
-      result[*src] = &FileObject{
-        Name:     src.Path,
-        Size:     *response.ContentLength,
-        Checksum: *response.ETag,
-      }
-    }
+  for idx, obj := range objs {
+    name := addPrefix + obj.Name[dropPrefix:]
+    files[name] = &objs[idx]
   }
-
-  return result
+  return files, nil
 }
 
-// Compute the Amazon ETag hash for a given file
-func amazonEtagHash(path string) (string, error) {
+// Compute the Amazon ETag hash for a given content of the given size
+func amazonEtagHash(fd io.Reader, size int64) (string, error) {
   const BLOCK_SIZE = 1024 * 1024 * 5    // 5MB
   const START_BLOCKS = 1024 * 1024 * 16 // 16MB
 
-  if strings.HasPrefix(path, "file://") {
-    path = path[7:]
-  }
-  fd, err := os.Open(path)
-  if err != nil {
-    return "", err
-  }
-  defer fd.Close()
-
-  info, err := fd.Stat()
-  if err != nil {
-    return "", err
-  }
-
+  var err error
   hasher := md5.New()
   count := 0
 
-  if info.Size() > START_BLOCKS {
+  if size > START_BLOCKS {
     for err != io.EOF {
       count += 1
       parthasher := md5.New()
@@ -389,9 +342,9 @@ func amazonEtagHash(path string) (string, error) {
 }
 
 //  GoRoutine workers -- copy from src to dst
-func workerCopy(config *Config, wg *sync.WaitGroup, jobs <-chan Action, progress chan int64) {
+func workerCopy(config *Config, srcBackend, dstBackend Backend, wg *sync.WaitGroup, jobs <-chan Action, progress chan int64) {
   for item := range jobs {
-    err := copyFile(config, item.Src, item.Dst, true)
+    err := copyFile(config, srcBackend, dstBackend, item.Src, item.Dst, item.Size)
     if err != nil {
       fmt.Printf("\nUnable to copy: %v\n", err)
       os.Exit(1)
@@ -401,34 +354,18 @@ func workerCopy(config *Config, wg *sync.WaitGroup, jobs <-chan Action, progress
   wg.Done()
 }
 
-//  GoRoutine workers -- remove file
-func workerRemove(config *Config, wg *sync.WaitGroup, jobs <-chan Action, progress chan int64) {
-  objects := make([]*s3.ObjectIdentifier, 0)
+//  GoRoutine workers -- remove file, the failures are added to errors
+func workerRemove(config *Config, backend Backend, wg *sync.WaitGroup, jobs <-chan Action, progress chan int64, errors *[]string) {
+  uris := make([]*FileURI, 0)
 
   // Helper to remove the actual objects
-  doDelete := func(last *FileURI) error {
-    bsvc, err := SessionForBucket(config, last.Bucket)
-    if err != nil {
-      return err
+  doDelete := func() {
+    if err := backend.Delete(uris); err != nil {
+      *errors = append(*errors, err.Error())
     }
-
-    params := &s3.DeleteObjectsInput{
-      Bucket: aws.String(last.Bucket), // Required
-      Delete: &s3.Delete{ // Required
-        Objects: objects,
-      },
-    }
-
-    if _, err := bsvc.DeleteObjects(params); err != nil {
-      return err
-    }
-
-    objects = make([]*s3.ObjectIdentifier, 0)
-    return nil
+    uris = make([]*FileURI, 0)
   }
 
-  var last *FileURI
-
   for item := range jobs {
     if config.Verbose {
       fmt.Printf("Remove %s\n", item.Dst.String())
@@ -436,56 +373,55 @@ func workerRemove(config *Config, wg *sync.WaitGroup, jobs <-chan Action, progre
     if config.DryRun {
       continue
     }
-    last = item.Dst
 
-    if item.Dst.Scheme == "file" {
-      if err := os.Remove(item.Dst.Path); err != nil {
-        // return err
-      }
-    } else {
-      objects = append(objects, &s3.ObjectIdentifier{Key: item.Dst.Key()})
-      if len(objects) == 500 {
-        if err := doDelete(last); err != nil {
-          // return err
-        }
-      }
+    uris = append(uris, item.Dst)
+    if len(uris) == 500 {
+      doDelete()
     }
   }
 
-  if len(objects) != 0 {
-    if err := doDelete(last); err != nil {
-      // return err
-    }
+  if len(uris) != 0 {
+    doDelete()
   }
   wg.Done()
 }
 
 //  GoRoutine workers -- check checksum and copy if needed
-func workerChecksum(config *Config, wg *sync.WaitGroup, jobs <-chan Action, progress chan int64) {
+func workerChecksum(config *Config, srcBackend, dstBackend Backend, wg *sync.WaitGroup, jobs <-chan Action, progress chan int64) {
+  // Checksum of a file, computed from its content when the backend does not
+  // know it, in the format of the checksum known by the other backend
+  checksum := func(backend Backend, uri *FileURI, known string, other Backend, like string, size int64) (string, error) {
+    if known != "" {
+      return known, nil
+    }
+    r, err := backend.Get(uri)
+    if err != nil {
+      return "", err
+    }
+    defer r.Close()
+    if c, ok := other.(Checksummer); ok && like != "" {
+      return c.Checksum(r, size, like)
+    }
+    return amazonEtagHash(r, size)
+  }
+
   for item := range jobs {
-    var (
-      hash string
-      err  error
-    )
-
-    if item.Dst.Scheme == "s3" {
-      hash, err = amazonEtagHash(item.Src.Path)
-      if err != nil {
-        // return fmt.Errorf("Unable to get checksum of local file %s", item.Src.String())
-        fmt.Printf("Unable to get checksum of local file %s\n", item.Src.String())
-      }
-    } else {
-      hash, err = amazonEtagHash(item.Dst.Path)
-      if err != nil {
-        // return fmt.Errorf("Unable to get checksum of local file %s", item.Dst.String())
-        fmt.Printf("Unable to get checksum of local file %s\n", item.Src.String())
-      }
+    srcHash, err := checksum(srcBackend, item.Src, item.SrcChecksum, dstBackend, item.Checksum, item.Size)
+    if err != nil {
+      fmt.Printf("Unable to get checksum of %s\n", item.Src.String())
+    }
+    dstHash, err := checksum(dstBackend, item.Dst, item.Checksum, srcBackend, item.SrcChecksum, item.Size)
+    if err != nil {
+      fmt.Printf("Unable to get checksum of %s\n", item.Dst.String())
     }
 
-    // fmt.Printf("Got checksum %s local=%s remote=%s\n", item.Src.String(), hash, item.Checksum)
-    if len(item.Checksum) <= 2 || hash != item.Checksum[1:len(item.Checksum)-1] {
+    // fmt.Printf("Got checksum %s src=%s dst=%s\n", item.Src.String(), srcHash, dstHash)
+    if srcHash == "" || srcHash != dstHash {
       progress <- item.Size
-      copyFile(config, item.Src, item.Dst, true)
+      if err := copyFile(config, srcBackend, dstBackend, item.Src, item.Dst, item.Size); err != nil {
+        fmt.Printf("\nUnable to copy: %v\n", err)
+        os.Exit(1)
+      }
       progress <- -item.Size
     }
   }
@@ -556,61 +492,3 @@ func workerProgress(updates <-chan int64) {
     os.Stdout.Sync()
   }
 }
-
-
-func remotePager(config *Config, svc *s3.S3, uri string, delim bool, pager func(page *s3.ListObjectsV2Output)) error {
-  u, err := FileURINew(uri)
-  if err != nil || u.Scheme != "s3" {
-    return fmt.Errorf("requires buckets to be prefixed with s3://")
-  }
-
-  params := &s3.ListObjectsV2Input{
-    Bucket:  aws.String(u.Bucket), // Required
-    MaxKeys: aws.Int64(1000),
-  }
-  if u.Path != "" && u.Path != "/" {
-    params.Prefix = u.Key()
-  }
-  if delim {
-    params.Delimiter = aws.String("/")
-  }
-
-  wrapper := func(page *s3.ListObjectsV2Output, lastPage bool) bool {
-    pager(page)
-    return true
-  }
-
-  if svc == nil {
-    svc = SessionNew(config)
-  }
-
-  bsvc, err := SessionForBucket(config, u.Bucket)
-  if err != nil {
-    return err
-  }
-  if err := bsvc.ListObjectsV2Pages(params, wrapper); err != nil {
-    return err
-  }
-  return nil
-}
-
-
-func remoteList(config *Config, svc *s3.S3, args []string) ([]FileObject, error) {
-  result := make([]FileObject, 0)
-
-  for _, arg := range args {
-    pager := func(page *s3.ListObjectsV2Output) {
-      for _, obj := range page.Contents {
-        result = append(result, FileObject{
-          Name:     *obj.Key,
-          Size:     *obj.Size,
-          Checksum: *obj.ETag,
-        })
-      }
-    }
-
-    remotePager(config, svc, arg, false, pager)
-  }
-
-  return result, nil
-}
\ No newline at end of file
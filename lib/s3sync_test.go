@@ -0,0 +1,231 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// A bucket in memory, its files are named by their keys like the ones of s3
+type memBackend struct {
+	mutex  sync.Mutex
+	files  map[string][]byte
+	locked map[string]bool // keys that cannot be deleted
+}
+
+var testBucket = &memBackend{files: make(map[string][]byte)}
+
+func init() {
+	RegisterBackend("mem", func(config *Config) (Backend, error) { return testBucket, nil })
+}
+
+func (b *memBackend) List(uri *FileURI) ([]FileObject, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	prefix := strings.TrimSuffix(*uri.Key(), "/")
+	files := make([]FileObject, 0)
+	for key, content := range b.files {
+		if prefix == "" || strings.HasPrefix(key, prefix+"/") {
+			files = append(files, FileObject{Name: key, Size: int64(len(content))})
+		}
+	}
+	return files, nil
+}
+
+func (b *memBackend) Stat(uri *FileURI) (*FileObject, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	content, found := b.files[*uri.Key()]
+	if !found {
+		return nil, nil
+	}
+	return &FileObject{Name: *uri.Key(), Size: int64(len(content))}, nil
+}
+
+func (b *memBackend) Put(uri *FileURI, r io.Reader, size int64) error {
+	content, err := ioutil.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.files[*uri.Key()] = content
+	return nil
+}
+
+func (b *memBackend) Get(uri *FileURI) (io.ReadCloser, error) {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	content, found := b.files[*uri.Key()]
+	if !found {
+		return nil, fmt.Errorf("%s not found", uri.String())
+	}
+	return ioutil.NopCloser(bytes.NewReader(content)), nil
+}
+
+func (b *memBackend) Delete(uris []*FileURI) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+
+	for _, uri := range uris {
+		if _, found := b.files[*uri.Key()]; !found {
+			return fmt.Errorf("%s not found", uri.String())
+		}
+		if b.locked[*uri.Key()] {
+			return fmt.Errorf("%s is locked", uri.String())
+		}
+		delete(b.files, *uri.Key())
+	}
+	return nil
+}
+
+func (b *memBackend) Copy(src, dst *FileURI) error {
+	b.mutex.Lock()
+	defer b.mutex.Unlock()
+	b.files[*dst.Key()] = b.files[*src.Key()]
+	return nil
+}
+
+func (b *memBackend) keys() []string {
+	keys := make([]string, 0, len(b.files))
+	for key := range b.files {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+	return keys
+}
+
+// The stale files of a nested prefix are removed by their own keys
+func TestS3SyncRemovesStaleFilesUnderNestedPrefix(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(t, srcDir, map[string]string{
+		"index.html":    "<html></html>",
+		"js/main.js":    "main()",
+		"js/changed.js": "new content",
+	})
+
+	testBucket.files = map[string][]byte{
+		"apps/web/index.html":    []byte("<html></html>"),
+		"apps/web/js/changed.js": []byte("old"),
+		"apps/web/js/stale.js":   []byte("stale()"),
+		"apps/web/stale.css":     []byte("a{}"),
+		"apps/other/keep.txt":    []byte("not synced"),
+		"apps/web.txt":           []byte("not synced"),
+	}
+
+	if err := S3Sync(&Config{}, srcDir+"/", "mem://bucket/apps/web"); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{
+		"apps/other/keep.txt",
+		"apps/web.txt",
+		"apps/web/index.html",
+		"apps/web/js/changed.js",
+		"apps/web/js/main.js",
+	}
+	if keys := testBucket.keys(); !reflect.DeepEqual(keys, want) {
+		t.Errorf("got %v, want %v", keys, want)
+	}
+	if content := string(testBucket.files["apps/web/js/changed.js"]); content != "new content" {
+		t.Errorf("js/changed.js: got %q", content)
+	}
+}
+
+// The files that cannot be removed fail the sync, the other changes being
+// made
+func TestS3SyncReportsRemoveErrors(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(t, srcDir, map[string]string{"index.html": "<html>new</html>"})
+
+	testBucket.files = map[string][]byte{
+		"web/index.html": []byte("<html></html>"),
+		"web/stale.js":   []byte("stale()"),
+	}
+	testBucket.locked = map[string]bool{"web/stale.js": true}
+	defer func() { testBucket.locked = nil }()
+
+	err = S3Sync(&Config{}, srcDir+"/", "mem://bucket/web")
+	if want := "Unable to remove: mem://bucket/web/stale.js is locked"; err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	if content := string(testBucket.files["web/index.html"]); content != "<html>new</html>" {
+		t.Errorf("index.html: got %q", content)
+	}
+}
+
+func TestFileBackendList(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"index.html": "<html></html>", "js/main.js": "main()"})
+
+	backend := fileBackend{}
+	files, err := backend.List(&FileURI{Scheme: "file", Path: dir})
+	if err != nil {
+		t.Fatal(err)
+	}
+	names := make([]string, 0)
+	for _, file := range files {
+		names = append(names, file.Name)
+	}
+	sort.Strings(names)
+	if want := []string{dir + "/index.html", dir + "/js/main.js"}; !reflect.DeepEqual(names, want) {
+		t.Errorf("got %v, want %v", names, want)
+	}
+
+	// A destination directory is created by the first sync
+	files, err = backend.List(&FileURI{Scheme: "file", Path: dir + "/missing"})
+	if err != nil || len(files) != 0 {
+		t.Errorf("missing directory: got %v %v", files, err)
+	}
+
+	// The other errors are reported
+	if _, err := backend.List(&FileURI{Scheme: "file", Path: dir + "/index.html/sub"}); err == nil {
+		t.Errorf("expected an error below a file")
+	}
+	if os.Geteuid() != 0 {
+		if err := os.Chmod(dir+"/js", 0); err != nil {
+			t.Fatal(err)
+		}
+		defer os.Chmod(dir+"/js", 0755)
+		if _, err := backend.List(&FileURI{Scheme: "file", Path: dir}); err == nil {
+			t.Errorf("expected an error for an unreadable directory")
+		}
+	}
+}
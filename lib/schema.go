@@ -0,0 +1,229 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Suffix of the schema file associated to a dotenv file
+const schemaExt = ".schema"
+
+// Declaration of a variable in a schema file
+type varSchema struct {
+	Name      string
+	Required  bool
+	Type      string // string, int, number, bool, url, json, enum or regex
+	Enum      []string
+	Pattern   *regexp.Regexp
+	NoDefault bool // the .env value may not be used in production
+}
+
+// Load a schema file. Each line declares a variable followed by its
+// attributes, blank lines and # comments are ignored:
+//
+//   API_URL    required url no-default
+//   LOG_LEVEL  enum(debug, info, warn, error)
+//   MAX_ITEMS  optional int
+//   SLUG       regex(^[a-z-]+$)
+//   TITLE      regex(^[A-Z][a-z]* [A-Z][a-z]*$)
+func loadSchema(file string) ([]*varSchema, error) {
+	fd, err := os.Open(file)
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+
+	schema := make([]*varSchema, 0)
+	scanner := bufio.NewScanner(fd)
+	line := 0
+	for scanner.Scan() {
+		line++
+		fields, err := schemaFields(scanner.Text())
+		if err != nil {
+			return nil, fmt.Errorf("%s:%d: %v", file, line, err)
+		}
+		if len(fields) == 0 {
+			continue
+		}
+
+		v := &varSchema{Name: fields[0], Type: "string"}
+		for _, attr := range fields[1:] {
+			if err := v.parseAttribute(attr); err != nil {
+				return nil, fmt.Errorf("%s:%d: %s: %v", file, line, v.Name, err)
+			}
+		}
+		schema = append(schema, v)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return schema, nil
+}
+
+// Split a schema line on the spaces out of the parentheses, so that
+// enum(a, b) and regex(^a b$) are single attributes. A backslash escapes a
+// parenthesis of a regex, and a # out of the parentheses starts a comment.
+func schemaFields(line string) ([]string, error) {
+	fields := make([]string, 0)
+	var field strings.Builder
+	depth := 0
+	for i := 0; i < len(line); i++ {
+		c := line[i]
+		switch {
+		case depth == 0 && (c == ' ' || c == '\t'):
+			if field.Len() > 0 {
+				fields = append(fields, field.String())
+				field.Reset()
+			}
+			continue
+		case depth == 0 && c == '#' && field.Len() == 0:
+			return fields, nil
+		case c == '\\' && depth > 0 && i+1 < len(line):
+			field.WriteByte(c)
+			i++
+			c = line[i]
+		case c == '(':
+			depth++
+		case c == ')':
+			if depth == 0 {
+				return nil, fmt.Errorf("unbalanced parenthesis in %s", field.String()+line[i:])
+			}
+			depth--
+		}
+		field.WriteByte(c)
+	}
+	if depth > 0 {
+		return nil, fmt.Errorf("unbalanced parenthesis in %s", field.String())
+	}
+	if field.Len() > 0 {
+		fields = append(fields, field.String())
+	}
+	return fields, nil
+}
+
+func (v *varSchema) parseAttribute(attr string) error {
+	switch {
+	case attr == "required":
+		v.Required = true
+	case attr == "optional":
+		v.Required = false
+	case attr == "no-default":
+		v.NoDefault = true
+	case attr == "string" || attr == "int" || attr == "number" || attr == "bool" || attr == "url" || attr == "json":
+		v.Type = attr
+	case strings.HasPrefix(attr, "enum(") && strings.HasSuffix(attr, ")"):
+		v.Type = "enum"
+		v.Enum = strings.Split(attr[5:len(attr)-1], ",")
+		for i := range v.Enum {
+			v.Enum[i] = strings.TrimSpace(v.Enum[i])
+		}
+	case strings.HasPrefix(attr, "regex(") && strings.HasSuffix(attr, ")"):
+		re, err := regexp.Compile("^(?:" + attr[6:len(attr)-1] + ")$")
+		if err != nil {
+			return fmt.Errorf("invalid regex: %v", err)
+		}
+		v.Type = "regex"
+		v.Pattern = re
+	default:
+		return fmt.Errorf("unknown attribute %s", attr)
+	}
+	return nil
+}
+
+// Check a value against the declared type
+func (v *varSchema) check(value string) error {
+	switch v.Type {
+	case "int":
+		if _, err := strconv.ParseInt(value, 10, 64); err != nil {
+			return fmt.Errorf("%q is not an integer", value)
+		}
+	case "number":
+		if _, err := strconv.ParseFloat(value, 64); err != nil {
+			return fmt.Errorf("%q is not a number", value)
+		}
+	case "bool":
+		if _, err := strconv.ParseBool(value); err != nil {
+			return fmt.Errorf("%q is not a boolean", value)
+		}
+	case "json":
+		if !json.Valid([]byte(value)) {
+			return fmt.Errorf("%q is not valid JSON", value)
+		}
+	case "url":
+		u, err := url.Parse(value)
+		if err != nil || u.Scheme == "" || u.Host == "" {
+			return fmt.Errorf("%q is not an absolute URL", value)
+		}
+	case "enum":
+		for _, allowed := range v.Enum {
+			if value == allowed {
+				return nil
+			}
+		}
+		return fmt.Errorf("%q is not one of %s", value, strings.Join(v.Enum, ", "))
+	case "regex":
+		if !v.Pattern.MatchString(value) {
+			return fmt.Errorf("%q does not match %s", value, v.Pattern.String())
+		}
+	}
+	return nil
+}
+
+// Validate the resolved variables against a schema, all the problems are
+// reported at once. layers lists the dotenv files holding the defaults.
+func validateVars(vars []EnvVar, schema []*varSchema, layers []string, production bool) error {
+	isDefault := make(map[string]bool)
+	for _, layer := range layers {
+		isDefault[layer] = true
+	}
+
+	byName := make(map[string]EnvVar)
+	for _, v := range vars {
+		byName[v.Name] = v
+	}
+
+	problems := make([]string, 0)
+	for _, s := range schema {
+		name := s.Name
+		v, found := byName[name]
+
+		switch {
+		case !found || v.Value == "":
+			if s.Required {
+				problems = append(problems, name+": is required")
+			}
+		case production && s.NoDefault && isDefault[v.Source]:
+			problems = append(problems, name+": must be set in the environment in production, the .env default cannot be used")
+		default:
+			if err := s.check(v.Value); err != nil {
+				problems = append(problems, name+": "+err.Error())
+			}
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Invalid configuration: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
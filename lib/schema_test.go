@@ -0,0 +1,229 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func writeSchema(t *testing.T, content string) string {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	file := filepath.Join(dir, ".env.schema")
+	if err := ioutil.WriteFile(file, []byte(content), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return file
+}
+
+func TestSchemaFields(t *testing.T) {
+	tests := []struct {
+		line   string
+		fields []string
+	}{
+		{"", []string{}},
+		{"   # comment", []string{}},
+		{"API_URL required url", []string{"API_URL", "required", "url"}},
+		{"\tAPI_URL\t required  url # the API", []string{"API_URL", "required", "url"}},
+		{"LEVEL enum(debug, info, warn)", []string{"LEVEL", "enum(debug, info, warn)"}},
+		{"TITLE regex(^[A-Z][a-z]* [A-Z][a-z]*$) required", []string{"TITLE", "regex(^[A-Z][a-z]* [A-Z][a-z]*$)", "required"}},
+		{"TAG regex((a|b) (c|d)#x)", []string{"TAG", "regex((a|b) (c|d)#x)"}},
+		{`PAREN regex(\) \()`, []string{"PAREN", `regex(\) \()`}},
+		{"ANCHOR regex(a#b)", []string{"ANCHOR", "regex(a#b)"}},
+	}
+	for _, test := range tests {
+		fields, err := schemaFields(test.line)
+		if err != nil || !reflect.DeepEqual(fields, test.fields) {
+			t.Errorf("%q: got %q %v, want %q", test.line, fields, err, test.fields)
+		}
+	}
+}
+
+func TestLoadSchema(t *testing.T) {
+	file := writeSchema(t, `
+# name     attributes
+API_URL    required url no-default
+LOG_LEVEL  enum(debug, info,warn , error)
+MAX_ITEMS  optional int
+RATIO      number
+FEATURE_X  bool
+OPTIONS    json
+TITLE      regex(^[A-Z][a-z]* [A-Z][a-z]*$)   # two capitalized words
+NAME
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+
+	schema, err := loadSchema(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	type declared struct {
+		name      string
+		required  bool
+		typ       string
+		enum      []string
+		pattern   string
+		noDefault bool
+	}
+	want := []declared{
+		{"API_URL", true, "url", nil, "", true},
+		{"LOG_LEVEL", false, "enum", []string{"debug", "info", "warn", "error"}, "", false},
+		{"MAX_ITEMS", false, "int", nil, "", false},
+		{"RATIO", false, "number", nil, "", false},
+		{"FEATURE_X", false, "bool", nil, "", false},
+		{"OPTIONS", false, "json", nil, "", false},
+		{"TITLE", false, "regex", nil, "^(?:^[A-Z][a-z]* [A-Z][a-z]*$)$", false},
+		{"NAME", false, "string", nil, "", false},
+	}
+	got := make([]declared, 0)
+	for _, v := range schema {
+		d := declared{v.Name, v.Required, v.Type, v.Enum, "", v.NoDefault}
+		if v.Pattern != nil {
+			d.pattern = v.Pattern.String()
+		}
+		got = append(got, d)
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestLoadSchemaErrors(t *testing.T) {
+	tests := []struct {
+		content string
+		err     string
+	}{
+		{"A required\nB mandatory", ":2: B: unknown attribute mandatory"},
+		{"A regex([a-z)", ":1: A: invalid regex: error parsing regexp: missing closing ]: `[a-z)$`"},
+		{"\nA enum(a, b", ":2: unbalanced parenthesis in enum(a, b"},
+		{"A regex(a)) required", ":1: unbalanced parenthesis in regex(a)) required"},
+	}
+	for _, test := range tests {
+		file := writeSchema(t, test.content)
+		defer os.RemoveAll(filepath.Dir(file))
+
+		_, err := loadSchema(file)
+		if err == nil || err.Error() != file+test.err {
+			t.Errorf("%q: got %v, want %s%s", test.content, err, file, test.err)
+		}
+	}
+}
+
+func TestValidateVars(t *testing.T) {
+	file := writeSchema(t, `
+API_URL    required url no-default
+LOG_LEVEL  enum(debug, info, warn, error)
+MAX_ITEMS  int
+RATIO      number
+FEATURE_X  bool
+OPTIONS    json
+TITLE      regex(^[A-Z][a-z]* [A-Z][a-z]*$)
+`)
+	defer os.RemoveAll(filepath.Dir(file))
+	schema, err := loadSchema(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	valid := map[string]string{
+		"API_URL":   "https://api.example.com",
+		"LOG_LEVEL": "warn",
+		"MAX_ITEMS": "50",
+		"RATIO":     "-1.5e3",
+		"FEATURE_X": "true",
+		"OPTIONS":   `{"a": [1, 2]}`,
+		"TITLE":     "Hello World",
+	}
+	tests := []struct {
+		name       string
+		values     map[string]string // overrides of the valid values, empty to remove
+		source     string            // source of API_URL
+		production bool
+		problems   []string
+	}{
+		{name: "valid"},
+		{name: "valid in production", source: "env", production: true},
+		{
+			name:     "missing",
+			values:   map[string]string{"API_URL": "", "LOG_LEVEL": "", "TITLE": ""},
+			problems: []string{"API_URL: is required"},
+		},
+		{
+			name: "types",
+			values: map[string]string{
+				"API_URL":   "/relative",
+				"LOG_LEVEL": "verbose",
+				"MAX_ITEMS": "1.5",
+				"RATIO":     "many",
+				"FEATURE_X": "yes",
+				"OPTIONS":   "{a: 1}",
+				"TITLE":     "hello world",
+			},
+			problems: []string{
+				`API_URL: "/relative" is not an absolute URL`,
+				`LOG_LEVEL: "verbose" is not one of debug, info, warn, error`,
+				`MAX_ITEMS: "1.5" is not an integer`,
+				`RATIO: "many" is not a number`,
+				`FEATURE_X: "yes" is not a boolean`,
+				`OPTIONS: "{a: 1}" is not valid JSON`,
+				`TITLE: "hello world" does not match ^(?:^[A-Z][a-z]* [A-Z][a-z]*$)$`,
+			},
+		},
+		{
+			name:       "default in production",
+			source:     ".env",
+			production: true,
+			problems:   []string{"API_URL: must be set in the environment in production, the .env default cannot be used"},
+		},
+		{name: "default out of production", source: ".env"},
+	}
+
+	for _, test := range tests {
+		vars := make([]EnvVar, 0)
+		for name, value := range valid {
+			if override, found := test.values[name]; found {
+				value = override
+			}
+			if value == "" {
+				continue
+			}
+			source := ".env"
+			if name == "API_URL" && test.source != "" {
+				source = test.source
+			}
+			vars = append(vars, EnvVar{Name: name, Value: value, Source: source})
+		}
+
+		err := validateVars(vars, schema, []string{".env", ".env.local"}, test.production)
+		if len(test.problems) == 0 {
+			if err != nil {
+				t.Errorf("%s: %v", test.name, err)
+			}
+			continue
+		}
+		want := "Invalid configuration: " + strings.Join(test.problems, "; ")
+		if err == nil || err.Error() != want {
+			t.Errorf("%s: got %v, want %s", test.name, err, want)
+		}
+	}
+}
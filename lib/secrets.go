@@ -0,0 +1,138 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"math"
+	"net/url"
+	"regexp"
+	"strings"
+)
+
+// A rule detecting a variable that looks like a secret
+type secretRule struct {
+	Name  string
+	Match func(v EnvVar) bool
+}
+
+var (
+	secretNameRe = regexp.MustCompile(`(?i)(PASSWORD|PASSWD|SECRET|PRIVATE_?KEY|TOKEN|CREDENTIAL)`)
+	awsKeyRe     = regexp.MustCompile(`\b(AKIA|ASIA)[0-9A-Z]{16}\b`)
+	jwtRe        = regexp.MustCompile(`\beyJ[A-Za-z0-9_-]+\.eyJ[A-Za-z0-9_-]+\.[A-Za-z0-9_-]*`)
+	privateKeyRe = regexp.MustCompile(`-----BEGIN [A-Z ]*PRIVATE KEY-----`)
+	tokenRe      = regexp.MustCompile(`[A-Za-z0-9+_=-]+`)
+	urlRe        = regexp.MustCompile(`[A-Za-z][A-Za-z0-9+.-]*://[^\s,"'<>]+`)
+	hexRe        = regexp.MustCompile(`^[0-9a-fA-F]+$`)
+	// Webhook URLs are secrets whose tokens are part of the path
+	webhookRe = regexp.MustCompile(`(?i)\bhttps?://(hooks\.slack\.com/(services|workflows|triggers)/|(ptb\.|canary\.)?discord(app)?\.com/api/webhooks/|[a-z0-9-]+\.webhook\.office\.com/|outlook\.office(365)?\.com/webhook/|hooks\.zapier\.com/hooks/catch/|chat\.googleapis\.com/v1/spaces/[^/\s]+/messages\?)`)
+)
+
+// Rules applied by CheckSecrets
+var secretRules = []secretRule{
+	{"secret-name", func(v EnvVar) bool { return v.Value != "" && secretNameRe.MatchString(v.Name) }},
+	{"aws-access-key", func(v EnvVar) bool { return awsKeyRe.MatchString(v.Value) }},
+	{"jwt", func(v EnvVar) bool { return jwtRe.MatchString(v.Value) }},
+	{"private-key", func(v EnvVar) bool { return privateKeyRe.MatchString(v.Value) }},
+	{"webhook-url", func(v EnvVar) bool { return webhookRe.MatchString(v.Value) }},
+	{"high-entropy", func(v EnvVar) bool { return hasHighEntropyToken(v.Value) }},
+}
+
+// CheckSecrets fails when a variable looks like a secret, unless its name is
+// explicitly allowed: the generated config is public.
+func CheckSecrets(vars []EnvVar, allowed []string) error {
+	allow := make(map[string]bool)
+	for _, name := range allowed {
+		allow[name] = true
+	}
+
+	problems := make([]string, 0)
+	for _, v := range vars {
+		if allow[v.Name] {
+			continue
+		}
+		matched := make([]string, 0)
+		for _, rule := range secretRules {
+			if rule.Match(v) {
+				matched = append(matched, rule.Name)
+			}
+		}
+		if len(matched) > 0 {
+			problems = append(problems, fmt.Sprintf("%s (%s)", v.Name, strings.Join(matched, ", ")))
+		}
+	}
+
+	if len(problems) > 0 {
+		return fmt.Errorf("Refusing to publish variables that look like secrets: %s", strings.Join(problems, "; "))
+	}
+	return nil
+}
+
+// Look for long random looking tokens, like API secrets. Hexadecimal tokens
+// have a lower maximum entropy and get a lower threshold. The hosts and user
+// names of the URLs are public, like the key of a Sentry DSN, and so are the
+// file names of their paths, which often carry a content hash. The other
+// path segments, the password, query and fragment are checked.
+func hasHighEntropyToken(value string) bool {
+	value = urlRe.ReplaceAllStringFunc(value, func(s string) string {
+		u, err := url.Parse(s)
+		if err != nil {
+			return s
+		}
+		parts := []string{u.RawQuery, u.Fragment}
+		for _, segment := range strings.Split(u.EscapedPath(), "/") {
+			if !strings.Contains(segment, ".") {
+				parts = append(parts, segment)
+			}
+		}
+		if u.User != nil {
+			if password, found := u.User.Password(); found {
+				parts = append(parts, password)
+			}
+		}
+		return " " + strings.Join(parts, " ") + " "
+	})
+
+	for _, token := range tokenRe.FindAllString(value, -1) {
+		switch {
+		case len(token) >= 32 && hexRe.MatchString(token):
+			if shannonEntropy(token) >= 3.0 {
+				return true
+			}
+		case len(token) >= 20:
+			if shannonEntropy(token) >= 4.0 {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Shannon entropy of s, in bits per character
+func shannonEntropy(s string) float64 {
+	counts := make(map[rune]int)
+	for _, c := range s {
+		counts[c]++
+	}
+
+	entropy := 0.0
+	n := float64(len(s))
+	for _, count := range counts {
+		p := float64(count) / n
+		entropy -= p * math.Log2(p)
+	}
+	return entropy
+}
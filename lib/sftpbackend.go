@@ -0,0 +1,189 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"path"
+	"strings"
+	"sync"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+)
+
+func init() {
+	RegisterBackend("sftp", newSFTPBackend)
+}
+
+// Directories of SSH servers, sftp://user@host/path being an absolute path
+// and sftp://user@host/~/path a path relative to the login directory. The
+// connections are opened on first use and shared by the workers.
+type sftpBackend struct {
+	config  *Config
+	lock    sync.Mutex
+	clients map[string]*sftp.Client // by user@host:port
+}
+
+func newSFTPBackend(config *Config) (Backend, error) {
+	return &sftpBackend{config: config, clients: make(map[string]*sftp.Client)}, nil
+}
+
+// Path of a key on the server
+func remotePath(key string) string {
+	if key == "~" {
+		return "."
+	}
+	if strings.HasPrefix(key, "~/") {
+		return key[2:]
+	}
+	return "/" + key
+}
+
+func (b *sftpBackend) client(uri *FileURI) (*sftp.Client, error) {
+	login := sshLogin(uri.User)
+	addr := sshAddress(uri.Bucket)
+
+	b.lock.Lock()
+	defer b.lock.Unlock()
+
+	id := login + "@" + addr
+	if client, found := b.clients[id]; found {
+		return client, nil
+	}
+
+	clientConfig, closeAgent, err := sshClientConfig(b.config, uri.User, addr)
+	if err != nil {
+		return nil, err
+	}
+	conn, err := ssh.Dial("tcp", addr, clientConfig)
+	closeAgent()
+	if err != nil {
+		return nil, fmt.Errorf("Unable to connect to %s: %v", id, err)
+	}
+	client, err := sftp.NewClient(conn)
+	if err != nil {
+		conn.Close()
+		return nil, fmt.Errorf("Unable to start SFTP on %s: %v", id, err)
+	}
+	b.clients[id] = client
+	return client, nil
+}
+
+// The SFTP servers don't know any checksum, the sync compares the sizes and
+// the modification times, or the contents with --check-md5
+func (b *sftpBackend) List(uri *FileURI) ([]FileObject, error) {
+	client, err := b.client(uri)
+	if err != nil {
+		return nil, err
+	}
+
+	key := *uri.Key()
+	root := remotePath(key)
+	files := make([]FileObject, 0)
+	walker := client.Walk(root)
+	for walker.Step() {
+		if err := walker.Err(); err != nil {
+			if walker.Path() == root && os.IsNotExist(err) {
+				return files, nil
+			}
+			return nil, err
+		}
+		if walker.Stat().IsDir() {
+			continue
+		}
+
+		rel := walker.Path()
+		if root != "." {
+			rel = strings.TrimPrefix(rel, root)
+		}
+		files = append(files, FileObject{
+			Name:    path.Join(key, rel),
+			Size:    walker.Stat().Size(),
+			ModTime: walker.Stat().ModTime(),
+		})
+	}
+	return files, nil
+}
+
+func (b *sftpBackend) Stat(uri *FileURI) (*FileObject, error) {
+	client, err := b.client(uri)
+	if err != nil {
+		return nil, err
+	}
+	info, err := client.Stat(remotePath(*uri.Key()))
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &FileObject{Name: *uri.Key(), Size: info.Size(), ModTime: info.ModTime()}, nil
+}
+
+func (b *sftpBackend) Put(uri *FileURI, r io.Reader, size int64) error {
+	client, err := b.client(uri)
+	if err != nil {
+		return err
+	}
+
+	file := remotePath(*uri.Key())
+	if err := client.MkdirAll(path.Dir(file)); err != nil {
+		return fmt.Errorf("Error making directory dir=%s error=%v", path.Dir(file), err)
+	}
+	fd, err := client.Create(file)
+	if err != nil {
+		return fmt.Errorf("Unable to create %s: %v", uri.String(), err)
+	}
+	if _, err := io.Copy(fd, r); err != nil {
+		fd.Close()
+		return err
+	}
+	return fd.Close()
+}
+
+func (b *sftpBackend) Get(uri *FileURI) (io.ReadCloser, error) {
+	client, err := b.client(uri)
+	if err != nil {
+		return nil, err
+	}
+	return client.Open(remotePath(*uri.Key()))
+}
+
+func (b *sftpBackend) Delete(uris []*FileURI) error {
+	for _, uri := range uris {
+		client, err := b.client(uri)
+		if err != nil {
+			return err
+		}
+		if err := client.Remove(remotePath(*uri.Key())); err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return nil
+}
+
+// SFTP has no copy, the content goes through the client
+func (b *sftpBackend) Copy(src, dst *FileURI) error {
+	r, err := b.Get(src)
+	if err != nil {
+		return err
+	}
+	defer r.Close()
+	return b.Put(dst, r, -1)
+}
@@ -0,0 +1,262 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/pem"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pkg/sftp"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// A SSH server serving SFTP on the local filesystem, only accepting the
+// client key
+type testSFTPServer struct {
+	t         *testing.T
+	listener  net.Listener
+	config    *ssh.ServerConfig
+	hostKey   ssh.PublicKey
+	clientKey ssh.PublicKey
+}
+
+func newTestSFTPServer(t *testing.T, clientKey ssh.PublicKey) *testSFTPServer {
+	_, hostPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerFromKey(hostPriv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return newTestSFTPServerWithHostKey(t, clientKey, hostSigner)
+}
+
+func newTestSFTPServerWithHostKey(t *testing.T, clientKey ssh.PublicKey, hostSigner ssh.Signer) *testSFTPServer {
+	listener, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	s := &testSFTPServer{t: t, listener: listener, hostKey: hostSigner.PublicKey(), clientKey: clientKey}
+	s.config = &ssh.ServerConfig{
+		PublicKeyCallback: func(conn ssh.ConnMetadata, key ssh.PublicKey) (*ssh.Permissions, error) {
+			if conn.User() == "deploy" && bytes.Equal(key.Marshal(), s.clientKey.Marshal()) {
+				return nil, nil
+			}
+			return nil, fmt.Errorf("unknown key for %s", conn.User())
+		},
+	}
+	s.config.AddHostKey(hostSigner)
+	go s.serve()
+	return s
+}
+
+func (s *testSFTPServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *testSFTPServer) handle(conn net.Conn) {
+	_, channels, requests, err := ssh.NewServerConn(conn, s.config)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	go ssh.DiscardRequests(requests)
+
+	for newChannel := range channels {
+		if newChannel.ChannelType() != "session" {
+			newChannel.Reject(ssh.UnknownChannelType, "unknown channel type")
+			continue
+		}
+		channel, requests, err := newChannel.Accept()
+		if err != nil {
+			s.t.Error(err)
+			return
+		}
+		go func() {
+			for req := range requests {
+				// The payload is the length prefixed name of the subsystem
+				ok := req.Type == "subsystem" && string(req.Payload[4:]) == "sftp"
+				req.Reply(ok, nil)
+				if ok {
+					server, err := sftp.NewServer(channel)
+					if err != nil {
+						s.t.Error(err)
+						return
+					}
+					go func() {
+						server.Serve()
+						server.Close()
+					}()
+				}
+			}
+		}()
+	}
+}
+
+func (s *testSFTPServer) addr() string {
+	return s.listener.Addr().String()
+}
+
+// The SSH settings of a client logging in with clientKey, hostKey being the
+// known key of addr
+func writeSSHConfig(t *testing.T, dir string, addr string, clientKey ed25519.PrivateKey, hostKey ssh.PublicKey) *Config {
+	block, err := ssh.MarshalPrivateKey(clientKey, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := &Config{
+		SSHKey:        filepath.Join(dir, "id_ed25519"),
+		SSHKnownHosts: filepath.Join(dir, "known_hosts"),
+	}
+	if err := ioutil.WriteFile(config.SSHKey, pem.EncodeToMemory(block), 0600); err != nil {
+		t.Fatal(err)
+	}
+	line := knownhosts.Line([]string{knownhosts.Normalize(addr)}, hostKey) + "\n"
+	if err := ioutil.WriteFile(config.SSHKnownHosts, []byte(line), 0644); err != nil {
+		t.Fatal(err)
+	}
+	return config
+}
+
+func TestSFTPBackendSync(t *testing.T) {
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestSFTPServer(t, sshPub)
+	defer server.listener.Close()
+
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	srcDir := filepath.Join(dir, "src")
+	dstDir := filepath.Join(dir, "dst")
+
+	writeFiles(t, srcDir, map[string]string{
+		"index.html":    "<html>new</html>",
+		"js/main.js":    "main()",
+		"css/style.css": "a{}",
+	})
+	writeFiles(t, dstDir, map[string]string{
+		"index.html":   "<html>previous</html>",
+		"js/stale.js":  "stale()",
+		"old/page.txt": "stale",
+	})
+
+	config := writeSSHConfig(t, dir, server.addr(), clientPriv, server.hostKey)
+	dst := "sftp://deploy@" + server.addr() + filepath.ToSlash(dstDir)
+	if err := S3Sync(config, srcDir+"/", dst); err != nil {
+		t.Fatal(err)
+	}
+
+	want := []string{"css/style.css", "index.html", "js/main.js"}
+	if files := listFiles(t, dstDir); !reflect.DeepEqual(files, want) {
+		t.Fatalf("got %v, want %v", files, want)
+	}
+	if content, _ := ioutil.ReadFile(filepath.Join(dstDir, "index.html")); string(content) != "<html>new</html>" {
+		t.Errorf("index.html: got %s", content)
+	}
+
+	// A same-size change is uploaded when the file is newer than the copy
+	writeFiles(t, srcDir, map[string]string{"js/main.js": "MAIN()", "css/style.css": "b{}"})
+	now := time.Now()
+	os.Chtimes(filepath.Join(srcDir, "js/main.js"), now, now.Add(time.Hour))
+	os.Chtimes(filepath.Join(srcDir, "css/style.css"), now, now.Add(-time.Hour))
+	if err := S3Sync(config, srcDir+"/", dst); err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name    string
+		content string
+	}{
+		{"js/main.js", "MAIN()"},
+		{"css/style.css", "a{}"},
+	}
+	for _, test := range tests {
+		if content, _ := ioutil.ReadFile(filepath.Join(dstDir, test.name)); string(content) != test.content {
+			t.Errorf("%s: got %s, want %s", test.name, content, test.content)
+		}
+	}
+}
+
+// The connection is refused when the host key is not the known one
+func TestSFTPBackendUnknownHostKey(t *testing.T) {
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestSFTPServer(t, sshPub)
+	defer server.listener.Close()
+
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	otherPub, _, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	otherKey, err := ssh.NewPublicKey(otherPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := writeSSHConfig(t, dir, server.addr(), clientPriv, otherKey)
+
+	backend, err := newSFTPBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := FileURINew("sftp://deploy@" + server.addr() + filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = backend.List(uri)
+	if err == nil || !strings.Contains(err.Error(), "key mismatch") {
+		t.Errorf("got %v, want a key mismatch", err)
+	}
+}
@@ -0,0 +1,190 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"os/user"
+	"path/filepath"
+
+	"golang.org/x/crypto/ed25519"
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+	"golang.org/x/crypto/ssh/knownhosts"
+)
+
+// Login of a SSH URI, defaulting to the current user
+func sshLogin(userinfo *url.Userinfo) string {
+	if userinfo != nil && userinfo.Username() != "" {
+		return userinfo.Username()
+	}
+	if u, err := user.Current(); err == nil {
+		return u.Username
+	}
+	return ""
+}
+
+// Address of a SSH host, the port defaulting to 22
+func sshAddress(host string) string {
+	if _, _, err := net.SplitHostPort(host); err != nil {
+		return net.JoinHostPort(host, "22")
+	}
+	return host
+}
+
+// sshClientConfig builds the configuration of a connection to addr, shared
+// by the SFTP backend and the git deployer. The returned function closes the
+// connection to the ssh agent, once the client is authenticated.
+func sshClientConfig(config *Config, userinfo *url.Userinfo, addr string) (*ssh.ClientConfig, func(), error) {
+	hostKeyCallback, algorithms, err := sshHostKeys(config, addr)
+	if err != nil {
+		return nil, nil, err
+	}
+	login := sshLogin(userinfo)
+	auth, closeAgent, err := sshAuthMethods(config, userinfo)
+	if err != nil {
+		return nil, nil, fmt.Errorf("%v for %s@%s", err, login, addr)
+	}
+
+	return &ssh.ClientConfig{
+		User:              login,
+		Auth:              auth,
+		HostKeyCallback:   hostKeyCallback,
+		HostKeyAlgorithms: algorithms,
+	}, closeAgent, nil
+}
+
+// Verify the host keys with the known_hosts file. The key types known for
+// addr are preferred, otherwise the server may offer another one and fail
+// the verification.
+func sshHostKeys(config *Config, addr string) (ssh.HostKeyCallback, []string, error) {
+	file := config.SSHKnownHosts
+	if file == "" {
+		home, err := os.UserHomeDir()
+		if err != nil {
+			return nil, nil, err
+		}
+		file = filepath.Join(home, ".ssh", "known_hosts")
+	}
+	callback, err := knownhosts.New(file)
+	if err != nil {
+		return nil, nil, fmt.Errorf("Unable to read the known hosts, set --ssh-known-hosts: %v", err)
+	}
+
+	// The known keys are reported when a key does not match
+	var types []string
+	probe, _ := ssh.NewPublicKey(ed25519.PublicKey(make([]byte, ed25519.PublicKeySize)))
+	remote := &net.TCPAddr{IP: net.IPv4zero}
+	if err, ok := callback(addr, remote, probe).(*knownhosts.KeyError); ok {
+		for _, known := range err.Want {
+			types = append(types, known.Key.Type())
+		}
+	}
+	return callback, hostKeyAlgorithms(types), nil
+}
+
+// Signature algorithms of the known host key types. The RSA keys sign with
+// SHA-2, ssh-rsa signs with SHA-1 which the current servers refuse, so it
+// comes last.
+func hostKeyAlgorithms(types []string) []string {
+	var algorithms []string
+	seen := make(map[string]bool)
+	add := func(algorithm string) {
+		if !seen[algorithm] {
+			seen[algorithm] = true
+			algorithms = append(algorithms, algorithm)
+		}
+	}
+	rsa := false
+	for _, t := range types {
+		if t == ssh.KeyAlgoRSA {
+			add(ssh.KeyAlgoRSASHA512)
+			add(ssh.KeyAlgoRSASHA256)
+			rsa = true
+			continue
+		}
+		add(t)
+	}
+	if rsa {
+		add(ssh.KeyAlgoRSA)
+	}
+	return algorithms
+}
+
+// Authenticate with the keys of the ssh agent and the private key files,
+// then with the password of the URI if any. The agent signs with the
+// connection closed by the returned function.
+func sshAuthMethods(config *Config, userinfo *url.Userinfo) ([]ssh.AuthMethod, func(), error) {
+	var signers []ssh.Signer
+	closeAgent := func() {}
+
+	if sock := os.Getenv("SSH_AUTH_SOCK"); sock != "" {
+		if conn, err := net.Dial("unix", sock); err == nil {
+			if agentSigners, err := agent.NewClient(conn).Signers(); err == nil && len(agentSigners) > 0 {
+				signers = append(signers, agentSigners...)
+				closeAgent = func() { conn.Close() }
+			} else {
+				conn.Close()
+			}
+		}
+	}
+
+	if config.SSHKey != "" {
+		signer, err := readPrivateKey(config.SSHKey)
+		if err != nil {
+			closeAgent()
+			return nil, nil, err
+		}
+		signers = append(signers, signer)
+	} else if home, err := os.UserHomeDir(); err == nil {
+		// The default keys are skipped when missing or protected by a passphrase
+		for _, name := range []string{"id_ed25519", "id_ecdsa", "id_rsa"} {
+			if signer, err := readPrivateKey(filepath.Join(home, ".ssh", name)); err == nil {
+				signers = append(signers, signer)
+			}
+		}
+	}
+
+	auth := make([]ssh.AuthMethod, 0)
+	if len(signers) > 0 {
+		auth = append(auth, ssh.PublicKeys(signers...))
+	}
+	if userinfo != nil {
+		if password, found := userinfo.Password(); found {
+			auth = append(auth, ssh.Password(password))
+		}
+	}
+	if len(auth) == 0 {
+		return nil, nil, fmt.Errorf("No SSH credentials, set --ssh-key or start an ssh agent")
+	}
+	return auth, closeAgent, nil
+}
+
+func readPrivateKey(file string) (ssh.Signer, error) {
+	pem, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read the SSH key: %v", err)
+	}
+	signer, err := ssh.ParsePrivateKey(pem)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to parse the SSH key %s, keys protected by a passphrase must be added to the ssh agent: %v", file, err)
+	}
+	return signer, nil
+}
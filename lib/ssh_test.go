@@ -0,0 +1,170 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"crypto/rsa"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/crypto/ssh/agent"
+)
+
+func TestHostKeyAlgorithms(t *testing.T) {
+	tests := []struct {
+		types      []string
+		algorithms []string
+	}{
+		{nil, nil},
+		{[]string{"ssh-ed25519"}, []string{"ssh-ed25519"}},
+		{[]string{"ssh-rsa"}, []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-rsa"}},
+		{[]string{"ssh-rsa", "ssh-ed25519", "ssh-rsa"}, []string{"rsa-sha2-512", "rsa-sha2-256", "ssh-ed25519", "ssh-rsa"}},
+		{[]string{"ecdsa-sha2-nistp256", "ssh-ed25519"}, []string{"ecdsa-sha2-nistp256", "ssh-ed25519"}},
+	}
+	for _, test := range tests {
+		if algorithms := hostKeyAlgorithms(test.types); !reflect.DeepEqual(algorithms, test.algorithms) {
+			t.Errorf("%v: got %v, want %v", test.types, algorithms, test.algorithms)
+		}
+	}
+}
+
+// A RSA host key signing with SHA-2 only, like the current OpenSSH servers
+func TestSFTPBackendRSAHostKey(t *testing.T) {
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaKey, err := rsa.GenerateKey(rand.Reader, 2048)
+	if err != nil {
+		t.Fatal(err)
+	}
+	rsaSigner, err := ssh.NewSignerFromKey(rsaKey)
+	if err != nil {
+		t.Fatal(err)
+	}
+	hostSigner, err := ssh.NewSignerWithAlgorithms(rsaSigner.(ssh.AlgorithmSigner), []string{ssh.KeyAlgoRSASHA512, ssh.KeyAlgoRSASHA256})
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestSFTPServerWithHostKey(t, sshPub, hostSigner)
+	defer server.listener.Close()
+
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	writeFiles(t, dir, map[string]string{"index.html": "<html></html>"})
+	config := writeSSHConfig(t, dir, server.addr(), clientPriv, hostSigner.PublicKey())
+
+	backend, err := newSFTPBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := FileURINew("sftp://deploy@" + server.addr() + filepath.ToSlash(filepath.Join(dir, "index.html")))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if file, err := backend.Stat(uri); err != nil || file == nil {
+		t.Errorf("got %v %v", file, err)
+	}
+}
+
+// The connection to the ssh agent is closed once the client is connected
+func TestSFTPBackendClosesAgent(t *testing.T) {
+	clientPub, clientPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	sshPub, err := ssh.NewPublicKey(clientPub)
+	if err != nil {
+		t.Fatal(err)
+	}
+	server := newTestSFTPServer(t, sshPub)
+	defer server.listener.Close()
+
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	keyring := agent.NewKeyring()
+	if err := keyring.Add(agent.AddedKey{PrivateKey: clientPriv}); err != nil {
+		t.Fatal(err)
+	}
+	sock := filepath.Join(dir, "agent.sock")
+	listener, err := net.Listen("unix", sock)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer listener.Close()
+	closed := make(chan bool, 1)
+	go func() {
+		conn, err := listener.Accept()
+		if err != nil {
+			return
+		}
+		agent.ServeAgent(keyring, conn)
+		closed <- true
+	}()
+
+	old, found := os.LookupEnv("SSH_AUTH_SOCK")
+	os.Setenv("SSH_AUTH_SOCK", sock)
+	defer func() {
+		if found {
+			os.Setenv("SSH_AUTH_SOCK", old)
+		} else {
+			os.Unsetenv("SSH_AUTH_SOCK")
+		}
+	}()
+
+	// The key file is not the client key, only the agent can log in
+	_, otherPriv, err := ed25519.GenerateKey(rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	config := writeSSHConfig(t, dir, server.addr(), otherPriv, server.hostKey)
+	backend, err := newSFTPBackend(config)
+	if err != nil {
+		t.Fatal(err)
+	}
+	uri, err := FileURINew("sftp://deploy@" + server.addr() + filepath.ToSlash(dir))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := backend.List(uri); err != nil {
+		t.Fatal(err)
+	}
+
+	select {
+	case <-closed:
+	case <-time.After(5 * time.Second):
+		t.Errorf("the agent connection is still open")
+	}
+}
@@ -0,0 +1,104 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"text/template"
+)
+
+// Extension of the files rendered in place by renderTemplateFiles
+const templateExt = ".tmpl"
+
+// Build the helpers available in the built-in and user supplied templates
+func templateFuncs(vars []EnvVar, globalName string) template.FuncMap {
+	funcs := template.FuncMap{
+		"global": func() string { return globalName },
+		"env": func(name string) string {
+			for _, v := range vars {
+				if v.Name == name {
+					return v.Value
+				}
+			}
+			return ""
+		},
+		"json": func(value interface{}) (string, error) {
+			b, err := json.Marshal(value)
+			return string(b), err
+		},
+		"quote": func(value interface{}) string {
+			return fmt.Sprintf("%q", fmt.Sprint(value))
+		},
+		"default": func(def interface{}, value interface{}) interface{} {
+			if value == nil || fmt.Sprint(value) == "" {
+				return def
+			}
+			return value
+		},
+		"upper": strings.ToUpper,
+		"lower": strings.ToLower,
+	}
+	for name, f := range tplFuncs {
+		funcs[name] = f
+	}
+	return funcs
+}
+
+// Load a user supplied template file
+func loadTemplate(file string, funcs template.FuncMap) (*template.Template, error) {
+	content, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, fmt.Errorf("Unable to read template %s: %v", file, err)
+	}
+	t, err := template.New(filepath.Base(file)).Funcs(funcs).Parse(string(content))
+	if err != nil {
+		return nil, fmt.Errorf("Invalid template %s: %v", file, err)
+	}
+	return t, nil
+}
+
+// Render every *.tmpl file of dir into the same file without the .tmpl
+// extension, the template itself is removed.
+func renderTemplateFiles(vars []EnvVar, dir string, config *DotEnvConfig) error {
+	globalName, err := configGlobalName(config)
+	if err != nil {
+		return err
+	}
+	funcs := templateFuncs(vars, globalName)
+
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if info.IsDir() || !strings.HasSuffix(path, templateExt) {
+			return nil
+		}
+
+		t, err := loadTemplate(path, funcs)
+		if err != nil {
+			return err
+		}
+		if err := renderTemplate(t, vars, strings.TrimSuffix(path, templateExt)); err != nil {
+			return err
+		}
+		return os.Remove(path)
+	})
+}
@@ -0,0 +1,74 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestRenderTemplateFilesGlobal(t *testing.T) {
+	vars := []EnvVar{{Name: "API_URL", Value: "x", Type: typeString}}
+	tests := []struct {
+		global string
+		want   string
+	}{
+		{"", `window._env_={"API_URL":"x"}`},
+		{"APP_CONFIG", `window.APP_CONFIG={"API_URL":"x"}`},
+	}
+
+	for _, test := range tests {
+		dir, err := ioutil.TempDir("", "go-deploy-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+
+		tmpl := filepath.Join(dir, "config.js.tmpl")
+		content := `window.{{ global }}={"API_URL":{{ jsString (env "API_URL") }}}`
+		if err := ioutil.WriteFile(tmpl, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+		if err := renderTemplateFiles(vars, dir, &DotEnvConfig{GlobalName: test.global}); err != nil {
+			t.Fatalf("global %q: %v", test.global, err)
+		}
+
+		out, err := ioutil.ReadFile(filepath.Join(dir, "config.js"))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(out) != test.want {
+			t.Errorf("global %q: got %s, want %s", test.global, out, test.want)
+		}
+		if _, err := os.Stat(tmpl); !os.IsNotExist(err) {
+			t.Errorf("global %q: the template was not removed", test.global)
+		}
+	}
+}
+
+func TestRenderTemplateFilesInvalidGlobal(t *testing.T) {
+	dir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	if err := renderTemplateFiles(nil, dir, &DotEnvConfig{GlobalName: "a-b"}); err == nil {
+		t.Error("an invalid global name must be rejected")
+	}
+}
@@ -0,0 +1,142 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"bytes"
+	"encoding/json"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// Types of the values in the generated config
+const (
+	typeString  = "string"
+	typeNumber  = "number"
+	typeBoolean = "boolean"
+	typeNull    = "null"
+	typeJSON    = "json"
+)
+
+// JSON number grammar, leading zeros are not allowed so that values like zip
+// codes stay strings
+var numberRe = regexp.MustCompile(`^-?(0|[1-9][0-9]*)(\.[0-9]+)?([eE][+-]?[0-9]+)?$`)
+
+// Largest integer of a JavaScript number, Number.MAX_SAFE_INTEGER
+const maxSafeInteger = 1<<53 - 1
+
+// A number that JavaScript reads back without losing precision: integers
+// beyond Number.MAX_SAFE_INTEGER and values overflowing to Infinity, like
+// ids or 1e400, stay strings
+func isSafeNumber(value string) bool {
+	if !numberRe.MatchString(value) {
+		return false
+	}
+	if !strings.ContainsAny(value, ".eE") {
+		n, err := strconv.ParseInt(value, 10, 64)
+		return err == nil && n >= -maxSafeInteger && n <= maxSafeInteger
+	}
+	_, err := strconv.ParseFloat(value, 64)
+	return err == nil
+}
+
+// Set the type of every variable, from its schema declaration when there is
+// one and inferred from its value otherwise. Without typed, every value is a
+// string as in the former versions.
+func setVarTypes(vars []EnvVar, schema []*varSchema, typed bool) {
+	declared := make(map[string]string)
+	for _, s := range schema {
+		declared[s.Name] = s.Type
+	}
+
+	for i := range vars {
+		vars[i].Type = typeString
+		if !typed {
+			continue
+		}
+
+		switch declared[vars[i].Name] {
+		case "int", "number":
+			vars[i].Type = typeNumber
+		case "bool":
+			vars[i].Type = typeBoolean
+		case "json":
+			vars[i].Type = typeJSON
+		case "":
+			vars[i].Type = inferType(vars[i].Value)
+		}
+	}
+}
+
+func inferType(value string) string {
+	switch {
+	case value == "true" || value == "false":
+		return typeBoolean
+	case value == "null":
+		return typeNull
+	case isSafeNumber(value):
+		return typeNumber
+	case (len(value) > 0 && (value[0] == '[' || value[0] == '{')) && json.Valid([]byte(value)):
+		return typeJSON
+	}
+	return typeString
+}
+
+// Encode a variable as a JavaScript literal of its type
+func jsValue(v EnvVar) string {
+	switch v.Type {
+	case typeNumber:
+		if isSafeNumber(v.Value) {
+			return v.Value
+		}
+		if f, err := strconv.ParseFloat(v.Value, 64); err == nil && !numberRe.MatchString(v.Value) {
+			// +1 or .5, but neither Infinity nor NaN
+			if formatted := strconv.FormatFloat(f, 'g', -1, 64); isSafeNumber(formatted) {
+				return formatted
+			}
+		}
+	case typeBoolean:
+		if b, err := strconv.ParseBool(v.Value); err == nil {
+			return strconv.FormatBool(b)
+		}
+	case typeNull:
+		return "null"
+	case typeJSON:
+		var compact bytes.Buffer
+		if err := json.Compact(&compact, []byte(v.Value)); err == nil {
+			// Escape <, > and & like jsString so that the config can be inlined
+			var escaped bytes.Buffer
+			json.HTMLEscape(&escaped, compact.Bytes())
+			return escaped.String()
+		}
+	}
+	return jsString(v.Value)
+}
+
+// TypeScript type of a variable, string when its value is emitted as such
+func tsType(v EnvVar) string {
+	if strings.HasPrefix(jsValue(v), `"`) {
+		return "string"
+	}
+	switch v.Type {
+	case typeNumber, typeBoolean, typeNull:
+		return v.Type
+	case typeJSON:
+		return "any"
+	}
+	return "string"
+}
@@ -0,0 +1,75 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"testing"
+)
+
+func TestInferType(t *testing.T) {
+	tests := []struct {
+		value string
+		typ   string
+	}{
+		{"true", typeBoolean},
+		{"null", typeNull},
+		{"50", typeNumber},
+		{"-1.5e3", typeNumber},
+		{"9007199254740991", typeNumber},
+		{"-9007199254740991", typeNumber},
+		{"9007199254740992", typeString},
+		{"-9007199254740992", typeString},
+		{"1234567890123456789", typeString},
+		{"123456789012345678901234567890", typeString},
+		{"1e400", typeString},
+		{"-1e400", typeString},
+		{"1e308", typeNumber},
+		{"01234", typeString},
+		{`["en","fr"]`, typeJSON},
+		{"Infinity", typeString},
+	}
+	for _, test := range tests {
+		if typ := inferType(test.value); typ != test.typ {
+			t.Errorf("inferType(%q) = %s, want %s", test.value, typ, test.typ)
+		}
+	}
+}
+
+// Numbers declared in the schema that JavaScript can't read back are strings
+func TestJsValueUnsafeNumbers(t *testing.T) {
+	tests := []struct {
+		value string
+		js    string
+		ts    string
+	}{
+		{"42", "42", "number"},
+		{"+5", "5", "number"},
+		{".5", "0.5", "number"},
+		{"1234567890123456789", `"1234567890123456789"`, "string"},
+		{"1e400", `"1e400"`, "string"},
+		{"Infinity", `"Infinity"`, "string"},
+		{"NaN", `"NaN"`, "string"},
+	}
+	for _, test := range tests {
+		v := EnvVar{Name: "N", Value: test.value, Type: typeNumber}
+		if js := jsValue(v); js != test.js {
+			t.Errorf("jsValue(%q) = %s, want %s", test.value, js, test.js)
+		}
+		if ts := tsType(v); ts != test.ts {
+			t.Errorf("tsType(%q) = %s, want %s", test.value, ts, test.ts)
+		}
+	}
+}
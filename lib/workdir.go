@@ -16,11 +16,34 @@ limitations under the License.
 package lib
 
 import (
+	"fmt"
 	"github.com/otiai10/copy"
 	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 )
 
-func BuildWorkDir(srcDir string, dotEnv string, configName string) (error, string) {
+// BuildWorkDir copies srcDir into a temporary work directory and generates
+// the runtime configuration in it. The variables are resolved before
+// anything is copied so that an invalid configuration fails early.
+func BuildWorkDir(srcDir string, config *DotEnvConfig) (error, string) {
+		err, vars := GetVars(srcDir, config)
+		if err != nil {
+		    return err, ""
+		}
+
+		err = CheckSecrets(vars, config.AllowSecrets)
+		if err != nil {
+		    return err, ""
+		}
+
+		if config.Verbose {
+		    for _, v := range vars {
+		        fmt.Printf("%s from %s\n", v.Name, v.Source)
+		    }
+		}
+
     // Create temporary workdir
 		workdir, err := ioutil.TempDir("/tmp", "go-deploy")
 		if err != nil {
@@ -33,12 +56,97 @@ func BuildWorkDir(srcDir string, dotEnv string, configName string) (error, strin
 		    return err, ""
 		}
 
-		// Generate env-config.js in workdir
-		err = GenerateDotEnv(srcDir + "/" + dotEnv, workdir + "/" + configName )
+		if len(config.Exclude) > 0 {
+		    err = removeExcluded(workdir, config.Exclude)
+		    if err != nil {
+		        return err, ""
+		    }
+		}
+
+		// The config template, the dotenv files, the schema and the settings
+		// of go-deploy are not part of the deployed application
+		sources, err := envSourceFiles(srcDir, config)
 		if err != nil {
 		    return err, ""
 		}
+		if settings := settingsFileIn(srcDir, config.SettingsFile); settings != "" {
+		    sources = append(sources, settings)
+		}
+		for _, file := range append(sources, config.Template) {
+		    if file != "" && !filepath.IsAbs(file) && !strings.HasPrefix(filepath.Clean(file), "..") {
+		        os.Remove(filepath.Join(workdir, file))
+		    }
+		}
+
+		if config.RenderTemplates {
+		    err = renderTemplateFiles(vars, workdir, config)
+		    if err != nil {
+		        return err, ""
+		    }
+		}
+
+		if config.Placeholders {
+		    err = replacePlaceholders(vars, workdir, config)
+		    if err != nil {
+		        return err, ""
+		    }
+		}
+
+		// Generate env-config.js and the other configured formats in workdir,
+		// after the steps above so that they don't alter the generated files
+		err = renderDotEnv(vars, srcDir, workdir, config)
+		if err != nil {
+		    return err, ""
+		}
+
+		if config.Inject != "" {
+		    err = injectConfig(vars, srcDir, workdir, config)
+		    if err != nil {
+		        return err, ""
+		    }
+		}
 
 		return nil, workdir
 
-}
\ No newline at end of file
+}
+
+// Path of the settings file relative to srcDir, empty when it is outside of
+// srcDir
+func settingsFileIn(srcDir string, file string) string {
+	if file == "" {
+		return ""
+	}
+	absDir, err := filepath.Abs(srcDir)
+	if err != nil {
+		return ""
+	}
+	absFile, err := filepath.Abs(file)
+	if err != nil {
+		return ""
+	}
+	rel, err := filepath.Rel(absDir, absFile)
+	if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+		return ""
+	}
+	return rel
+}
+
+// Remove the files and directories matching the exclude globs, either by
+// their path relative to dir or by their name.
+func removeExcluded(dir string, globs []string) error {
+	return filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path == dir || !matchesGlobs(dir, path, globs) {
+			return nil
+		}
+		if err := os.RemoveAll(path); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
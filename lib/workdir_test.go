@@ -0,0 +1,161 @@
+/*
+Copyright © 2019 Nuxeo
+
+Licensed under the Apache License, Version 2.0 (the "License");
+you may not use this file except in compliance with the License.
+You may obtain a copy of the License at
+
+    http://www.apache.org/licenses/LICENSE-2.0
+
+Unless required by applicable law or agreed to in writing, software
+distributed under the License is distributed on an "AS IS" BASIS,
+WITHOUT WARRANTIES OR CONDITIONS OF ANY KIND, either express or implied.
+See the License for the specific language governing permissions and
+limitations under the License.
+*/
+package lib
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+func writeFiles(t *testing.T, dir string, files map[string]string) {
+	for name, content := range files {
+		path := filepath.Join(dir, name)
+		if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+			t.Fatal(err)
+		}
+		if err := ioutil.WriteFile(path, []byte(content), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func listFiles(t *testing.T, dir string) []string {
+	files := make([]string, 0)
+	err := filepath.Walk(dir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || info.IsDir() {
+			return err
+		}
+		rel, err := filepath.Rel(dir, path)
+		files = append(files, filepath.ToSlash(rel))
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sort.Strings(files)
+	return files
+}
+
+// The dotenv layers and the schema are left out of the deployed files
+func TestBuildWorkDirRemovesEnvFiles(t *testing.T) {
+	tests := []struct {
+		mode     string
+		schema   string
+		deployed []string
+		vars     []string
+	}{
+		{
+			mode:     "",
+			deployed: []string{".env.production", "app/.env", "config/vars.schema", "env-config.js", "index.html"},
+			vars:     []string{"API_URL=local", "THEME=dark"},
+		},
+		{
+			mode:     "production",
+			deployed: []string{"app/.env", "config/vars.schema", "env-config.js", "index.html"},
+			vars:     []string{"API_URL=local", "THEME=light"},
+		},
+		{
+			// The configured schema is removed instead of the default one
+			mode:     "production",
+			schema:   "config/vars.schema",
+			deployed: []string{".env.schema", "app/.env", "env-config.js", "index.html"},
+			vars:     []string{"API_URL=local", "THEME=light"},
+		},
+	}
+
+	for _, test := range tests {
+		srcDir, err := ioutil.TempDir("", "go-deploy-test")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(srcDir)
+		writeFiles(t, srcDir, map[string]string{
+			".env":               "API_URL=base\nTHEME=dark\n",
+			".env.production":    "API_URL=production\nTHEME=light\n",
+			".env.local":         "API_URL=local\n",
+			".env.schema":        "API_URL required\n",
+			"config/vars.schema": "THEME required\n",
+			"index.html":         "<html></html>",
+			"app/.env":           "not a layer",
+		})
+
+		config := &DotEnvConfig{ConfigName: "env-config.js", Mode: test.mode, SchemaFile: test.schema}
+		err, workdir := BuildWorkDir(srcDir, config)
+		if err != nil {
+			t.Fatalf("mode %q: %v", test.mode, err)
+		}
+		defer os.RemoveAll(workdir)
+
+		deployed := listFiles(t, workdir)
+		if !reflect.DeepEqual(deployed, test.deployed) {
+			t.Errorf("mode %q schema %q: deployed %v, want %v", test.mode, test.schema, deployed, test.deployed)
+		}
+
+		err, vars := GetVars(srcDir, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		values := make([]string, 0)
+		for _, v := range vars {
+			values = append(values, v.Name+"="+v.Value)
+		}
+		if !reflect.DeepEqual(values, test.vars) {
+			t.Errorf("mode %q: got %v, want %v", test.mode, values, test.vars)
+		}
+	}
+}
+
+// The settings of go-deploy may hold credentials, they are not published
+// when they are read from the source directory
+func TestBuildWorkDirRemovesSettingsFile(t *testing.T) {
+	srcDir, err := ioutil.TempDir("", "go-deploy-test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(srcDir)
+	writeFiles(t, srcDir, map[string]string{
+		".env":               "API_URL=base\n",
+		"go-deploy.yaml":     "secret-key: s3cr3t\n",
+		"conf/go-deploy.yml": "azure-key: s3cr3t\n",
+		"index.html":         "<html></html>",
+	})
+
+	tests := []struct {
+		settings string
+		deployed []string
+	}{
+		{"", []string{"conf/go-deploy.yml", "env-config.js", "go-deploy.yaml", "index.html"}},
+		{filepath.Join(srcDir, "go-deploy.yaml"), []string{"conf/go-deploy.yml", "env-config.js", "index.html"}},
+		{filepath.Join(srcDir, "conf", "..", "conf", "go-deploy.yml"), []string{"env-config.js", "go-deploy.yaml", "index.html"}},
+		{filepath.Join(srcDir, "..", "go-deploy.yaml"), []string{"conf/go-deploy.yml", "env-config.js", "go-deploy.yaml", "index.html"}},
+	}
+	for _, test := range tests {
+		config := &DotEnvConfig{ConfigName: "env-config.js", SettingsFile: test.settings}
+		err, workdir := BuildWorkDir(srcDir, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(workdir)
+
+		if deployed := listFiles(t, workdir); !reflect.DeepEqual(deployed, test.deployed) {
+			t.Errorf("settings %s: deployed %v, want %v", test.settings, deployed, test.deployed)
+		}
+	}
+}